@@ -0,0 +1,418 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "github.com/pablo11/Peerster/sdk"
+)
+
+const (
+    INTERACTIVE_POLL_PERIOD time.Duration = 1 // Seconds between two updates of the interactive session
+    INTERACTIVE_HISTORY_LEN uint32 = 10 // Messages shown when the session starts
+    INTERACTIVE_MESSAGES_LIMIT uint32 = 100 // Messages fetched at most by each update
+)
+
+// Commands of the interactive session, the queries of the client are also accepted
+var INTERACTIVE_COMMANDS = []string{"help", "msg", "pm", "status", "index", "download", "pause", "resume", "cancel", "priority", "find", "quit"}
+
+const INTERACTIVE_HELP = `Commands:
+  msg <text>                          send a rumor
+  pm <dest> <text>                    send a private message
+  status <id>                         delivery state of a private message
+  index <path>                        index a local file, or a file of the shared files directory
+  download <filename> <metahash> [dest]
+                                      download a file, from dest or from the search matches
+  pause <metahash>                    pause a download
+  resume <metahash>                   resume a paused or interrupted download, or retry it at once
+  cancel <metahash>                   cancel a download
+  priority <metahash> <n>             set the priority of a download, the highest queued ones start first
+  find <keyword,keyword> [budget]     search files in the network
+  id, peers, routes, messages, files, downloads, search, chain, names [limit]
+                                      query the state of the gossiper
+  help                                show this help
+  quit                                close the session (or Ctrl-D)
+Tab completes commands, origins, filenames and metahashes. New messages,
+download progress and search matches are shown as they arrive.`
+
+// Interactive session with one gossiper
+type session struct {
+    client *sdk.UIClient
+    format string
+    editor *lineEditor
+
+    // Seq of the last message shown
+    lastSeq uint64
+    // Metahash -> progress of the downloads last shown
+    downloads map[string]string
+    // Metahashes of the search matches already shown
+    matches map[string]bool
+    isConnected bool
+
+    // Completion candidates, refreshed by the updates
+    origins []string
+    filenames []string
+    metahashes []string
+    candidatesMutex sync.Mutex
+}
+
+func newSession(client *sdk.UIClient, format string) *session {
+    return &session{
+        client: client,
+        format: format,
+        editor: nil,
+        lastSeq: 0,
+        downloads: make(map[string]string),
+        matches: make(map[string]bool),
+        isConnected: true,
+        origins: make([]string, 0),
+        filenames: make([]string, 0),
+        metahashes: make([]string, 0),
+        candidatesMutex: sync.Mutex{},
+    }
+}
+
+// Open an interactive session with the gossiper of client
+func runInteractive(client *sdk.UIClient, format string) {
+    s := newSession(client, format)
+
+    id, err := client.Identity()
+    exitOnError(err)
+
+    s.editor = newLineEditor(id.Name + "> ", s.complete)
+    s.editor.Open()
+    defer s.editor.Close()
+
+    s.editor.Println(fmt.Sprintf("Connected to %s (%s), type help for the list of commands", id.Name, id.Address))
+
+    // Show the recent messages and the current state before listening to updates
+    s.update(true)
+    go func() {
+        for {
+            time.Sleep(INTERACTIVE_POLL_PERIOD * time.Second)
+            s.update(false)
+        }
+    }()
+
+    for {
+        line, err := s.editor.ReadLine()
+        if err != nil {
+            return
+        }
+
+        args := strings.Fields(line)
+        if len(args) == 0 {
+            continue
+        }
+        if args[0] == "quit" || args[0] == "exit" {
+            return
+        }
+
+        output := bytes.Buffer{}
+        if err := s.run(&output, args, line); err != nil {
+            output.WriteString("Error: " + err.Error() + "\n")
+        }
+        if output.Len() > 0 {
+            s.editor.Println(output.String())
+        }
+    }
+}
+
+// Execute the command typed by the user
+func (s *session) run(w io.Writer, args []string, line string) error {
+    switch args[0] {
+        case "help":
+            fmt.Fprintln(w, INTERACTIVE_HELP)
+            return nil
+
+        case "msg":
+            text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "msg"))
+            id, err := s.client.SendMessage(text)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Message sent, ID %d\n", id)
+            return nil
+
+        case "pm":
+            if len(args) < 3 {
+                return errors.New("usage: pm <dest> <text>")
+            }
+            text := strings.TrimSpace(line)
+            text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(text, "pm")), args[1]))
+            id, err := s.client.SendPrivateMessage(args[1], text)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Private message to %s sent, ID %d\n", args[1], id)
+            return nil
+
+        case "status":
+            if len(args) != 2 {
+                return errors.New("usage: status <id>")
+            }
+            id, err := strconv.ParseUint(args[1], 10, 32)
+            if err != nil {
+                return errors.New("invalid message id " + args[1])
+            }
+            delivery, err := s.client.MessageStatus(uint32(id))
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Message %d to %s: %s after %d attempts\n", delivery.ID, delivery.Destination, delivery.State, delivery.Attempts)
+            return nil
+
+        case "index":
+            if len(args) != 2 {
+                return errors.New("usage: index <path>")
+            }
+            metahash, err := s.client.IndexFile(localPath(args[1]))
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Indexed %s, metahash %s\n", args[1], metahash)
+            return nil
+
+        case "download":
+            if len(args) != 3 && len(args) != 4 {
+                return errors.New("usage: download <filename> <metahash> [dest]")
+            }
+            dest := ""
+            if len(args) == 4 {
+                dest = args[3]
+            }
+            if err := s.client.DownloadFile(args[1], args[2], dest); err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Downloading %s\n", args[1])
+            return nil
+
+        case "pause", "resume", "cancel":
+            if len(args) != 2 {
+                return errors.New("usage: " + args[0] + " <metahash>")
+            }
+            var err error
+            var done string
+            switch args[0] {
+                case "pause":
+                    err, done = s.client.PauseDownload(args[1]), "Paused"
+                case "resume":
+                    err, done = s.client.ResumeDownload(args[1]), "Resumed"
+                case "cancel":
+                    err, done = s.client.CancelDownload(args[1]), "Cancelled"
+            }
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "%s the download of %s\n", done, args[1])
+            return nil
+
+        case "priority":
+            if len(args) != 3 {
+                return errors.New("usage: priority <metahash> <n>")
+            }
+            priority, err := strconv.Atoi(args[2])
+            if err != nil {
+                return errors.New("invalid priority " + args[2])
+            }
+            if err := s.client.SetDownloadPriority(args[1], priority); err != nil {
+                return err
+            }
+            fmt.Fprintf(w, "Set the priority of the download of %s to %d\n", args[1], priority)
+            return nil
+
+        case "find":
+            if len(args) != 2 && len(args) != 3 {
+                return errors.New("usage: find <keyword,keyword> [budget]")
+            }
+            var budget uint64 = 0
+            if len(args) == 3 {
+                var err error
+                if budget, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+                    return errors.New("invalid budget " + args[2])
+                }
+            }
+            if err := s.client.Search(strings.Split(args[1], ","), budget); err != nil {
+                return err
+            }
+            fmt.Fprintln(w, "Search started, matches are shown as they arrive")
+            return nil
+    }
+
+    if !isQuery(args[0]) {
+        return errors.New("unknown command " + args[0] + ", type help for the list of commands")
+    }
+
+    var limit uint64 = 0
+    if len(args) > 1 {
+        var err error
+        if limit, err = strconv.ParseUint(args[1], 10, 32); err != nil {
+            return errors.New("invalid limit " + args[1])
+        }
+    }
+    result, err := runQuery(s.client, args[0], uint32(limit))
+    if err != nil {
+        return err
+    }
+    printResult(w, s.format, result)
+    return nil
+}
+
+// Words that can follow the words already typed
+func (s *session) complete(args []string) []string {
+    if len(args) == 0 {
+        return append(append([]string{}, INTERACTIVE_COMMANDS...), QUERIES...)
+    }
+
+    s.candidatesMutex.Lock()
+    defer s.candidatesMutex.Unlock()
+
+    switch {
+        case args[0] == "pm" && len(args) == 1:
+            return s.origins
+        case args[0] == "download" && len(args) == 1:
+            return s.filenames
+        case args[0] == "download" && len(args) == 2:
+            return s.metahashes
+        case args[0] == "download" && len(args) == 3:
+            return s.origins
+        case (args[0] == "pause" || args[0] == "resume" || args[0] == "cancel" || args[0] == "priority") && len(args) == 1:
+            return s.metahashes
+    }
+    return []string{}
+}
+
+// Show what changed since the last update: new messages, download progress
+// and search matches. The first update only shows the recent messages
+func (s *session) update(isFirst bool) {
+    output := bytes.Buffer{}
+    err := s.updateMessages(&output, isFirst)
+    if err == nil {
+        err = s.updateFiles(&output, isFirst)
+    }
+    if err == nil {
+        err = s.updateCandidates()
+    }
+
+    if err != nil && s.isConnected {
+        output.WriteString("Lost connection to the gossiper: " + err.Error() + "\n")
+    } else if err == nil && !s.isConnected {
+        output.WriteString("Connection to the gossiper restored\n")
+    }
+    s.isConnected = err == nil
+
+    if output.Len() > 0 {
+        s.editor.Println(output.String())
+    }
+}
+
+func (s *session) updateMessages(w io.Writer, isFirst bool) error {
+    limit := INTERACTIVE_MESSAGES_LIMIT
+    if isFirst {
+        limit = INTERACTIVE_HISTORY_LEN
+    }
+
+    messages, err := s.client.Messages(limit, s.lastSeq)
+    if err != nil {
+        return err
+    }
+
+    for _, m := range messages {
+        if m.Seq > s.lastSeq {
+            s.lastSeq = m.Seq
+        }
+
+        timestamp := m.Timestamp.Local().Format("15:04:05")
+        if m.Type == "private" {
+            fmt.Fprintf(w, "%s [private] %s -> %s: %s\n", timestamp, m.Origin, m.Destination, m.Text)
+        } else {
+            fmt.Fprintf(w, "%s [%s] %s: %s\n", timestamp, m.Type, m.Origin, m.Text)
+        }
+    }
+    return nil
+}
+
+func (s *session) updateFiles(w io.Writer, isFirst bool) error {
+    files, err := s.client.Files()
+    if err != nil {
+        return err
+    }
+
+    filenames := make([]string, 0)
+    metahashes := make([]string, 0)
+
+    for _, f := range files {
+        filenames = append(filenames, f.Name)
+        metahashes = append(metahashes, f.MetaHash)
+
+        shownProgress, isShown := s.downloads[f.MetaHash]
+        if f.State == sdk.FILE_DOWNLOADING {
+            if currentProgress := progress(f); currentProgress != shownProgress {
+                fmt.Fprintf(w, "Downloading %s: %s\n", f.Name, currentProgress)
+                s.downloads[f.MetaHash] = currentProgress
+            }
+        } else if isShown {
+            fmt.Fprintf(w, "Downloaded %s\n", f.Name)
+            delete(s.downloads, f.MetaHash)
+        }
+    }
+
+    matches, err := s.client.SearchResults()
+    if err != nil {
+        return err
+    }
+
+    for _, m := range matches {
+        filenames = append(filenames, m.Filename)
+        metahashes = append(metahashes, m.MetaHash)
+
+        if !s.matches[m.MetaHash] {
+            s.matches[m.MetaHash] = true
+            if !isFirst {
+                fmt.Fprintf(w, "Search match %s (%d chunks), metahash %s\n", m.Filename, m.NbChunks, m.MetaHash)
+            }
+        }
+    }
+
+    s.candidatesMutex.Lock()
+    s.filenames = uniqueSorted(filenames)
+    s.metahashes = uniqueSorted(metahashes)
+    s.candidatesMutex.Unlock()
+    return nil
+}
+
+func (s *session) updateCandidates() error {
+    routes, err := s.client.Routes()
+    if err != nil {
+        return err
+    }
+
+    origins := make([]string, len(routes))
+    for i, route := range routes {
+        origins[i] = route.Origin
+    }
+
+    s.candidatesMutex.Lock()
+    s.origins = uniqueSorted(origins)
+    s.candidatesMutex.Unlock()
+    return nil
+}
+
+func uniqueSorted(words []string) []string {
+    seen := make(map[string]bool)
+    unique := make([]string, 0, len(words))
+    for _, word := range words {
+        if !seen[word] {
+            seen[word] = true
+            unique = append(unique, word)
+        }
+    }
+    sort.Strings(unique)
+    return unique
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "sync"
+    "bufio"
+    "os/exec"
+    "strings"
+)
+
+// Minimal line editor for the interactive session: history, tab completion
+// and lines printed above the prompt while the user is typing. The terminal
+// is switched to non canonical mode with stty, when stdin is not a terminal
+// lines are read as they come
+type lineEditor struct {
+    prompt string
+    reader *bufio.Reader
+    isTerminal bool
+    // Terminal settings restored on Close
+    savedState string
+
+    // Return the words that can follow args, the words already typed
+    complete func(args []string) []string
+
+    line []rune
+    isReading bool
+    history []string
+    historyPos int
+    lineMutex sync.Mutex
+}
+
+func newLineEditor(prompt string, complete func(args []string) []string) *lineEditor {
+    return &lineEditor{
+        prompt: prompt,
+        reader: bufio.NewReader(os.Stdin),
+        isTerminal: false,
+        savedState: "",
+        complete: complete,
+        line: make([]rune, 0),
+        isReading: false,
+        history: make([]string, 0),
+        historyPos: 0,
+        lineMutex: sync.Mutex{},
+    }
+}
+
+// Put the terminal in non canonical mode, without echo nor signals
+func (e *lineEditor) Open() {
+    if stat, err := os.Stdin.Stat(); err != nil || stat.Mode() & os.ModeCharDevice == 0 {
+        return
+    }
+
+    savedState, err := stty("-g")
+    if err != nil {
+        return
+    }
+    if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+        return
+    }
+    e.savedState = strings.TrimSpace(savedState)
+    e.isTerminal = true
+}
+
+// Restore the terminal settings
+func (e *lineEditor) Close() {
+    if e.isTerminal {
+        stty(e.savedState)
+        e.isTerminal = false
+    }
+}
+
+func stty(args ...string) (string, error) {
+    cmd := exec.Command("stty", args...)
+    cmd.Stdin = os.Stdin
+    output, err := cmd.Output()
+    return string(output), err
+}
+
+// Print text above the line being typed
+func (e *lineEditor) Println(text string) {
+    e.lineMutex.Lock()
+    defer e.lineMutex.Unlock()
+
+    if !strings.HasSuffix(text, "\n") {
+        text += "\n"
+    }
+
+    if !e.isTerminal {
+        fmt.Print(text)
+        return
+    }
+
+    fmt.Print("\r\033[K" + text)
+    if e.isReading {
+        e.redraw()
+    }
+}
+
+// Read the next line typed by the user. Returns io.EOF when stdin is closed
+// or Ctrl-D is typed on an empty line
+func (e *lineEditor) ReadLine() (string, error) {
+    if !e.isTerminal {
+        line, err := e.reader.ReadString('\n')
+        if err != nil && (err != io.EOF || line == "") {
+            return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+    }
+
+    e.lineMutex.Lock()
+    e.line = e.line[:0]
+    e.historyPos = len(e.history)
+    e.isReading = true
+    e.redraw()
+    e.lineMutex.Unlock()
+
+    for {
+        r, _, err := e.reader.ReadRune()
+        if err != nil {
+            e.stopReading("\n")
+            return "", err
+        }
+
+        // Escape sequences of the arrows: ESC [ X
+        escape := ' '
+        if r == 27 {
+            if next, _, err := e.reader.ReadRune(); err != nil || next != '[' {
+                continue
+            }
+            escape, _, _ = e.reader.ReadRune()
+        }
+
+        e.lineMutex.Lock()
+        switch r {
+            case '\n', '\r':
+                line := string(e.line)
+                if strings.TrimSpace(line) != "" {
+                    e.history = append(e.history, line)
+                }
+                e.lineMutex.Unlock()
+                e.stopReading("\n")
+                return line, nil
+
+            // Ctrl-C clears the line
+            case 3:
+                e.line = e.line[:0]
+                fmt.Print("^C\n")
+                e.redraw()
+
+            // Ctrl-D closes the session on an empty line
+            case 4:
+                if len(e.line) == 0 {
+                    e.lineMutex.Unlock()
+                    e.stopReading("\n")
+                    return "", io.EOF
+                }
+
+            // Backspace
+            case 8, 127:
+                if len(e.line) > 0 {
+                    e.line = e.line[:len(e.line) - 1]
+                    e.redraw()
+                }
+
+            // Ctrl-U clears the line
+            case 21:
+                e.line = e.line[:0]
+                e.redraw()
+
+            case '\t':
+                e.completeLine()
+
+            case 27:
+                e.browseHistory(escape)
+
+            default:
+                if r >= 32 {
+                    e.line = append(e.line, r)
+                    e.redraw()
+                }
+        }
+        e.lineMutex.Unlock()
+    }
+}
+
+func (e *lineEditor) stopReading(end string) {
+    e.lineMutex.Lock()
+    defer e.lineMutex.Unlock()
+
+    e.isReading = false
+    fmt.Print(end)
+}
+
+// Must be called with lineMutex locked
+func (e *lineEditor) redraw() {
+    fmt.Print("\r\033[K" + e.prompt + string(e.line))
+}
+
+// Up and down arrows walk through the lines typed before. Must be called with
+// lineMutex locked
+func (e *lineEditor) browseHistory(arrow rune) {
+    if arrow == 'A' && e.historyPos > 0 {
+        e.historyPos -= 1
+    } else if arrow == 'B' && e.historyPos < len(e.history) {
+        e.historyPos += 1
+    } else {
+        return
+    }
+
+    e.line = e.line[:0]
+    if e.historyPos < len(e.history) {
+        e.line = append(e.line, []rune(e.history[e.historyPos])...)
+    }
+    e.redraw()
+}
+
+// Complete the last word of the line. Must be called with lineMutex locked
+func (e *lineEditor) completeLine() {
+    text := string(e.line)
+    start := strings.LastIndex(text, " ") + 1
+    word := text[start:]
+
+    matches := make([]string, 0)
+    for _, candidate := range e.complete(strings.Fields(text[:start])) {
+        if strings.HasPrefix(candidate, word) {
+            matches = append(matches, candidate)
+        }
+    }
+
+    switch len(matches) {
+        case 0:
+            fmt.Print("\a")
+
+        case 1:
+            e.line = []rune(text[:start] + matches[0] + " ")
+            e.redraw()
+
+        default:
+            prefix := commonPrefix(matches)
+            if len(prefix) > len(word) {
+                e.line = []rune(text[:start] + prefix)
+            } else {
+                fmt.Print("\r\033[K" + strings.Join(matches, "  ") + "\n")
+            }
+            e.redraw()
+    }
+}
+
+func commonPrefix(words []string) string {
+    prefix := words[0]
+    for _, word := range words[1:] {
+        for !strings.HasPrefix(word, prefix) {
+            prefix = prefix[:len(prefix) - 1]
+        }
+    }
+    return prefix
+}
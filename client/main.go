@@ -1,14 +1,18 @@
 package main
 
 import (
+    "os"
     "fmt"
     "flag"
-    "net"
+    "time"
     "strings"
-    "github.com/dedis/protobuf"
-    "github.com/pablo11/Peerster/model"
+    "math/rand"
+    "path/filepath"
+    "github.com/pablo11/Peerster/sdk"
 )
 
+const DELIVERY_POLL_PERIOD time.Duration = 500 // Milliseconds between two delivery state requests
+
 func main() {
     // Definition of the cli flags
     uiPort := flag.String("UIPort", "8080", "Port for the UI client (default \"8080\")")
@@ -18,69 +22,149 @@ func main() {
     request := flag.String("request", "", "Request a chunk or metafile of this hash")
     keywords := flag.String("keywords", "", "Keywords for the file search")
     budget := flag.Int("budget", 0, "Budget for the file search")
+    wait := flag.Bool("wait", false, "Wait until the private message is delivered, kept in the mailbox or failed")
+    format := flag.String("format", "table", "Output format of queries: table or json")
+    limit := flag.Int("limit", 0, "Maximum number of messages, blocks, files or search results returned by queries")
+    interactive := flag.Bool("interactive", false, "Open an interactive session with the gossiper")
+    resume := flag.Bool("resume", false, "Resume the download of the metahash given by -request")
+    pause := flag.Bool("pause", false, "Pause the download of the metahash given by -request")
+    cancel := flag.Bool("cancel", false, "Cancel the download of the metahash given by -request")
+    priority := flag.Int("priority", 0, "Priority of a new download, or of the download of the metahash given by -request")
+
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "Usage: client [flags] [query]")
+        fmt.Fprintln(os.Stderr, "Queries: " + strings.Join(QUERIES, ", "))
+        fmt.Fprintln(os.Stderr, "Flags:")
+        flag.PrintDefaults()
+    }
 
     flag.Parse()
 
+    isPrioritySet := false
+    flag.Visit(func(f *flag.Flag) {
+        isPrioritySet = isPrioritySet || f.Name == "priority"
+    })
+
+    rand.Seed(time.Now().UnixNano())
+
+    if *format != "table" && *format != "json" {
+        fmt.Fprintln(os.Stderr, "Error: format must be table or json")
+        os.Exit(2)
+    }
+
+    client := sdk.NewUIClient(*uiPort)
+
+    if *interactive {
+        runInteractive(client, *format)
+        return
+    }
+
+    // Query the state of the gossiper
+    if flag.NArg() > 0 {
+        if !isQuery(flag.Arg(0)) {
+            fmt.Fprintln(os.Stderr, "Error: unknown query " + flag.Arg(0) + ", expected one of " + strings.Join(QUERIES, ", "))
+            os.Exit(2)
+        }
+        if *limit < 0 {
+            fmt.Fprintln(os.Stderr, "Error: limit must be positive")
+            os.Exit(2)
+        }
+        result, err := runQuery(client, flag.Arg(0), uint32(*limit))
+        exitOnError(err)
+        printResult(os.Stdout, *format, result)
+        return
+    }
+
     // Ask to index file
     if *file != "" && *request == "" {
-        //indexFile("../_SharedFiles/" + *file)
+        metahash, err := client.IndexFile(localPath(*file))
+        exitOnError(err)
+        fmt.Println("Indexed " + *file + ", metahash " + metahash)
+        return
+    }
 
-        cm := &model.ClientMessage{
-            Type: "indexFile",
-            File: *file,
+    // Control a download
+    if *resume || *pause || *cancel || (isPrioritySet && *file == "") {
+        if *request == "" {
+            fmt.Fprintln(os.Stderr, "Error: the metahash of the download is required in -request")
+            os.Exit(2)
+        }
+        switch {
+            case *resume:
+                exitOnError(client.ResumeDownload(*request))
+                fmt.Println("Resumed the download of " + *request)
+            case *pause:
+                exitOnError(client.PauseDownload(*request))
+                fmt.Println("Paused the download of " + *request)
+            case *cancel:
+                exitOnError(client.CancelDownload(*request))
+                fmt.Println("Cancelled the download of " + *request)
+            default:
+                exitOnError(client.SetDownloadPriority(*request, *priority))
+                fmt.Printf("Set the priority of the download of %s to %d\n", *request, *priority)
         }
-        sendPacket(cm, *uiPort)
         return
     }
 
     // Ask to download file
-    if *file != "" && *request != "" && *dest != "" {
-        cm := &model.ClientMessage{
-            Type: "downloadFile",
-            File: *file,
-            Request: *request,
-            Dest: *dest,
-        }
-        sendPacket(cm, *uiPort)
+    if *file != "" && *request != "" {
+        exitOnError(client.DownloadFileWithPriority(*file, *request, *dest, *priority))
+        fmt.Println("Downloading " + *file)
         return
     }
 
     // Send message
     if *msg != "" {
-        cm := &model.ClientMessage{
-            Type: "msg",
-            Text: *msg,
-            Dest: *dest,
+        if *dest == "" {
+            id, err := client.SendMessage(*msg)
+            exitOnError(err)
+            fmt.Printf("Message sent, ID %d\n", id)
+            return
+        }
+
+        id, err := client.SendPrivateMessage(*dest, *msg)
+        exitOnError(err)
+        fmt.Printf("Private message to %s sent, ID %d\n", *dest, id)
+
+        if *wait {
+            // Wait until the message is not pending anymore
+            delivery, err := client.WaitDelivery(id, DELIVERY_POLL_PERIOD * time.Millisecond)
+            exitOnError(err)
+            fmt.Println("Delivery state: " + delivery.State)
+            if delivery.State == sdk.DELIVERY_FAILED {
+                os.Exit(1)
+            }
         }
-        sendPacket(cm, *uiPort)
         return
     }
 
     // Send search request
     if *keywords != "" {
-        cm := &model.ClientMessage{
-            Type: "searchFile",
-            Keywords: strings.Split(*keywords, ","),
-            Budget: uint64(*budget),
-        }
-        sendPacket(cm, *uiPort)
+        exitOnError(client.Search(strings.Split(*keywords, ","), uint64(*budget)))
+        fmt.Println("Search started")
         return
     }
 
     fmt.Println("Please provide some parameters")
+    os.Exit(2)
 }
 
-func sendPacket(cm *model.ClientMessage, uiPort string) {
-    packetBytes, err := protobuf.Encode(cm)
-    if err != nil {
-        fmt.Println(err)
-        return
+// Paths of files to index are relative to the working directory of the
+// client, names that don't exist there are looked up by the gossiper in its
+// shared files directory
+func localPath(path string) string {
+    if absPath, err := filepath.Abs(path); err == nil {
+        if _, err := os.Stat(absPath); err == nil {
+            return absPath
+        }
     }
+    return path
+}
 
-    conn, e := net.Dial("udp", "127.0.0.1:" + uiPort)
-	defer conn.Close()
-	if e != nil {
-		fmt.Println(e)
-	}
-	conn.Write(packetBytes)
+// Print the error and exit with status 1 if err is not nil
+func exitOnError(err error) {
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+        os.Exit(1)
+    }
 }
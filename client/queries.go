@@ -0,0 +1,186 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "errors"
+    "strings"
+    "strconv"
+    "text/tabwriter"
+    "encoding/json"
+    "github.com/pablo11/Peerster/sdk"
+)
+
+const TIME_FORMAT = "2006-01-02 15:04:05"
+
+// Queries of the state of the gossiper accepted as subcommand
+var QUERIES = []string{"peers", "routes", "messages", "files", "downloads", "search", "chain", "names", "id"}
+
+func isQuery(name string) bool {
+    for _, query := range QUERIES {
+        if query == name {
+            return true
+        }
+    }
+    return false
+}
+
+// Send the query to the gossiper and return its typed result
+func runQuery(client *sdk.UIClient, query string, limit uint32) (interface{}, error) {
+    switch query {
+        case "peers":
+            return client.Peers()
+        case "routes":
+            return client.Routes()
+        case "messages":
+            return client.Messages(limit, 0)
+        case "files":
+            if limit > 0 {
+                files, _, err := client.FilesPage(limit, 0)
+                return files, err
+            }
+            return client.Files()
+        case "downloads":
+            return client.Downloads()
+        case "search":
+            if limit > 0 {
+                results, _, err := client.SearchResultsPage(limit, 0)
+                return results, err
+            }
+            return client.SearchResults()
+        case "chain":
+            return client.Chain(limit)
+        case "names":
+            return client.Names()
+        case "id":
+            return client.Identity()
+        default:
+            return nil, errors.New("unknown query " + query + ", expected one of " + strings.Join(QUERIES, ", "))
+    }
+}
+
+// Print the result of a query to w
+func printResult(w io.Writer, format string, result interface{}) {
+    if format == "json" {
+        output, _ := json.MarshalIndent(result, "", "  ")
+        fmt.Fprintln(w, string(output))
+        return
+    }
+
+    rows := make([][]string, 0)
+    switch r := result.(type) {
+        case []sdk.Peer:
+            rows = append(rows, []string{"ADDRESS", "SCORE", "BANNED"})
+            for _, p := range r {
+                rows = append(rows, []string{p.Address, strconv.FormatFloat(p.Score, 'f', -1, 64), strconv.FormatBool(p.Banned)})
+            }
+
+        case []sdk.Route:
+            rows = append(rows, []string{"ORIGIN", "NEXT HOP"})
+            for _, route := range r {
+                rows = append(rows, []string{route.Origin, route.NextHop})
+            }
+
+        case []sdk.Message:
+            rows = append(rows, []string{"TIME", "TYPE", "ORIGIN", "DEST", "ID", "TEXT"})
+            for _, m := range r {
+                rows = append(rows, []string{m.Timestamp.Local().Format(TIME_FORMAT), m.Type, m.Origin, m.Destination, strconv.FormatUint(uint64(m.ID), 10), m.Text})
+            }
+
+        case []sdk.File:
+            rows = append(rows, []string{"NAME", "SIZE", "STATE", "PROGRESS", "METAHASH"})
+            for _, f := range r {
+                state := f.State
+                if f.SourceState != "" && f.SourceState != sdk.SOURCE_OK {
+                    state += " (" + f.SourceState + ")"
+                }
+                rows = append(rows, []string{f.Name, strconv.FormatInt(f.Size, 10), state, progress(f), f.MetaHash})
+            }
+
+        case []sdk.Download:
+            rows = append(rows, []string{"NAME", "STATE", "PRIORITY", "PROGRESS", "RATE", "SOURCES", "METAHASH"})
+            for _, d := range r {
+                sources := make([]string, len(d.Sources))
+                for i, s := range d.Sources {
+                    sources[i] = fmt.Sprintf("%s:%d", s.Name, s.Downloaded)
+                    if s.Abandoned {
+                        sources[i] += "(abandoned)"
+                    }
+                }
+                rows = append(rows, []string{d.Name, d.State, strconv.Itoa(d.Priority), downloadProgress(d), rate(d.BytesPerSecond), strings.Join(sources, ","), d.MetaHash})
+            }
+
+        case []sdk.SearchResult:
+            rows = append(rows, []string{"FILENAME", "CHUNKS", "METAHASH"})
+            for _, s := range r {
+                rows = append(rows, []string{s.Filename, strconv.FormatUint(s.NbChunks, 10), s.MetaHash})
+            }
+
+        case sdk.Chain:
+            fmt.Fprintf(w, "Chain length: %d\n", r.Length)
+            rows = append(rows, []string{"HASH", "PREVIOUS", "FILENAMES"})
+            for _, b := range r.Blocks {
+                rows = append(rows, []string{b.Hash, b.PrevHash, strings.Join(b.Filenames, ",")})
+            }
+
+        case []sdk.Name:
+            rows = append(rows, []string{"NAME", "SIZE", "METAHASH"})
+            for _, n := range r {
+                rows = append(rows, []string{n.Name, strconv.FormatInt(n.Size, 10), n.MetaHash})
+            }
+
+        case sdk.Identity:
+            rows = append(rows, []string{"NAME", "ADDRESS", "PEERS", "ORIGINS", "SIMPLE"})
+            rows = append(rows, []string{r.Name, r.Address, strconv.Itoa(r.Peers), strconv.Itoa(r.Origins), strconv.FormatBool(r.Simple)})
+    }
+
+    printTable(w, rows)
+}
+
+// Download progress of a file
+func progress(f sdk.File) string {
+    if f.State != sdk.FILE_DOWNLOADING {
+        return "100%"
+    }
+    if f.NbChunks == 0 {
+        return "metafile"
+    }
+    return fmt.Sprintf("%.0f%% (%d/%d)", 100 * f.Progress(), f.Chunks, f.NbChunks)
+}
+
+// Progress of a download, like the progress of a file
+func downloadProgress(d sdk.Download) string {
+    if d.NbChunks == 0 {
+        return "metafile"
+    }
+    return fmt.Sprintf("%.0f%% (%d/%d)", 100 * float64(d.Chunks) / float64(d.NbChunks), d.Chunks, d.NbChunks)
+}
+
+// Bytes per second in a readable unit
+func rate(bytesPerSecond float64) string {
+    switch {
+        case bytesPerSecond >= 1 << 20:
+            return fmt.Sprintf("%.1f MB/s", bytesPerSecond / (1 << 20))
+        case bytesPerSecond >= 1 << 10:
+            return fmt.Sprintf("%.1f KB/s", bytesPerSecond / (1 << 10))
+        default:
+            return fmt.Sprintf("%.0f B/s", bytesPerSecond)
+    }
+}
+
+// Print the rows aligned in columns, the first row is the header
+func printTable(out io.Writer, rows [][]string) {
+    w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    for _, row := range rows {
+        values := make([]string, len(row))
+        for i, value := range row {
+            if value == "" {
+                value = "-"
+            }
+            // Keep one row per line
+            values[i] = strings.Replace(value, "\n", " ", -1)
+        }
+        fmt.Fprintln(w, strings.Join(values, "\t"))
+    }
+    w.Flush()
+}
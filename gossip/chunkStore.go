@@ -0,0 +1,190 @@
+package gossip
+
+import (
+    "os"
+    "sync"
+    "bytes"
+    "errors"
+    "io/ioutil"
+    "encoding/hex"
+)
+
+// Location of a chunk inside an indexed file
+type chunkRef struct {
+    path string
+    offset int64
+    size int
+}
+
+// Store of the chunks and metafiles served by this node. Chunks of indexed
+// files are not copied: they are read from the original file at their offset
+// and checked against their hash, so that a modified file never serves wrong
+// data. Downloaded chunks are served the same way from the file being
+// downloaded. Downloaded metafiles are written to CHUNKS_DIR, and kept in
+// memory once their download completes
+type ChunkStore struct {
+    // Hex chunk hash -> locations in indexed files, identical chunks can appear in several files
+    references map[string][]chunkRef
+    // Hex metahash -> metafile of an indexed file
+    metafiles map[string][]byte
+    referencesMutex sync.RWMutex
+}
+
+func NewChunkStore() *ChunkStore {
+    return &ChunkStore{
+        references: make(map[string][]chunkRef),
+        metafiles: make(map[string][]byte),
+        referencesMutex: sync.RWMutex{},
+    }
+}
+
+// Serve the chunk hash from path at offset
+func (cs *ChunkStore) addReference(hash string, path string, offset int64, size int) {
+    cs.referencesMutex.Lock()
+    defer cs.referencesMutex.Unlock()
+
+    ref := chunkRef{
+        path: path,
+        offset: offset,
+        size: size,
+    }
+    for _, existing := range cs.references[hash] {
+        if existing == ref {
+            return
+        }
+    }
+    cs.references[hash] = append(cs.references[hash], ref)
+}
+
+// Serve the chunks referenced in oldPath from newPath, once it is renamed
+func (cs *ChunkStore) moveReferences(oldPath string, newPath string) {
+    cs.referencesMutex.Lock()
+    defer cs.referencesMutex.Unlock()
+
+    for hash, refs := range cs.references {
+        for i, ref := range refs {
+            if ref.path == oldPath {
+                refs[i].path = newPath
+            }
+        }
+        cs.references[hash] = refs
+    }
+}
+
+// Stop serving the chunks of path
+func (cs *ChunkStore) removeReferences(path string) {
+    cs.referencesMutex.Lock()
+    defer cs.referencesMutex.Unlock()
+
+    for hash, refs := range cs.references {
+        kept := make([]chunkRef, 0, len(refs))
+        for _, ref := range refs {
+            if ref.path != path {
+                kept = append(kept, ref)
+            }
+        }
+        if len(kept) == 0 {
+            delete(cs.references, hash)
+        } else {
+            cs.references[hash] = kept
+        }
+    }
+}
+
+func (cs *ChunkStore) addMetafile(metahash string, metafile []byte) {
+    cs.referencesMutex.Lock()
+    defer cs.referencesMutex.Unlock()
+
+    cs.metafiles[metahash] = metafile
+}
+
+// Keep in memory the downloaded metafile hash and remove it from CHUNKS_DIR
+func (cs *ChunkStore) keepMetafile(hash string) error {
+    metafile := cs.read(hash)
+    if metafile == nil {
+        return errors.New("missing metafile " + hash)
+    }
+    cs.addMetafile(hash, metafile)
+
+    if err := os.Remove(CHUNKS_DIR + hash); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// Number of chunks and metafiles served, and their size in bytes: the chunks
+// referenced in files, the metafiles kept in memory and the ones of CHUNKS_DIR
+func (cs *ChunkStore) size() (int, int64) {
+    cs.referencesMutex.RLock()
+    nbChunks := len(cs.references) + len(cs.metafiles)
+    var nbBytes int64 = 0
+    for _, refs := range cs.references {
+        nbBytes += int64(refs[0].size)
+    }
+    for _, metafile := range cs.metafiles {
+        nbBytes += int64(len(metafile))
+    }
+    cs.referencesMutex.RUnlock()
+
+    files, err := ioutil.ReadDir(CHUNKS_DIR)
+    if err != nil {
+        return nbChunks, nbBytes
+    }
+    for _, f := range files {
+        if f.Mode() & os.ModeType == 0 {
+            nbChunks += 1
+            nbBytes += f.Size()
+        }
+    }
+    return nbChunks, nbBytes
+}
+
+// Return the chunk or metafile with the given hex hash, nil if this node doesn't have it
+func (cs *ChunkStore) read(hash string) []byte {
+    cs.referencesMutex.RLock()
+    metafile, isMetafile := cs.metafiles[hash]
+    refs := cs.references[hash]
+    cs.referencesMutex.RUnlock()
+
+    if isMetafile {
+        return metafile
+    }
+
+    for _, ref := range refs {
+        if data := readReference(hash, ref); data != nil {
+            return data
+        }
+    }
+
+    data, err := ioutil.ReadFile(CHUNKS_DIR + hash)
+    if err != nil {
+        return nil
+    }
+    return data
+}
+
+// Read the chunk at ref, nil if the file can't be read or doesn't contain it anymore
+func readReference(hexHash string, ref chunkRef) []byte {
+    f, err := os.Open(ref.path)
+    if err != nil {
+        return nil
+    }
+    defer f.Close()
+
+    data := make([]byte, ref.size)
+    if _, err := f.ReadAt(data, ref.offset); err != nil {
+        return nil
+    }
+
+    expectedHash, _ := hex.DecodeString(hexHash)
+    if !bytes.Equal(hash(data), expectedHash) {
+        filesLog.Debug("Chunk " + hexHash + " changed in " + ref.path)
+        return nil
+    }
+    return data
+}
+
+// Store a downloaded metafile
+func (cs *ChunkStore) write(hash string, data []byte) error {
+    return ioutil.WriteFile(CHUNKS_DIR + hash, data, 0644)
+}
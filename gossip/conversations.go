@@ -0,0 +1,377 @@
+package gossip
+
+import (
+    "io"
+    "os"
+    "bufio"
+    "errors"
+    "sort"
+    "sync"
+    "time"
+    "io/ioutil"
+    "encoding/hex"
+    "encoding/json"
+    "path/filepath"
+    "github.com/pablo11/Peerster/model"
+)
+
+var CONVERSATIONS_DIR = "_Conversations/"
+
+const CONVERSATIONS_MAX int = 1000 // Conversations kept, messages received from other peers are not stored
+
+// Line of the log of a conversation: the name of the peer in the first line,
+// then a message, a delivery state or a new unread counter per line
+type conversationRecord struct {
+    Peer string `json:",omitempty"`
+    Message *model.ConversationMessage `json:",omitempty"`
+    // New delivery State of the sent message StateID
+    StateID uint32 `json:",omitempty"`
+    State string `json:",omitempty"`
+    Unread *int `json:",omitempty"`
+}
+
+// Summary of a conversation, as listed by the API
+type ConversationSummary struct {
+    Peer string
+    NbMessages int
+    Unread int
+    LastMessage model.ConversationMessage
+}
+
+// Private messages sent and received by this node, grouped by peer and
+// persisted to disk, one log of JSON lines per peer. Changes are appended to
+// the log, which is compacted when it is loaded
+type Conversations struct {
+    name string
+    dir string
+    // Peer name -> conversation
+    conversations map[string]*model.Conversation
+    conversationsMutex sync.Mutex
+}
+
+func NewConversations(name string) *Conversations {
+    c := &Conversations{
+        name: name,
+        dir: CONVERSATIONS_DIR + name + "/",
+        conversations: make(map[string]*model.Conversation),
+        conversationsMutex: sync.Mutex{},
+    }
+    c.load()
+    return c
+}
+
+// Store a private message sent or received by this node. state is the
+// delivery state of sent messages, empty for received ones
+func (c *Conversations) Add(pm *model.PrivateMessage, state string) {
+    peer := pm.Origin
+    isReceived := true
+    if pm.Origin == c.name {
+        peer = pm.Destination
+        isReceived = false
+    }
+
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    conversation, isPresent := c.conversations[peer]
+    if !isPresent {
+        // Any peer can claim new origin names, the messages of new peers
+        // are only kept while there is room for them
+        if isReceived && len(c.conversations) >= CONVERSATIONS_MAX {
+            gossipLog.Warning("Too many conversations, the private message from " + peer + " is not stored")
+            return
+        }
+        conversation = &model.Conversation{
+            Peer: peer,
+            Messages: make([]*model.ConversationMessage, 0),
+            Unread: 0,
+        }
+        c.conversations[peer] = conversation
+    }
+
+    message := &model.ConversationMessage{
+        Seq: uint64(len(conversation.Messages) + 1),
+        ID: pm.ID,
+        Origin: pm.Origin,
+        Destination: pm.Destination,
+        Text: pm.Text,
+        Timestamp: time.Now(),
+        State: state,
+    }
+    conversation.Messages = append(conversation.Messages, message)
+    if isReceived {
+        conversation.Unread += 1
+    }
+
+    c.appendRecord(peer, conversationRecord{Message: message})
+}
+
+// Return the summary of every conversation, the most recent first
+func (c *Conversations) List() []ConversationSummary {
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    summaries := make([]ConversationSummary, 0, len(c.conversations))
+    for _, conversation := range c.conversations {
+        if len(conversation.Messages) == 0 {
+            continue
+        }
+        summaries = append(summaries, ConversationSummary{
+            Peer: conversation.Peer,
+            NbMessages: len(conversation.Messages),
+            Unread: conversation.Unread,
+            LastMessage: *conversation.Messages[len(conversation.Messages) - 1],
+        })
+    }
+
+    sort.Slice(summaries, func(i, j int) bool {
+        return summaries[i].LastMessage.Timestamp.After(summaries[j].LastMessage.Timestamp)
+    })
+    return summaries
+}
+
+// Return at most limit messages of the conversation with peer that come after
+// the message sinceSeq, and the number of unread messages. limit 0 means no limit
+func (c *Conversations) Thread(peer string, sinceSeq uint64, limit int) ([]model.ConversationMessage, int, bool) {
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    conversation, isPresent := c.conversations[peer]
+    if !isPresent {
+        return nil, 0, false
+    }
+
+    messages := make([]model.ConversationMessage, 0)
+    // Compared before the conversion, large values would become negative
+    if sinceSeq >= uint64(len(conversation.Messages)) {
+        return messages, conversation.Unread, true
+    }
+    for i := int(sinceSeq); i < len(conversation.Messages) && (limit == 0 || len(messages) < limit); i++ {
+        messages = append(messages, *conversation.Messages[i])
+    }
+    return messages, conversation.Unread, true
+}
+
+// Update the delivery state of the message id sent to peer
+func (c *Conversations) SetState(peer string, id uint32, state string) {
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    conversation, isPresent := c.conversations[peer]
+    if !isPresent {
+        return
+    }
+
+    // The message is most likely among the last ones
+    for i := len(conversation.Messages) - 1; i >= 0; i-- {
+        m := conversation.Messages[i]
+        if m.ID == id && m.Origin == c.name {
+            m.State = state
+            c.appendRecord(peer, conversationRecord{StateID: id, State: state})
+            return
+        }
+    }
+}
+
+// Reset the unread counter of the conversation with peer
+func (c *Conversations) MarkRead(peer string) bool {
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    conversation, isPresent := c.conversations[peer]
+    if !isPresent {
+        return false
+    }
+
+    if conversation.Unread != 0 {
+        conversation.Unread = 0
+        unread := 0
+        c.appendRecord(peer, conversationRecord{Unread: &unread})
+    }
+    return true
+}
+
+// Total number of unread messages over every conversation
+func (c *Conversations) Unread() int {
+    c.conversationsMutex.Lock()
+    defer c.conversationsMutex.Unlock()
+
+    unread := 0
+    for _, conversation := range c.conversations {
+        unread += conversation.Unread
+    }
+    return unread
+}
+
+// Peer names may contain any character and be long, so files are named after
+// the hex hash of the name
+func (c *Conversations) pathOf(peer string) string {
+    return c.dir + hex.EncodeToString(hash([]byte(peer))) + ".log"
+}
+
+// Append a record to the log of the conversation with peer, the log starts
+// with the name of the peer. Must be called with conversationsMutex locked
+func (c *Conversations) appendRecord(peer string, record conversationRecord) {
+    if err := os.MkdirAll(c.dir, 0700); err != nil {
+        gossipLog.Error("Could not create " + c.dir + ": " + err.Error())
+        return
+    }
+
+    f, err := os.OpenFile(c.pathOf(peer), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600)
+    if err != nil {
+        gossipLog.Error("Could not save the conversation with " + peer + ": " + err.Error())
+        return
+    }
+    defer f.Close()
+
+    records := []conversationRecord{record}
+    if info, err := f.Stat(); err == nil && info.Size() == 0 {
+        records = []conversationRecord{conversationRecord{Peer: peer}, record}
+    }
+
+    // Written at once, a crash can only cut the last line
+    data, err := encodeRecords(records)
+    if err == nil {
+        _, err = f.Write(data)
+    }
+    if err != nil {
+        gossipLog.Error("Could not save the conversation with " + peer + ": " + err.Error())
+    }
+}
+
+// Write the conversation as a compact log, through a temporary file so that a
+// crash never leaves a truncated conversation
+func (c *Conversations) rewrite(conversation *model.Conversation) {
+    unread := conversation.Unread
+    records := []conversationRecord{conversationRecord{Peer: conversation.Peer}}
+    for _, m := range conversation.Messages {
+        records = append(records, conversationRecord{Message: m})
+    }
+    records = append(records, conversationRecord{Unread: &unread})
+
+    data, err := encodeRecords(records)
+    if err != nil {
+        gossipLog.Error("Could not encode the conversation with " + conversation.Peer + ": " + err.Error())
+        return
+    }
+
+    tmp, err := ioutil.TempFile(c.dir, ".conversation-")
+    if err != nil {
+        gossipLog.Error("Could not save the conversation with " + conversation.Peer + ": " + err.Error())
+        return
+    }
+    _, err = tmp.Write(data)
+    tmp.Close()
+    if err == nil {
+        err = os.Rename(tmp.Name(), c.pathOf(conversation.Peer))
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        gossipLog.Error("Could not save the conversation with " + conversation.Peer + ": " + err.Error())
+    }
+}
+
+func encodeRecords(records []conversationRecord) ([]byte, error) {
+    data := make([]byte, 0)
+    for _, record := range records {
+        line, err := json.Marshal(record)
+        if err != nil {
+            return nil, err
+        }
+        data = append(append(data, line...), '\n')
+    }
+    return data, nil
+}
+
+// Load the conversations stored by a previous run
+func (c *Conversations) load() {
+    paths, err := filepath.Glob(c.dir + "*.log")
+    if err != nil {
+        return
+    }
+
+    for _, path := range paths {
+        conversation, isCompact, err := readConversation(path)
+        if err != nil {
+            gossipLog.Warning("Ignoring invalid conversation file " + path + ": " + err.Error())
+            continue
+        }
+
+        // Retransmissions don't survive a restart
+        for _, m := range conversation.Messages {
+            if m.State == DELIVERY_PENDING || m.State == DELIVERY_QUEUED {
+                m.State = DELIVERY_FAILED
+            }
+        }
+        c.conversations[conversation.Peer] = conversation
+
+        if !isCompact {
+            c.rewrite(conversation)
+        }
+    }
+}
+
+// Replay the log of a conversation. It is compact if it has no invalid line
+// and about one record per message
+func readConversation(path string) (*model.Conversation, bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, false, err
+    }
+    defer f.Close()
+
+    conversation := &model.Conversation{
+        Peer: "",
+        Messages: make([]*model.ConversationMessage, 0),
+        Unread: 0,
+    }
+    nbRecords := 0
+    isCut := false
+    reader := bufio.NewReader(f)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            // A line without its end was cut by a crash
+            isCut = len(line) > 0
+            break
+        }
+        if err != nil {
+            return nil, false, err
+        }
+
+        record := conversationRecord{}
+        if err := json.Unmarshal(line, &record); err != nil {
+            isCut = true
+            continue
+        }
+        nbRecords += 1
+
+        switch {
+            case record.Peer != "":
+                conversation.Peer = record.Peer
+
+            case record.Message != nil:
+                record.Message.Seq = uint64(len(conversation.Messages) + 1)
+                conversation.Messages = append(conversation.Messages, record.Message)
+                if record.Message.Origin == conversation.Peer {
+                    conversation.Unread += 1
+                }
+
+            case record.StateID != 0:
+                for i := len(conversation.Messages) - 1; i >= 0; i-- {
+                    if conversation.Messages[i].ID == record.StateID && conversation.Messages[i].Origin != conversation.Peer {
+                        conversation.Messages[i].State = record.State
+                        break
+                    }
+                }
+
+            case record.Unread != nil:
+                conversation.Unread = *record.Unread
+        }
+    }
+
+    if conversation.Peer == "" {
+        return nil, false, errors.New("the name of the peer is missing")
+    }
+    return conversation, !isCut && nbRecords <= len(conversation.Messages) + 2, nil
+}
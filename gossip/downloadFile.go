@@ -0,0 +1,280 @@
+package gossip
+
+import (
+    "os"
+    "bytes"
+    "errors"
+    "strconv"
+    "encoding/hex"
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+/* Chunks are written at their offset in a part file of DOWNLOADS_DIR as soon
+   as they arrive, and served to other nodes from there. The part file is
+   preallocated once the root metafile is known. When every chunk is there,
+   it is checked against the metafiles and renamed to the name of the
+   download, so that an incomplete or wrong file is never listed as
+   downloaded */
+
+// Part file of the download of the file with the given hex metahash. The name
+// of the node keeps apart the nodes run from the same directory
+func (fs *FileSharing) partPathOf(metahash string) string {
+    return DOWNLOADS_DIR + "." + fs.gossiper.Name + "-" + metahash + ".part"
+}
+
+// Open the part file of d, preallocated to hold all its chunks. The chunks
+// already written are kept
+func (fs *FileSharing) openPart(d *download) error {
+    if err := os.MkdirAll(DOWNLOADS_DIR, os.ModePerm); err != nil {
+        return err
+    }
+
+    f, err := os.OpenFile(fs.partPathOf(d.metahash), os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    if err := f.Truncate(int64(len(d.chunks)) * MAX_CHUNK_SIZE); err != nil {
+        f.Close()
+        return err
+    }
+    d.part = f
+    return nil
+}
+
+// Write chunk number offset of d in its part file, and serve it from there.
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) writeChunk(d *download, offset int, hexHash string, data []byte) error {
+    position := int64(offset) * MAX_CHUNK_SIZE
+    if _, err := d.part.WriteAt(data, position); err != nil {
+        return err
+    }
+    fs.chunks.addReference(hexHash, fs.partPathOf(d.metahash), position, len(data))
+
+    // Only the last chunk can be smaller
+    if offset == len(d.chunks) - 1 {
+        d.size = position + int64(len(data))
+    }
+    return nil
+}
+
+// True if chunk number offset of d can have size bytes: only the last chunk
+// can be smaller than MAX_CHUNK_SIZE, and it isn't empty
+func isValidChunkSize(d *download, offset int, size int) bool {
+    if offset == len(d.chunks) - 1 {
+        return size > 0 && size <= MAX_CHUNK_SIZE
+    }
+    return size == MAX_CHUNK_SIZE
+}
+
+// Read chunk number offset of d from its part file into buffer. The last
+// chunk can only be read once its size is known
+func (fs *FileSharing) readPartChunk(d *download, offset int, buffer []byte) ([]byte, error) {
+    position := int64(offset) * MAX_CHUNK_SIZE
+    size := int64(MAX_CHUNK_SIZE)
+    if offset == len(d.chunks) - 1 {
+        size = d.size - position
+        if size <= 0 || size > MAX_CHUNK_SIZE {
+            return nil, errors.New("the size of the last chunk is unknown")
+        }
+    }
+
+    chunk := buffer[:size]
+    if _, err := d.part.ReadAt(chunk, position); err != nil {
+        return nil, err
+    }
+    return chunk, nil
+}
+
+// Mark as done the chunks of d already written to its part file with the
+// right hash, and copy there the ones this node already stores. The
+// metafiles must be stored too, the chunks they list are requested otherwise
+func (fs *FileSharing) checkStoredChunks(d *download) {
+    buffer := make([]byte, MAX_CHUNK_SIZE)
+    for offset := range d.chunks {
+        chunkHash, _, _ := fs.chunkHashOf(d, offset)
+        if chunkHash == nil {
+            continue
+        }
+        hexHash := hex.EncodeToString(chunkHash)
+
+        chunk, err := fs.readPartChunk(d, offset, buffer)
+        if err == nil && bytes.Equal(hash(chunk), chunkHash) {
+            fs.chunks.addReference(hexHash, fs.partPathOf(d.metahash), int64(offset) * MAX_CHUNK_SIZE, len(chunk))
+        } else {
+            // Chunks of indexed files, or stored by a previous version as chunk files
+            chunk = fs.readChunkFile(hexHash)
+            if chunk == nil || !bytes.Equal(hash(chunk), chunkHash) || !isValidChunkSize(d, offset, len(chunk)) || fs.writeChunk(d, offset, hexHash, chunk) != nil {
+                continue
+            }
+        }
+
+        d.chunks[offset] = CHUNK_DONE
+        d.file.NbChunksDone += 1
+        d.file.ChunksLocation[offset] = fs.gossiper.Name
+    }
+
+    for d.firstMissing < len(d.chunks) && d.chunks[d.firstMissing] == CHUNK_DONE {
+        d.firstMissing += 1
+    }
+}
+
+// Complete the download d, no longer listed in the downloads, and forget its
+// state. If it can't be completed, it is listed again, paused
+func (fs *FileSharing) completeDownload(d *download) {
+    corrupted, err := fs.finishDownload(d)
+    if err == nil {
+        fs.removeState(d.metahash)
+        return
+    }
+
+    filesLog.Error("Could not complete the download of " + d.file.LocalName + ": " + err.Error())
+    fs.keepDownload(d, corrupted)
+}
+
+// Check the part file of the complete download d against its metafiles and
+// rename it to the name of the download. If it fails, return the offsets of
+// the chunks that don't match their hash
+func (fs *FileSharing) finishDownload(d *download) ([]int, error) {
+    partPath := fs.partPathOf(d.metahash)
+    filename := d.file.LocalName
+
+    corrupted := []int{}
+    err := d.part.Truncate(d.size)
+    if err == nil {
+        err = d.part.Sync()
+    }
+    if err == nil {
+        corrupted = fs.verifyPart(d)
+        if len(corrupted) > 0 {
+            err = errors.New(strconv.Itoa(len(corrupted)) + " chunks don't match their hash")
+        }
+    }
+    d.part.Close()
+    if err != nil {
+        return corrupted, err
+    }
+
+    finalPath := DOWNLOADS_DIR + filename
+    if err := os.Rename(partPath, finalPath); err != nil {
+        return corrupted, err
+    }
+    fs.chunks.moveReferences(partPath, finalPath)
+
+    // The metafiles are served from memory, like the ones of indexed files
+    for _, metafileHash := range fs.metafileHashes(d.metahash) {
+        if err := fs.chunks.keepMetafile(metafileHash); err != nil {
+            filesLog.Warning("Could not keep the metafile of " + filename + ": " + err.Error())
+        }
+    }
+
+    fs.availableFilesMutex.Lock()
+    d.file.Size = d.size
+    d.file.Path = finalPath
+    fs.availableFilesMutex.Unlock()
+
+    filesLog.Event(logger.INFO, "RECONSTRUCTED", "RECONSTRUCTED file " + filename, logger.Fields{
+        "filename": filename,
+        "metahash": d.metahash,
+    })
+
+    fs.gossiper.Events.Publish(&Event{
+        Type: EVENT_FILE_RECONSTRUCTED,
+        File: &FileReconstructed{
+            Filename: filename,
+            MetaHash: d.metahash,
+        },
+    })
+    return corrupted, nil
+}
+
+// List again, paused, the download d that couldn't be completed. The corrupted
+// chunks are downloaded again once it is resumed
+func (fs *FileSharing) keepDownload(d *download, corrupted []int) {
+    if err := fs.openPart(d); err != nil {
+        filesLog.Error("Could not open the file of " + d.file.LocalName + ": " + err.Error())
+    }
+
+    fs.downloadsMutex.Lock()
+    if _, isDownloading := fs.downloads[d.metahash]; isDownloading {
+        // Requested again in the meantime
+        fs.downloadsMutex.Unlock()
+        return
+    }
+
+    for _, offset := range corrupted {
+        d.chunks[offset] = CHUNK_MISSING
+        if offset < d.firstMissing {
+            d.firstMissing = offset
+        }
+    }
+    fs.availableFilesMutex.Lock()
+    d.file.NbChunksDone -= len(corrupted)
+    fs.availableFilesMutex.Unlock()
+
+    d.state = DOWNLOAD_PAUSED
+    d.rate = 0
+    d.lastBytesDone = d.bytesDone
+    fs.downloads[d.metahash] = d
+    state := fs.stateOf(d)
+    fs.downloadsMutex.Unlock()
+
+    if len(corrupted) > 0 {
+        filesLog.Warning("Paused the download of " + d.file.LocalName + ", resume it to download the corrupted chunks again")
+    } else {
+        filesLog.Warning("Paused the download of " + d.file.LocalName + ", resume it to complete it")
+    }
+    fs.saveState(state)
+}
+
+// Offsets of the chunks of the part file of d that don't match the hashes of
+// its metafiles
+func (fs *FileSharing) verifyPart(d *download) []int {
+    corrupted := make([]int, 0)
+    buffer := make([]byte, MAX_CHUNK_SIZE)
+    for offset := range d.chunks {
+        expectedHash, _, _ := fs.chunkHashOf(d, offset)
+        chunk, err := fs.readPartChunk(d, offset, buffer)
+        if expectedHash == nil || err != nil || !bytes.Equal(hash(chunk), expectedHash) {
+            corrupted = append(corrupted, offset)
+        }
+    }
+    return corrupted
+}
+
+// Close and delete the part file of a download that won't complete
+func (fs *FileSharing) discardPart(d *download) {
+    if d.part == nil {
+        return
+    }
+
+    partPath := fs.partPathOf(d.metahash)
+    d.part.Close()
+    fs.chunks.removeReferences(partPath)
+    if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+        filesLog.Error("Could not delete " + partPath + ": " + err.Error())
+    }
+}
+
+// Hex hashes of the root and the other metafiles of the file with the given
+// hex metahash, as far as they are stored
+func (fs *FileSharing) metafileHashes(metahash string) []string {
+    hashes := []string{metahash}
+    root, err := parseMetafileRoot(fs.readChunkFile(metahash))
+    if err != nil {
+        return hashes
+    }
+
+    level := root.children
+    for depth := root.depth; depth > 1; depth-- {
+        next := make([]byte, 0)
+        for i := 0; i < len(level) / 32; i++ {
+            hexHash := hex.EncodeToString(hashAt(level, i))
+            hashes = append(hashes, hexHash)
+            if depth > 2 {
+                next = append(next, fs.readChunkFile(hexHash)...)
+            }
+        }
+        level = next
+    }
+    return hashes
+}
@@ -0,0 +1,319 @@
+package gossip
+
+import (
+    "sort"
+    "time"
+    "errors"
+    "encoding/hex"
+    "github.com/pablo11/Peerster/model"
+)
+
+const (
+    DOWNLOAD_DEFAULT_MAX_ACTIVE int = 3 // Downloads running at the same time, the others wait in the queue
+    DOWNLOAD_RATE_SMOOTHING float64 = 0.3 // Weight of the last period in the download rate
+)
+
+// States of a download
+const (
+    DOWNLOAD_QUEUED = "queued"
+    DOWNLOAD_RUNNING = "running"
+    DOWNLOAD_PAUSED = "paused"
+)
+
+// Progress of a download, as listed by the API
+type DownloadStatus struct {
+    MetaHash string
+    LocalName string
+    State string
+    Priority int
+    NbChunksDone int
+    // 0 until the root metafile is received
+    NbChunks int
+    BytesDone int64
+    BytesPerSecond float64
+    Sources []DownloadSourceStatus
+}
+
+type DownloadSourceStatus struct {
+    Name string
+    // Offers every chunk, otherwise NbChunks of them
+    HasAll bool
+    NbChunks int
+    // Chunks received from this source
+    Downloaded int
+    // Requests of this download waiting for an answer of this source
+    Pending int
+    // Consecutive timeouts
+    Failures int
+    // Only used for the chunks no other source offers
+    Abandoned bool
+}
+
+var errNoDownload = errors.New("no download of this metahash")
+
+// Set the number of downloads running at the same time
+func (fs *FileSharing) SetMaxDownloads(maxActive int) {
+    fs.downloadsMutex.Lock()
+    fs.maxActive = maxActive
+    toSend := fs.schedule()
+    fs.downloadsMutex.Unlock()
+
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+}
+
+// Status of every download, running ones first, then queued ones in the order
+// they will start, then paused ones
+func (fs *FileSharing) GetDownloads() []DownloadStatus {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    downloads := make([]*download, 0, len(fs.downloads))
+    for _, d := range fs.downloads {
+        downloads = append(downloads, d)
+    }
+    stateOrder := map[string]int{DOWNLOAD_RUNNING: 0, DOWNLOAD_QUEUED: 1, DOWNLOAD_PAUSED: 2}
+    sort.Slice(downloads, func(i, j int) bool {
+        if downloads[i].state != downloads[j].state {
+            return stateOrder[downloads[i].state] < stateOrder[downloads[j].state]
+        }
+        return isBefore(downloads[i], downloads[j])
+    })
+
+    statuses := make([]DownloadStatus, len(downloads))
+    for i, d := range downloads {
+        statuses[i] = fs.statusOf(d)
+    }
+    return statuses
+}
+
+// Status of the download of the file with the given hex metahash
+func (fs *FileSharing) GetDownload(metahash string) (DownloadStatus, bool) {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    d, isDownloading := fs.downloads[metahash]
+    if !isDownloading {
+        return DownloadStatus{}, false
+    }
+    return fs.statusOf(d), true
+}
+
+// Stop requesting chunks of a download until it is resumed. Paused downloads
+// don't count in the downloads running at the same time
+func (fs *FileSharing) PauseDownload(metahash string) error {
+    fs.downloadsMutex.Lock()
+    d, isDownloading := fs.downloads[metahash]
+    if !isDownloading {
+        fs.downloadsMutex.Unlock()
+        return errNoDownload
+    }
+
+    fs.dropPendingRequests(d)
+    d.state = DOWNLOAD_PAUSED
+    d.rate = 0
+    toSend := fs.schedule()
+    state := fs.stateOf(d)
+    fs.downloadsMutex.Unlock()
+
+    filesLog.Info("Paused the download of " + d.file.LocalName)
+    fs.saveState(state)
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    return nil
+}
+
+// Stop a download, forget it and delete its part file
+func (fs *FileSharing) CancelDownload(metahash string) error {
+    fs.downloadsMutex.Lock()
+    d, isDownloading := fs.downloads[metahash]
+    if !isDownloading {
+        fs.downloadsMutex.Unlock()
+        return errNoDownload
+    }
+
+    fs.dropPendingRequests(d)
+    delete(fs.downloads, metahash)
+    toSend := fs.schedule()
+    fs.downloadsMutex.Unlock()
+
+    fs.availableFilesMutex.Lock()
+    delete(fs.AvailableFiles, metahash)
+    fs.availableFilesMutex.Unlock()
+
+    filesLog.Info("Cancelled the download of " + d.file.LocalName)
+    fs.discardPart(d)
+    fs.removeState(metahash)
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    return nil
+}
+
+// Set the priority of a download in the queue. Running downloads are not
+// interrupted by queued ones of a higher priority
+func (fs *FileSharing) SetDownloadPriority(metahash string, priority int) error {
+    fs.downloadsMutex.Lock()
+    d, isDownloading := fs.downloads[metahash]
+    if !isDownloading {
+        fs.downloadsMutex.Unlock()
+        return errNoDownload
+    }
+
+    d.priority = priority
+    d.isDirty = true
+    toSend := fs.schedule()
+    fs.downloadsMutex.Unlock()
+
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    return nil
+}
+
+// Start queued downloads, highest priority first, until maxActive downloads
+// are running. Return the requests to send. Must be called with downloadsMutex locked
+func (fs *FileSharing) schedule() []*model.DataRequest {
+    toSend := make([]*model.DataRequest, 0)
+
+    running := 0
+    queued := make([]*download, 0)
+    for _, d := range fs.downloads {
+        if d.state == DOWNLOAD_RUNNING {
+            running += 1
+        } else if d.state == DOWNLOAD_QUEUED {
+            queued = append(queued, d)
+        }
+    }
+
+    sort.Slice(queued, func(i, j int) bool {
+        return isBefore(queued[i], queued[j])
+    })
+
+    for _, d := range queued {
+        if running >= fs.maxActive {
+            break
+        }
+        running += 1
+        d.state = DOWNLOAD_RUNNING
+        filesLog.Debug("Starting the download of " + d.file.LocalName)
+        toSend = append(toSend, fs.activate(d)...)
+    }
+    return toSend
+}
+
+// Request the root metafile of d, or its first chunks if the root is already
+// known. Must be called with downloadsMutex locked
+func (fs *FileSharing) activate(d *download) []*model.DataRequest {
+    if d.chunks != nil {
+        return fs.fillWindow(d)
+    }
+
+    byteHash, _ := hex.DecodeString(d.metahash)
+    source := d.rootSource
+    if _, isSource := d.sources[source]; !isSource {
+        source = fs.pickSource(d, -1)
+    }
+    if source == "" {
+        // Every source has a full window, the timeout retries later
+        for name, _ := range d.sources {
+            source = name
+            break
+        }
+    }
+    if source == "" {
+        return []*model.DataRequest{}
+    }
+    return []*model.DataRequest{fs.addPendingRequest(d, byteHash, []int{}, -1, source)}
+}
+
+// Pause d because its chunks or metafiles can't be stored. Must be called
+// with downloadsMutex locked
+func (fs *FileSharing) pauseOnError(d *download) {
+    filesLog.Warning("Paused the download of " + d.file.LocalName + ", resume it once the disk is writable")
+    fs.dropPendingRequests(d)
+    d.state = DOWNLOAD_PAUSED
+    d.rate = 0
+    d.isDirty = true
+}
+
+// Forget the requests d is waiting for, its chunks are requested again when
+// it runs. Must be called with downloadsMutex locked
+func (fs *FileSharing) dropPendingRequests(d *download) {
+    for hexHash, request := range d.pending {
+        for _, offset := range request.offsets {
+            d.chunks[offset] = CHUNK_MISSING
+        }
+        fs.removePendingRequest(d, hexHash)
+    }
+}
+
+// Update the download rates with the bytes received since the last update
+func (fs *FileSharing) updateRates() {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    elapsed := time.Since(fs.ratesUpdatedAt).Seconds()
+    fs.ratesUpdatedAt = time.Now()
+    if elapsed <= 0 {
+        return
+    }
+
+    for _, d := range fs.downloads {
+        lastRate := float64(d.bytesDone - d.lastBytesDone) / elapsed
+        d.rate = DOWNLOAD_RATE_SMOOTHING * lastRate + (1 - DOWNLOAD_RATE_SMOOTHING) * d.rate
+        d.lastBytesDone = d.bytesDone
+    }
+}
+
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) statusOf(d *download) DownloadStatus {
+    status := DownloadStatus{
+        MetaHash: d.metahash,
+        LocalName: d.file.LocalName,
+        State: d.state,
+        Priority: d.priority,
+        NbChunksDone: d.file.NbChunksDone,
+        NbChunks: d.file.NbChunks,
+        BytesDone: d.bytesDone,
+        BytesPerSecond: d.rate,
+        Sources: make([]DownloadSourceStatus, 0, len(d.sources)),
+    }
+
+    pending := make(map[string]int)
+    for _, request := range d.pending {
+        pending[request.source] += 1
+    }
+
+    for name, source := range d.sources {
+        nbChunks := 0
+        for _, offered := range source.chunks {
+            if offered {
+                nbChunks += 1
+            }
+        }
+        status.Sources = append(status.Sources, DownloadSourceStatus{
+            Name: name,
+            HasAll: source.hasAll,
+            NbChunks: nbChunks,
+            Downloaded: source.downloaded,
+            Pending: pending[name],
+            Failures: source.failures,
+            Abandoned: source.isDead(),
+        })
+    }
+    sort.Slice(status.Sources, func(i, j int) bool {
+        return status.Sources[i].Name < status.Sources[j].Name
+    })
+    return status
+}
+
+// True if a starts before b in the queue
+func isBefore(a, b *download) bool {
+    if a.priority != b.priority {
+        return a.priority > b.priority
+    }
+    return a.queuedAt.Before(b.queuedAt)
+}
@@ -0,0 +1,338 @@
+package gossip
+
+import (
+    "os"
+    "time"
+    "errors"
+    "strconv"
+    "io/ioutil"
+    "encoding/hex"
+    "encoding/json"
+    "path/filepath"
+    "github.com/pablo11/Peerster/model"
+)
+
+var DOWNLOAD_STATE_DIR = "_DownloadState/"
+
+const DOWNLOAD_SAVE_PERIOD time.Duration = 2 // Seconds between two saves of the state of a download in progress
+
+/* The state of each download in progress is saved in DOWNLOAD_STATE_DIR, one
+   JSON file per metahash, so that it can be resumed after a restart. Chunks
+   are already written to the part file of the download and metafiles to
+   CHUNKS_DIR: when resuming, the chunks found in the part file with the right
+   hash are not downloaded again. The state is saved when the download
+   starts, every DOWNLOAD_SAVE_PERIOD seconds while it progresses, and removed
+   once the file is complete */
+
+// Resume the download of the file with the given hex metahash: queue it again
+// if it is paused, restart it from its saved state if it isn't known, or retry
+// its pending requests at once and give another chance to the sources it
+// abandoned if it is running
+func (fs *FileSharing) ResumeDownload(metahash string) error {
+    toSend := make([]*model.DataRequest, 0)
+
+    fs.downloadsMutex.Lock()
+    d, isDownloading := fs.downloads[metahash]
+    if isDownloading && d.state == DOWNLOAD_PAUSED && d.chunks != nil && d.firstMissing >= len(d.chunks) {
+        // Every chunk is there, only the completion of the file failed
+        delete(fs.downloads, metahash)
+        fs.downloadsMutex.Unlock()
+
+        fs.completeDownload(d)
+        return nil
+    }
+    if isDownloading && d.state == DOWNLOAD_PAUSED {
+        d.state = DOWNLOAD_QUEUED
+        d.queuedAt = time.Now()
+        toSend = fs.schedule()
+        state := fs.stateOf(d)
+        fs.downloadsMutex.Unlock()
+
+        filesLog.Info("Resumed the download of " + d.file.LocalName)
+        fs.saveState(state)
+        for _, request := range toSend {
+            go fs.sendDataRequest(request)
+        }
+        return nil
+    }
+    isRunning := isDownloading && d.state == DOWNLOAD_RUNNING
+    if isRunning {
+        for _, source := range d.sources {
+            source.failures = 0
+        }
+        d.failedSources = make(map[int][]string)
+        for _, request := range d.pending {
+            request.sentAt = time.Now()
+            toSend = append(toSend, fs.newDataRequest(request.source, request.hash))
+        }
+        if d.chunks != nil {
+            toSend = append(toSend, fs.fillWindow(d)...)
+        }
+    }
+    fs.downloadsMutex.Unlock()
+
+    if isRunning {
+        filesLog.Info("Retrying the requests of " + d.file.LocalName)
+    }
+    if isDownloading {
+        // Queued downloads start when their turn comes
+        for _, request := range toSend {
+            go fs.sendDataRequest(request)
+        }
+        return nil
+    }
+
+    state := fs.loadState(fs.statePathOf(metahash))
+    if state == nil {
+        return errNoDownload
+    }
+    return fs.resume(state)
+}
+
+// Resume every download saved before the last shutdown
+func (fs *FileSharing) resumeDownloads() {
+    paths, err := filepath.Glob(fs.stateDir + "*.json")
+    if err != nil {
+        return
+    }
+
+    for _, path := range paths {
+        state := fs.loadState(path)
+        if state == nil {
+            continue
+        }
+        if err := fs.resume(state); err != nil {
+            filesLog.Warning("Could not resume the download of " + state.LocalName + ": " + err.Error())
+        }
+    }
+}
+
+// Restart a download from its saved state. Chunks already written with the
+// right hash are kept, the others are requested again
+func (fs *FileSharing) resume(state *model.DownloadState) error {
+    if fs.isDownloading(state.MetaHash) {
+        return errors.New("the file is already being downloaded")
+    }
+
+    file := &model.FileDownload{
+        LocalName: state.LocalName,
+        MetaHash: nil,
+        NbChunksDone: 0,
+        NbChunks: 0,
+        ChunksLocation: []string{},
+    }
+    d := newDownload(state.MetaHash, file)
+    d.priority = state.Priority
+    if state.Paused {
+        d.state = DOWNLOAD_PAUSED
+    }
+
+    rootBytes := fs.readChunkFile(state.MetaHash)
+    if rootBytes != nil {
+        if root, err := parseMetafileRoot(rootBytes); err == nil {
+            fs.setUpChunks(d, hash(rootBytes), root)
+            d.size = state.Size
+            if err := fs.openPart(d); err != nil {
+                return err
+            }
+            fs.checkStoredChunks(d)
+        }
+    }
+
+    filesLog.Info("Resuming the download of " + file.LocalName + " (" + strconv.Itoa(file.NbChunksDone) + "/" + strconv.Itoa(file.NbChunks) + " chunks stored)")
+
+    toSend := make([]*model.DataRequest, 0)
+    fs.downloadsMutex.Lock()
+    if _, isDownloading := fs.downloads[d.metahash]; isDownloading {
+        fs.downloadsMutex.Unlock()
+        if d.part != nil {
+            d.part.Close()
+        }
+        return errors.New("the file is already being downloaded")
+    }
+    for _, source := range state.Sources {
+        if source.HasAll {
+            fs.addDownloadSource(d, source.Name, nil)
+        } else {
+            fs.addDownloadSource(d, source.Name, bitmapRanges(source.Chunks))
+        }
+    }
+    // The file is listed once its download is, a concurrent request of the
+    // same metahash fails before replacing it
+    fs.downloads[d.metahash] = d
+    fs.availableFilesMutex.Lock()
+    fs.AvailableFiles[d.metahash] = file
+    fs.availableFilesMutex.Unlock()
+
+    // Every chunk is stored, only the completion of the file is left. A
+    // download that couldn't be completed is paused until it is resumed
+    isComplete := d.chunks != nil && d.firstMissing >= len(d.chunks) && d.state != DOWNLOAD_PAUSED
+    if isComplete {
+        delete(fs.downloads, d.metahash)
+    } else {
+        toSend = fs.schedule()
+    }
+    fs.downloadsMutex.Unlock()
+
+    if isComplete {
+        fs.completeDownload(d)
+        return nil
+    }
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    return nil
+}
+
+// Save the state of the downloads that progressed since their last save
+func (fs *FileSharing) saveDownloads() {
+    states := make([]*model.DownloadState, 0)
+
+    fs.downloadsMutex.Lock()
+    for _, d := range fs.downloads {
+        if d.isDirty {
+            states = append(states, fs.stateOf(d))
+            d.isDirty = false
+        }
+    }
+    fs.downloadsMutex.Unlock()
+
+    for _, state := range states {
+        fs.saveState(state)
+    }
+}
+
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) stateOf(d *download) *model.DownloadState {
+    state := &model.DownloadState{
+        MetaHash: d.metahash,
+        LocalName: d.file.LocalName,
+        Paused: d.state == DOWNLOAD_PAUSED,
+        Priority: d.priority,
+        NbChunks: len(d.chunks),
+        Size: d.size,
+        Chunks: newBitmap(len(d.chunks), func(i int) bool {
+            return d.chunks[i] == CHUNK_DONE
+        }),
+        Sources: make([]model.DownloadSourceState, 0, len(d.sources)),
+    }
+
+    for name, source := range d.sources {
+        chunks := source.chunks
+        state.Sources = append(state.Sources, model.DownloadSourceState{
+            Name: name,
+            HasAll: source.hasAll,
+            Chunks: newBitmap(len(chunks), func(i int) bool {
+                return chunks[i]
+            }),
+        })
+    }
+    return state
+}
+
+func (fs *FileSharing) saveState(state *model.DownloadState) {
+    fs.stateMutex.Lock()
+    defer fs.stateMutex.Unlock()
+
+    // The download may have completed since the state was taken
+    if !fs.isDownloading(state.MetaHash) {
+        return
+    }
+
+    data, err := json.Marshal(state)
+    if err != nil {
+        filesLog.Error("Could not encode the state of the download of " + state.LocalName + ": " + err.Error())
+        return
+    }
+
+    if err := os.MkdirAll(fs.stateDir, 0700); err != nil {
+        filesLog.Error("Could not create " + fs.stateDir + ": " + err.Error())
+        return
+    }
+
+    tmp, err := ioutil.TempFile(fs.stateDir, ".download-")
+    if err != nil {
+        filesLog.Error("Could not save the state of the download of " + state.LocalName + ": " + err.Error())
+        return
+    }
+    _, err = tmp.Write(data)
+    tmp.Close()
+    if err == nil {
+        err = os.Rename(tmp.Name(), fs.statePathOf(state.MetaHash))
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        filesLog.Error("Could not save the state of the download of " + state.LocalName + ": " + err.Error())
+    }
+}
+
+// Forget the saved state of a download that completed or failed
+func (fs *FileSharing) removeState(metahash string) {
+    fs.stateMutex.Lock()
+    defer fs.stateMutex.Unlock()
+
+    if err := os.Remove(fs.statePathOf(metahash)); err != nil && !os.IsNotExist(err) {
+        filesLog.Error("Could not remove the state of the download " + metahash + ": " + err.Error())
+    }
+}
+
+// Return the state saved at path, nil if it is missing or invalid
+func (fs *FileSharing) loadState(path string) *model.DownloadState {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            filesLog.Warning("Could not read " + path + ": " + err.Error())
+        }
+        return nil
+    }
+
+    state := &model.DownloadState{}
+    if err := json.Unmarshal(data, state); err != nil || len(state.Sources) == 0 {
+        filesLog.Warning("Ignoring invalid download state " + path)
+        return nil
+    }
+    if metahash, err := hex.DecodeString(state.MetaHash); err != nil || len(metahash) != 32 {
+        filesLog.Warning("Ignoring invalid download state " + path)
+        return nil
+    }
+
+    // The name is checked like the one of a new download
+    state.LocalName = filepath.Base(state.LocalName)
+    if state.LocalName == "." || state.LocalName == ".." || state.LocalName == string(filepath.Separator) {
+        filesLog.Warning("Ignoring invalid download state " + path)
+        return nil
+    }
+    return state
+}
+
+func (fs *FileSharing) statePathOf(metahash string) string {
+    return fs.stateDir + metahash + ".json"
+}
+
+// Bitmap of n bits, bit i is set if isSet(i)
+func newBitmap(n int, isSet func(int) bool) []byte {
+    bitmap := make([]byte, (n + 7) / 8)
+    for i := 0; i < n; i++ {
+        if isSet(i) {
+            bitmap[i / 8] |= 1 << uint(i % 8)
+        }
+    }
+    return bitmap
+}
+
+// Chunk numbers, starting from 1, of the bits set in bitmap as pairs of first
+// and last chunk number
+func bitmapRanges(bitmap []byte) []uint64 {
+    chunkRanges := make([]uint64, 0)
+    for i := 0; i < len(bitmap) * 8; i++ {
+        if bitmap[i / 8] & (1 << uint(i % 8)) == 0 {
+            continue
+        }
+        if len(chunkRanges) > 0 && chunkRanges[len(chunkRanges) - 1] == uint64(i) {
+            chunkRanges[len(chunkRanges) - 1] = uint64(i + 1)
+        } else {
+            chunkRanges = append(chunkRanges, uint64(i + 1), uint64(i + 1))
+        }
+    }
+    return chunkRanges
+}
@@ -0,0 +1,741 @@
+package gossip
+
+import (
+    "os"
+    "time"
+    "errors"
+    "strconv"
+    "encoding/hex"
+    "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+const (
+    DOWNLOAD_DEFAULT_WINDOW int = 32 // Outstanding DataRequests per download
+    DOWNLOAD_DEFAULT_SOURCE_WINDOW int = 16 // Outstanding DataRequests per source, over all the downloads
+    DOWNLOAD_TIMEOUT_CHECK_PERIOD time.Duration = 500 // Milliseconds between two checks for timed out requests
+    DOWNLOAD_SOURCE_MAX_FAILURES int = 3 // Consecutive timeouts after which a source is only used if no other source offers the chunk
+)
+
+// States of a chunk being downloaded
+const (
+    CHUNK_MISSING byte = iota
+    CHUNK_REQUESTED
+    CHUNK_DONE
+)
+
+// DataRequest sent by a download and not answered yet
+type pendingRequest struct {
+    hash []byte
+    // Offsets of the chunks with this hash, empty for metafiles
+    offsets []int
+    // Chunk that needs the requested metafile, -1 for the root
+    forChunk int
+    // Length the requested metafile must have, 0 for the root and chunks
+    size int
+    source string
+    sentAt time.Time
+}
+
+// Peer offering chunks of a download
+type downloadSource struct {
+    // Offers every chunk, otherwise only the offsets set in chunks
+    hasAll bool
+    chunks []bool
+    // Consecutive timeouts
+    failures int
+    // Chunks received from this source
+    downloaded int
+}
+
+func (s *downloadSource) offers(offset int) bool {
+    return s.hasAll || offset < 0 || (offset < len(s.chunks) && s.chunks[offset])
+}
+
+func (s *downloadSource) isDead() bool {
+    return s.failures >= DOWNLOAD_SOURCE_MAX_FAILURES
+}
+
+// Download of a file from a swarm of sources. Up to window chunks are
+// requested at the same time, spread over the sources offering them, and they
+// can arrive in any order
+type download struct {
+    metahash string
+    file *model.FileDownload
+    // DOWNLOAD_QUEUED, DOWNLOAD_RUNNING or DOWNLOAD_PAUSED
+    state string
+    // Queued downloads with a higher priority start first
+    priority int
+    queuedAt time.Time
+    // Source to request the root metafile from, "" for any of them
+    rootSource string
+    // State of each chunk, nil until the root metafile is received
+    chunks []byte
+    // Parsed root metafile, nil until it is received
+    root *metafileRoot
+    // Hex hash -> other metafiles of the file, read once from the chunk store
+    metafiles map[string][]byte
+    // Part file the chunks are written to, nil until the root metafile is received
+    part *os.File
+    // Size of the file, 0 until its last chunk is received
+    size int64
+    // Hex hash -> request waiting for its reply
+    pending map[string]*pendingRequest
+    // Every chunk before this offset is downloaded
+    firstMissing int
+    // Name -> source
+    sources map[string]*downloadSource
+    // Offset -> sources that didn't answer the request of the chunk
+    failedSources map[int][]string
+    // Progressed since its state was last saved
+    isDirty bool
+    // Bytes of the chunks downloaded, and their value at the last rate update
+    bytesDone int64
+    lastBytesDone int64
+    // Bytes per second, smoothed over the last updates
+    rate float64
+}
+
+func newDownload(metahash string, file *model.FileDownload) *download {
+    return &download{
+        metahash: metahash,
+        file: file,
+        state: DOWNLOAD_QUEUED,
+        priority: 0,
+        queuedAt: time.Now(),
+        rootSource: "",
+        chunks: nil,
+        root: nil,
+        metafiles: make(map[string][]byte),
+        part: nil,
+        size: 0,
+        pending: make(map[string]*pendingRequest),
+        firstMissing: 0,
+        sources: make(map[string]*downloadSource),
+        failedSources: make(map[int][]string),
+        isDirty: false,
+        bytesDone: 0,
+        lastBytesDone: 0,
+        rate: 0,
+    }
+}
+
+func (d *download) addFailedSource(offset int, name string) {
+    for _, failed := range d.failedSources[offset] {
+        if failed == name {
+            return
+        }
+    }
+    d.failedSources[offset] = append(d.failedSources[offset], name)
+}
+
+// Set the number of outstanding DataRequests per download and per source
+func (fs *FileSharing) SetWindows(window, sourceWindow int) {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    fs.window = window
+    fs.sourceWindow = sourceWindow
+}
+
+// Queue the download of file from sources: name -> chunks it offers as pairs
+// of first and last chunk number, nil if it offers all of them. The root metafile is requested to rootSource
+func (fs *FileSharing) startDownload(metahash string, file *model.FileDownload, sources map[string][]uint64, rootSource string, priority int) error {
+    fs.downloadsMutex.Lock()
+    if _, isDownloading := fs.downloads[metahash]; isDownloading {
+        fs.downloadsMutex.Unlock()
+        return errors.New("the file is already being downloaded")
+    }
+
+    d := newDownload(metahash, file)
+    d.priority = priority
+    d.rootSource = rootSource
+    for name, chunkRanges := range sources {
+        fs.addDownloadSource(d, name, chunkRanges)
+    }
+    fs.downloads[metahash] = d
+    fs.availableFilesMutex.Lock()
+    fs.AvailableFiles[metahash] = file
+    fs.availableFilesMutex.Unlock()
+    toSend := fs.schedule()
+    state := fs.stateOf(d)
+    fs.downloadsMutex.Unlock()
+
+    fs.saveState(state)
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    return nil
+}
+
+// Add a source offering the given chunks, as pairs of first and last chunk
+// number, to the download of the file with the given hex metahash if there is
+// one. nbChunks is the number of chunks of the file according to the source
+func (fs *FileSharing) addSource(metahash string, name string, chunkRanges []uint64, nbChunks uint64) {
+    if name == fs.gossiper.Name {
+        return
+    }
+
+    fs.downloadsMutex.Lock()
+    d, isDownloading := fs.downloads[metahash]
+    if isDownloading && d.root != nil && uint64(d.root.nbChunks) != nbChunks {
+        filesLog.Warning("Ignored source " + name + " for " + d.file.LocalName + " with a wrong number of chunks")
+        isDownloading = false
+    }
+    toSend := make([]*model.DataRequest, 0)
+    if isDownloading {
+        if _, isKnown := d.sources[name]; !isKnown {
+            filesLog.Info("New source " + name + " for " + d.file.LocalName)
+        }
+        fs.addDownloadSource(d, name, chunkRanges)
+        d.isDirty = true
+        if d.chunks != nil {
+            toSend = fs.fillWindow(d)
+        }
+    }
+    fs.downloadsMutex.Unlock()
+
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+}
+
+// Add a source offering the given chunks, as pairs of first and last chunk
+// number, or every chunk if chunkRanges is nil. Must be called with
+// downloadsMutex locked
+func (fs *FileSharing) addDownloadSource(d *download, name string, chunkRanges []uint64) {
+    source, isKnown := d.sources[name]
+    if !isKnown {
+        source = &downloadSource{
+            hasAll: false,
+            chunks: make([]bool, 0),
+            failures: 0,
+        }
+        d.sources[name] = source
+    }
+
+    if chunkRanges == nil {
+        source.hasAll = true
+        return
+    }
+
+    // Chunks past the end of the file are never offered
+    nbChunks := uint64(MAX_NB_CHUNKS)
+    if d.root != nil {
+        nbChunks = uint64(d.root.nbChunks)
+    }
+    for i := 0; i + 1 < len(chunkRanges); i += 2 {
+        first := chunkRanges[i]
+        last := chunkRanges[i + 1]
+        if first < 1 {
+            first = 1
+        }
+        if last > nbChunks {
+            last = nbChunks
+        }
+        if first > last {
+            continue
+        }
+
+        if int(last) > len(source.chunks) {
+            source.chunks = append(source.chunks, make([]bool, int(last) - len(source.chunks))...)
+        }
+        for chunkNb := first; chunkNb <= last; chunkNb++ {
+            source.chunks[chunkNb - 1] = true
+        }
+    }
+}
+
+// True if the file with the given hex metahash is being downloaded
+func (fs *FileSharing) isDownloading(metahash string) bool {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    _, isDownloading := fs.downloads[metahash]
+    return isDownloading
+}
+
+// Chunks held of the file with the given hex metahash, nil if the file is complete
+func (fs *FileSharing) heldChunks(metahash string) []bool {
+    fs.downloadsMutex.Lock()
+    defer fs.downloadsMutex.Unlock()
+
+    d, isDownloading := fs.downloads[metahash]
+    if !isDownloading {
+        return nil
+    }
+
+    held := make([]bool, len(d.chunks))
+    for i, state := range d.chunks {
+        held[i] = state == CHUNK_DONE
+    }
+    return held
+}
+
+// Handle a DataReply for this node, return false if no download requested it
+func (fs *FileSharing) receiveData(dr *model.DataReply) bool {
+    hexHash := hex.EncodeToString(dr.HashValue)
+    toSend := make([]*model.DataRequest, 0)
+    completed := make([]*download, 0)
+    failed := make([]*download, 0)
+    isPaused := false
+    isRequested := false
+
+    fs.downloadsMutex.Lock()
+    for _, d := range fs.downloads {
+        request, isPending := d.pending[hexHash]
+        if !isPending {
+            continue
+        }
+        isRequested = true
+
+        fs.removePendingRequest(d, hexHash)
+        // The reply may come from another node than the one asked
+        if dr.Origin == request.source {
+            fs.gossiper.Reputation.RewardLatency(request.source, time.Since(request.sentAt))
+        }
+        if source, isSource := d.sources[request.source]; isSource {
+            source.failures = 0
+        }
+
+        // The hash of a metafile doesn't tell if it lists the chunks its
+        // place in the tree requires, the file can't be downloaded otherwise
+        if d.chunks != nil && len(request.offsets) == 0 && len(dr.Data) != request.size {
+            filesLog.Error("Invalid metafile of " + d.file.LocalName + " from " + dr.Origin + ": it has " + strconv.Itoa(len(dr.Data) / 32) + " hashes instead of " + strconv.Itoa(request.size / 32))
+            fs.gossiper.Reputation.PenalizeOrigin(dr.Origin, REPUTATION_INVALID_DATA_REPLY)
+            delete(fs.downloads, d.metahash)
+            failed = append(failed, d)
+            continue
+        }
+
+        // Metafiles are stored until the download completes, chunks are
+        // written to the part file of the download
+        if len(request.offsets) == 0 && fs.writeBytesToFile(hexHash, dr.Data) != nil {
+            fs.pauseOnError(d)
+            isPaused = true
+            continue
+        }
+
+        if d.chunks == nil {
+            if !fs.receiveRootMetafile(d, dr) {
+                delete(fs.downloads, d.metahash)
+                failed = append(failed, d)
+                continue
+            }
+        } else if len(request.offsets) > 0 {
+            if !fs.receiveChunk(d, request, dr) {
+                fs.pauseOnError(d)
+                isPaused = true
+                continue
+            }
+        } else {
+            d.metafiles[hexHash] = dr.Data
+            filesLog.Debug("Downloaded a metafile of " + d.file.LocalName + " from " + dr.Origin)
+        }
+
+        if d.chunks != nil && d.firstMissing >= len(d.chunks) {
+            delete(fs.downloads, d.metahash)
+            completed = append(completed, d)
+            continue
+        }
+        toSend = append(toSend, fs.fillWindow(d)...)
+    }
+
+    // Queued downloads take the place of the ones that ended
+    if len(completed) > 0 || len(failed) > 0 || isPaused {
+        toSend = append(toSend, fs.schedule()...)
+    }
+
+    // Requests to other downloads may fit in the windows freed by the reply
+    if isRequested {
+        for _, d := range fs.downloads {
+            if d.chunks != nil && len(d.pending) < fs.window {
+                toSend = append(toSend, fs.fillWindow(d)...)
+            }
+        }
+    }
+    fs.downloadsMutex.Unlock()
+
+    // Send outside of the lock: a request to this node is answered synchronously
+    for _, request := range toSend {
+        go fs.sendDataRequest(request)
+    }
+    for _, d := range completed {
+        fs.completeDownload(d)
+    }
+    for _, d := range failed {
+        fs.availableFilesMutex.Lock()
+        delete(fs.AvailableFiles, d.metahash)
+        fs.availableFilesMutex.Unlock()
+
+        filesLog.Error("The download of " + d.file.LocalName + " failed")
+        fs.discardPart(d)
+        fs.removeState(d.metahash)
+    }
+    return isRequested
+}
+
+// Set up the chunks of d from its root metafile, return false if it is invalid
+func (fs *FileSharing) receiveRootMetafile(d *download, dr *model.DataReply) bool {
+    root, err := parseMetafileRoot(dr.Data)
+    if err != nil {
+        filesLog.Error("Invalid metafile of " + d.file.LocalName + " from " + dr.Origin + ": " + err.Error())
+        fs.gossiper.Reputation.PenalizeOrigin(dr.Origin, REPUTATION_INVALID_DATA_REPLY)
+        return false
+    }
+
+    filesLog.Event(logger.INFO, "DOWNLOADING", "DOWNLOADING metafile of " + d.file.LocalName + " from " + dr.Origin, logger.Fields{
+        "filename": d.file.LocalName,
+        "origin": dr.Origin,
+        "metafile": true,
+    })
+
+    fs.gossiper.Events.Publish(&Event{
+        Type: EVENT_CHUNK_DOWNLOADED,
+        Chunk: &ChunkDownload{
+            Filename: d.file.LocalName,
+            MetaHash: d.metahash,
+            ChunkNb: 0,
+            NbChunks: root.nbChunks,
+            From: dr.Origin,
+        },
+    })
+
+    fs.setUpChunks(d, dr.HashValue, root)
+    if err := fs.openPart(d); err != nil {
+        filesLog.Error("Could not create the file of " + d.file.LocalName + ": " + err.Error())
+        return false
+    }
+    d.isDirty = true
+    return true
+}
+
+func (fs *FileSharing) setUpChunks(d *download, metahash []byte, root *metafileRoot) {
+    fs.availableFilesMutex.Lock()
+    d.file.MetaHash = metahash
+    d.file.NbChunks = root.nbChunks
+    d.file.NbChunksDone = 0
+    d.file.ChunksLocation = make([]string, root.nbChunks)
+    fs.availableFilesMutex.Unlock()
+
+    d.chunks = make([]byte, root.nbChunks)
+    d.root = root
+
+    // Sources added before the metafile can't offer chunks past the end of the file
+    for _, source := range d.sources {
+        if len(source.chunks) > root.nbChunks {
+            source.chunks = source.chunks[:root.nbChunks]
+        }
+    }
+}
+
+// Hash of chunk number offset of d, see metafileRoot.chunkHash. The metafiles
+// are read once from the chunk store. Must be called with downloadsMutex
+// locked once d is listed
+func (fs *FileSharing) chunkHashOf(d *download, offset int) ([]byte, []byte, int) {
+    return d.root.chunkHash(offset, func(hexHash string) []byte {
+        metafile, isCached := d.metafiles[hexHash]
+        if !isCached {
+            metafile = fs.readChunkFile(hexHash)
+            if metafile != nil {
+                d.metafiles[hexHash] = metafile
+            }
+        }
+        return metafile
+    })
+}
+
+// Write the chunks of the reply to the part file of d, return false if it fails
+func (fs *FileSharing) receiveChunk(d *download, request *pendingRequest, dr *model.DataReply) bool {
+    hexHash := hex.EncodeToString(dr.HashValue)
+    origin := dr.Origin
+    isPenalized := false
+
+    for _, offset := range request.offsets {
+        if d.chunks[offset] == CHUNK_DONE {
+            continue
+        }
+
+        // A chunk of the wrong size would overwrite the next one in the part file
+        if !isValidChunkSize(d, offset, len(dr.Data)) {
+            filesLog.Error("Chunk " + strconv.Itoa(offset + 1) + " of " + d.file.LocalName + " from " + origin + " has an invalid size of " + strconv.Itoa(len(dr.Data)) + " bytes")
+            if !isPenalized {
+                fs.gossiper.Reputation.PenalizeOrigin(origin, REPUTATION_INVALID_DATA_REPLY)
+                isPenalized = true
+            }
+            d.chunks[offset] = CHUNK_MISSING
+            d.addFailedSource(offset, request.source)
+            d.addFailedSource(offset, origin)
+            continue
+        }
+
+        if err := fs.writeChunk(d, offset, hexHash, dr.Data); err != nil {
+            filesLog.Error("Could not write to the file of " + d.file.LocalName + ": " + err.Error())
+            for _, missing := range request.offsets {
+                if d.chunks[missing] != CHUNK_DONE {
+                    d.chunks[missing] = CHUNK_MISSING
+                }
+            }
+            return false
+        }
+
+        d.chunks[offset] = CHUNK_DONE
+        d.isDirty = true
+        d.bytesDone += int64(len(dr.Data))
+        delete(d.failedSources, offset)
+        if source, isSource := d.sources[origin]; isSource {
+            source.downloaded += 1
+        }
+
+        fs.availableFilesMutex.Lock()
+        d.file.NbChunksDone += 1
+        d.file.ChunksLocation[offset] = origin
+        fs.availableFilesMutex.Unlock()
+
+        chunkNb := offset + 1
+        filesLog.Event(logger.INFO, "DOWNLOADING", "DOWNLOADING " + d.file.LocalName + " chunk " + strconv.Itoa(chunkNb) + " from " + origin, logger.Fields{
+            "filename": d.file.LocalName,
+            "origin": origin,
+            "chunk": chunkNb,
+        })
+
+        fs.gossiper.Events.Publish(&Event{
+            Type: EVENT_CHUNK_DOWNLOADED,
+            Chunk: &ChunkDownload{
+                Filename: d.file.LocalName,
+                MetaHash: d.metahash,
+                ChunkNb: chunkNb,
+                NbChunks: d.file.NbChunks,
+                From: origin,
+            },
+        })
+    }
+
+    for d.firstMissing < len(d.chunks) && d.chunks[d.firstMissing] == CHUNK_DONE {
+        d.firstMissing += 1
+    }
+    return true
+}
+
+// Request missing chunks of d, in order, until its window or the windows of
+// its sources are full. Return the requests to send. Must be called with
+// downloadsMutex locked
+func (fs *FileSharing) fillWindow(d *download) []*model.DataRequest {
+    toSend := make([]*model.DataRequest, 0)
+    if d.state != DOWNLOAD_RUNNING {
+        return toSend
+    }
+
+    // Past reach, no source with a free window offers chunks
+    reach := fs.reachOf(d)
+    for offset := d.firstMissing; offset < reach && len(d.pending) < fs.window; offset++ {
+        if d.chunks[offset] != CHUNK_MISSING {
+            continue
+        }
+
+        source := fs.pickSource(d, offset)
+        if source == "" {
+            // No source offers this chunk yet, or they are all busy
+            continue
+        }
+
+        chunkHash, metafileHash, metafileLen := fs.chunkHashOf(d, offset)
+        if chunkHash == nil {
+            if metafileHash == nil {
+                filesLog.Error("The metafile of " + d.file.LocalName + " is incomplete")
+                break
+            }
+
+            // The metafile listing the chunk is needed first, whoever has the
+            // chunk also has the metafiles leading to it
+            if _, isPending := d.pending[hex.EncodeToString(metafileHash)]; !isPending {
+                toSend = append(toSend, fs.addPendingRequest(d, metafileHash, []int{}, offset, source))
+                d.pending[hex.EncodeToString(metafileHash)].size = metafileLen
+            }
+            break
+        }
+
+        d.chunks[offset] = CHUNK_REQUESTED
+        if request, isPending := d.pending[hex.EncodeToString(chunkHash)]; isPending {
+            // Identical chunks are requested once
+            request.offsets = append(request.offsets, offset)
+            continue
+        }
+        toSend = append(toSend, fs.addPendingRequest(d, chunkHash, []int{offset}, offset, source))
+        reach = fs.reachOf(d)
+    }
+
+    return toSend
+}
+
+// Source to request chunk offset (-1 for the root metafile) from: the least
+// loaded of the sources offering it. Sources that failed to send the chunk or
+// timed out too often are only used if there is no other one. Return "" if
+// every candidate has a full window. Must be called with downloadsMutex locked
+func (fs *FileSharing) pickSource(d *download, offset int) string {
+    preferred := make([]string, 0)
+    others := make([]string, 0)
+    for name, source := range d.sources {
+        if !source.offers(offset) {
+            continue
+        }
+
+        hasFailed := false
+        for _, failed := range d.failedSources[offset] {
+            hasFailed = hasFailed || failed == name
+        }
+        if hasFailed || source.isDead() {
+            others = append(others, name)
+        } else {
+            preferred = append(preferred, name)
+        }
+    }
+
+    candidates := preferred
+    if len(candidates) == 0 {
+        candidates = others
+    }
+
+    leastLoaded := make([]string, 0)
+    minLoad := fs.sourceWindow
+    for _, name := range candidates {
+        load := fs.sourceLoad[name]
+        if load < minLoad {
+            minLoad = load
+            leastLoaded = []string{name}
+        } else if load == minLoad && load < fs.sourceWindow {
+            leastLoaded = append(leastLoaded, name)
+        }
+    }
+
+    if len(leastLoaded) == 0 {
+        return ""
+    }
+    return fs.gossiper.Reputation.BestOrigin(leastLoaded)
+}
+
+// End of the chunks of d offered by the sources with a free window, 0 if
+// they are all full. Must be called with downloadsMutex locked
+func (fs *FileSharing) reachOf(d *download) int {
+    reach := 0
+    for name, source := range d.sources {
+        if fs.sourceLoad[name] >= fs.sourceWindow {
+            continue
+        }
+        if source.hasAll || len(source.chunks) >= len(d.chunks) {
+            return len(d.chunks)
+        }
+        if len(source.chunks) > reach {
+            reach = len(source.chunks)
+        }
+    }
+    return reach
+}
+
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) addPendingRequest(d *download, hashValue []byte, offsets []int, forChunk int, source string) *model.DataRequest {
+    d.pending[hex.EncodeToString(hashValue)] = &pendingRequest{
+        hash: hashValue,
+        offsets: offsets,
+        forChunk: forChunk,
+        size: 0,
+        source: source,
+        sentAt: time.Now(),
+    }
+    fs.sourceLoad[source] += 1
+
+    return fs.newDataRequest(source, hashValue)
+}
+
+func (fs *FileSharing) newDataRequest(dest string, hashValue []byte) *model.DataRequest {
+    return &model.DataRequest{
+        Origin: fs.gossiper.Name,
+        Destination: dest,
+        HopLimit: 10,
+        HashValue: hashValue,
+    }
+}
+
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) removePendingRequest(d *download, hexHash string) {
+    request, isPending := d.pending[hexHash]
+    if !isPending {
+        return
+    }
+
+    delete(d.pending, hexHash)
+    fs.sourceLoad[request.source] -= 1
+    if fs.sourceLoad[request.source] <= 0 {
+        delete(fs.sourceLoad, request.source)
+    }
+}
+
+// Retry the requests not answered after TIMEOUT_DATA_REQUEST seconds at
+// another source when possible, and save the state of the downloads
+func (fs *FileSharing) watchDownloads() {
+    lastSave := time.Now()
+    for {
+        time.Sleep(DOWNLOAD_TIMEOUT_CHECK_PERIOD * time.Millisecond)
+
+        fs.updateRates()
+        if time.Since(lastSave) >= DOWNLOAD_SAVE_PERIOD * time.Second {
+            fs.saveDownloads()
+            lastSave = time.Now()
+        }
+
+        toSend := make([]*model.DataRequest, 0)
+        fs.downloadsMutex.Lock()
+        for _, d := range fs.downloads {
+            toSend = append(toSend, fs.retryTimedOut(d)...)
+        }
+        fs.downloadsMutex.Unlock()
+
+        for _, request := range toSend {
+            go fs.sendDataRequest(request)
+        }
+    }
+}
+
+// Must be called with downloadsMutex locked
+func (fs *FileSharing) retryTimedOut(d *download) []*model.DataRequest {
+    toSend := make([]*model.DataRequest, 0)
+    hasTimedOut := false
+
+    for hexHash, request := range d.pending {
+        if time.Since(request.sentAt) < TIMEOUT_DATA_REQUEST * time.Second {
+            continue
+        }
+        hasTimedOut = true
+
+        filesLog.Info("DataRequest to " + request.source + " timed out, retrying")
+        fs.gossiper.Reputation.PenalizeOrigin(request.source, REPUTATION_DATA_REQUEST_TIMEOUT)
+        fs.removePendingRequest(d, hexHash)
+
+        if source, isSource := d.sources[request.source]; isSource {
+            source.failures += 1
+            if source.failures == DOWNLOAD_SOURCE_MAX_FAILURES {
+                filesLog.Warning("Abandoning source " + request.source + " of " + d.file.LocalName + " after " + strconv.Itoa(source.failures) + " timeouts")
+            }
+        }
+
+        d.addFailedSource(request.forChunk, request.source)
+        for _, offset := range request.offsets {
+            d.chunks[offset] = CHUNK_MISSING
+            d.addFailedSource(offset, request.source)
+        }
+
+        // The root metafile is needed before any chunk
+        if d.chunks == nil {
+            source := fs.pickSource(d, -1)
+            if source == "" {
+                source = request.source
+            }
+            toSend = append(toSend, fs.addPendingRequest(d, request.hash, []int{}, -1, source))
+        }
+    }
+
+    if hasTimedOut && d.chunks != nil {
+        toSend = append(toSend, fs.fillWindow(d)...)
+    }
+    return toSend
+}
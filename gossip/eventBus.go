@@ -0,0 +1,170 @@
+package gossip
+
+import (
+    "sync"
+    "time"
+    "github.com/pablo11/Peerster/model"
+)
+
+const EVENT_SUBSCRIPTION_BUFFER_LEN int = 64 // Events buffered for a slow subscriber before dropping new ones
+
+type EventType string
+
+const (
+    EVENT_RUMOR_DELIVERED EventType = "rumorDelivered"
+    EVENT_PRIVATE_MESSAGE_RECEIVED EventType = "privateMessageReceived"
+    EVENT_PRIVATE_MESSAGE_STATE EventType = "privateMessageState"
+    EVENT_ROUTE_CHANGED EventType = "routeChanged"
+    EVENT_CHUNK_DOWNLOADED EventType = "chunkDownloaded"
+    EVENT_FILE_RECONSTRUCTED EventType = "fileReconstructed"
+    EVENT_FILE_SOURCE_CHANGED EventType = "fileSourceChanged"
+    EVENT_SEARCH_MATCH EventType = "searchMatch"
+    EVENT_BLOCK_ACCEPTED EventType = "blockAccepted"
+    EVENT_FORK_SWITCHED EventType = "forkSwitched"
+)
+
+// An event emitted by the gossiper. Exactly one of the payload fields,
+// corresponding to Type, is set
+type Event struct {
+    Type EventType
+    Time time.Time
+
+    Rumor *model.RumorMessage
+    Private *model.PrivateMessage
+    Delivery *PrivateDeliveryState
+    Route *RouteChange
+    Chunk *ChunkDownload
+    File *FileReconstructed
+    Source *FileSourceChange
+    Match *SearchMatch
+    Block *BlockAccepted
+    Fork *ForkSwitch
+}
+
+type PrivateDeliveryState struct {
+    ID uint32
+    Destination string
+    // DELIVERY_PENDING, DELIVERY_QUEUED, DELIVERY_DELIVERED or DELIVERY_FAILED
+    State string
+}
+
+type RouteChange struct {
+    Origin string
+    NextHop string
+}
+
+type ChunkDownload struct {
+    Filename string
+    MetaHash string
+    // Chunk number starting from 1, 0 for the metafile
+    ChunkNb int
+    NbChunks int
+    From string
+}
+
+type FileReconstructed struct {
+    Filename string
+    MetaHash string
+}
+
+type FileSourceChange struct {
+    Filename string
+    MetaHash string
+    Path string
+    // SOURCE_OK, SOURCE_CHANGED or SOURCE_MISSING
+    State string
+    // Metahash of the new content when the source changed
+    NewMetaHash string
+}
+
+type SearchMatch struct {
+    Filename string
+    MetaHash string
+    Origin string
+    // Chunks held by the origin, as pairs of first and last chunk number
+    ChunkRanges []uint64
+    ChunkCount uint64
+    // True when all chunks of the file have a known location
+    IsFullMatch bool
+}
+
+type BlockAccepted struct {
+    Hash string
+    PrevHash string
+    Filenames []string
+    OnLongestChain bool
+}
+
+type ForkSwitch struct {
+    OldHead string
+    NewHead string
+    Rewind int
+}
+
+// A subscription receives the events of the requested types on C
+type Subscription struct {
+    C chan *Event
+    types map[EventType]bool
+}
+
+// In-process publish/subscribe bus. Publishing never blocks: if a subscriber
+// doesn't consume its events fast enough, new events are dropped for it
+type EventBus struct {
+    subscriptions map[*Subscription]bool
+    subscriptionsMutex sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+    return &EventBus{
+        subscriptions: make(map[*Subscription]bool),
+        subscriptionsMutex: sync.RWMutex{},
+    }
+}
+
+// Subscribe to the given event types, or to every event if none is given
+func (eb *EventBus) Subscribe(types ...EventType) *Subscription {
+    s := &Subscription{
+        C: make(chan *Event, EVENT_SUBSCRIPTION_BUFFER_LEN),
+        types: make(map[EventType]bool),
+    }
+    for _, t := range types {
+        s.types[t] = true
+    }
+
+    eb.subscriptionsMutex.Lock()
+    eb.subscriptions[s] = true
+    eb.subscriptionsMutex.Unlock()
+    return s
+}
+
+// Stop receiving events and close the subscription channel
+func (eb *EventBus) Unsubscribe(s *Subscription) {
+    eb.subscriptionsMutex.Lock()
+    defer eb.subscriptionsMutex.Unlock()
+
+    if _, isPresent := eb.subscriptions[s]; isPresent {
+        delete(eb.subscriptions, s)
+        close(s.C)
+    }
+}
+
+func (eb *EventBus) Publish(e *Event) {
+    if e.Time.IsZero() {
+        e.Time = time.Now()
+    }
+
+    eb.subscriptionsMutex.RLock()
+    defer eb.subscriptionsMutex.RUnlock()
+
+    for s, _ := range eb.subscriptions {
+        if len(s.types) > 0 && !s.types[e.Type] {
+            continue
+        }
+
+        select {
+        case s.C <- e:
+        default:
+            gossipLog.Debug("Dropping event " + string(e.Type) + " for a slow subscriber")
+        }
+    }
+}
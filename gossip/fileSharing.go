@@ -1,15 +1,17 @@
 package gossip
 
 import (
-    "time"
+    "errors"
     "math"
-    "fmt"
     "os"
+    "strconv"
     "io"
-    "io/ioutil"
+    "path/filepath"
     "sync"
+    "time"
     "encoding/hex"
     "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 const MAX_CHUNK_SIZE = 8192 // Chunk size in byte (8KB)
@@ -22,17 +24,44 @@ type FileSharing struct {
     gossiper *Gossiper
     // When downloading a file store it here: metaHash->file
     AvailableFiles map[string]*model.FileDownload
-    // Mapping from hash to channel for notifying a data reply
-    waitDataRequestChannels map[string]chan bool
-
-    waitDataRequestChannelsMutex sync.Mutex
+    chunks *ChunkStore
+
+    // Metahash -> download in progress
+    downloads map[string]*download
+    // Source -> outstanding DataRequests of all the downloads
+    sourceLoad map[string]int
+    window int
+    sourceWindow int
+    // Downloads running at the same time
+    maxActive int
+    ratesUpdatedAt time.Time
+    // Directory of the saved state of the downloads
+    stateDir string
+    // Path given by the client -> its last indexing
+    indexJobs map[string]*IndexJob
+
+    availableFilesMutex sync.Mutex
+    downloadsMutex sync.Mutex
+    stateMutex sync.Mutex
+    indexJobsMutex sync.Mutex
 }
 
 func NewFileSharing() *FileSharing{
     return &FileSharing{
         AvailableFiles: make(map[string]*model.FileDownload),
-        waitDataRequestChannels: make(map[string]chan bool),
-        waitDataRequestChannelsMutex: sync.Mutex{},
+        chunks: NewChunkStore(),
+        downloads: make(map[string]*download),
+        sourceLoad: make(map[string]int),
+        window: DOWNLOAD_DEFAULT_WINDOW,
+        sourceWindow: DOWNLOAD_DEFAULT_SOURCE_WINDOW,
+        maxActive: DOWNLOAD_DEFAULT_MAX_ACTIVE,
+        ratesUpdatedAt: time.Now(),
+        stateDir: DOWNLOAD_STATE_DIR,
+        indexJobs: make(map[string]*IndexJob),
+        availableFilesMutex: sync.Mutex{},
+        downloadsMutex: sync.Mutex{},
+        stateMutex: sync.Mutex{},
+        indexJobsMutex: sync.Mutex{},
     }
 }
 
@@ -42,86 +71,118 @@ func (fs *FileSharing) SetGossiper(g *Gossiper) {
     // Make a directory for each node to simulate nodes not in the same location
     CHUNKS_DIR = CHUNKS_DIR + g.Name + "/"
     os.MkdirAll(CHUNKS_DIR, os.ModePerm);
+    fs.stateDir = DOWNLOAD_STATE_DIR + g.Name + "/"
+
+    go fs.watchSources()
+    go fs.watchDownloads()
+    go fs.resumeDownloads()
+}
+
+// Index a file and return its hex metahash. path is either absolute or
+// relative to the shared files directory
+func (fs *FileSharing) IndexFile(path string) (string, error) {
+    if filepath.IsAbs(path) {
+        return fs.indexFileAt(filepath.Clean(path), filepath.Base(path))
+    }
+    return fs.indexFileAt(SHARED_FILES_DIR + path, path)
 }
 
-func (fs *FileSharing) IndexFile(path string) {
+// Index the file at fullPath under the name localName
+func (fs *FileSharing) indexFileAt(fullPath, localName string) (string, error) {
     var err error
     var f *os.File
+    path := localName
 
     // Open the file
-    f, err = os.Open(SHARED_FILES_DIR + path)
+    f, err = os.Open(fullPath)
     if err != nil {
-        fmt.Println("ERROR: Could not open the file " + path)
-        fmt.Println(err)
-        return
+        filesLog.Error("Could not open the file " + fullPath)
+        filesLog.Error(err.Error())
+        return "", errors.New("could not open the file " + path)
     }
     defer f.Close()
 
-    // Check filesize (allow up to maxNbChunks in one single metafile)
+    // Check filesize
     fi, err2 := f.Stat()
     if err2 != nil {
-        fmt.Println("ERROR: Could not read file length")
-        fmt.Println(err)
-        return
+        filesLog.Error("Could not read file length")
+        filesLog.Error(err2.Error())
+        return "", errors.New("could not read the length of " + path)
+    }
+    if !fi.Mode().IsRegular() {
+        return "", errors.New(path + " is not a regular file")
     }
     filesize := fi.Size()
     requiredNbChunks := int(math.Ceil(float64(filesize) / MAX_CHUNK_SIZE))
-    if requiredNbChunks > int(MAX_CHUNK_SIZE / 32) {
-        fmt.Println("ERROR: The file is too large to be indexed")
-        fmt.Println()
-        return
+    if requiredNbChunks > MAX_NB_CHUNKS {
+        filesLog.Error("The file is too large to be indexed")
+        return "", errors.New("the file is too large to be indexed")
     }
 
-    var metafile []byte
+    chunkHashes := make([]byte, 0, requiredNbChunks * 32)
     var nbChunks uint64 = 0
-    // Read chunks and build up metafile
+    // Read chunks and build up metafile. Chunks are served from the file
+    // itself, only their location is kept
     buffer := make([]byte, MAX_CHUNK_SIZE)
     bytesread := 0
     hashBytes := make([]byte, 0)
+    var offset int64 = 0
     for {
-        bytesread, err = f.Read(buffer)
+        bytesread, err = io.ReadFull(f, buffer)
 
-        if err != nil {
-            if err != io.EOF {
-                fmt.Println(err)
-            }
+        if err == io.EOF {
             break
         }
+        if err != nil && err != io.ErrUnexpectedEOF {
+            filesLog.Error(err.Error())
+            return "", err
+        }
 
         // Compute hash of chunk
         hashBytes = hash(buffer[:bytesread])
-        err = fs.writeBytesToFile(hex.EncodeToString(hashBytes), buffer[:bytesread])
-        if (err != nil) {
-            return
-        }
+        fs.chunks.addReference(hex.EncodeToString(hashBytes), fullPath, offset, bytesread)
 
         // Add chunk to available chunks
-        metafile = append(metafile, hashBytes...)
+        chunkHashes = append(chunkHashes, hashBytes...)
         nbChunks += 1
+        offset += int64(bytesread)
     }
 
+    // Large files get a tree of metafiles, kept in memory like the root
+    metafile, metafileNodes := buildMetafileTree(chunkHashes)
+    for nodeHash, node := range metafileNodes {
+        fs.chunks.addMetafile(nodeHash, node)
+    }
     metaHash := hash(metafile)
 
-    fmt.Printf("METAHASH: %x\n", metaHash)
-
-    fmt.Println("Number of chunks: ", nbChunks)
-    fmt.Println()
+    filesLog.Event(logger.INFO, "INDEXED", "METAHASH: " + hex.EncodeToString(metaHash), logger.Fields{
+        "filename": path,
+        "path": fullPath,
+        "metahash": hex.EncodeToString(metaHash),
+        "chunks": nbChunks,
+    })
+    filesLog.Info("Number of chunks:  " + strconv.FormatUint(nbChunks, 10))
 
-    _ = fs.writeBytesToFile(hex.EncodeToString(metaHash), metafile)
+    fs.chunks.addMetafile(hex.EncodeToString(metaHash), metafile)
 
     chunksLocation := make([]string, int(nbChunks))
     for i, _ := range chunksLocation {
         chunksLocation[i] = fs.gossiper.Name
     }
 
+    fs.availableFilesMutex.Lock()
     fs.AvailableFiles[hex.EncodeToString(metaHash)] = &model.FileDownload{
         LocalName: path,
+        Path: fullPath,
+        Size: filesize,
+        SourceModTime: fi.ModTime(),
+        SourceState: SOURCE_OK,
         MetaHash: metaHash,
-        NextChunkOffset: int(nbChunks),
-        NextChunkHash: "",
+        NbChunksDone: int(nbChunks),
         NbChunks: int(nbChunks),
         ChunksLocation: chunksLocation,
     }
+    fs.availableFilesMutex.Unlock()
 
     // Publish file for blockchain
     go fs.gossiper.SendTxPublish(&model.File{
@@ -129,72 +190,79 @@ func (fs *FileSharing) IndexFile(path string) {
         Size: filesize,
         MetafileHash: metaHash,
     })
+
+    return hex.EncodeToString(metaHash), nil
 }
 
 // If dest is "", the file is downloaded from multiple sources. Sources are
-// retreived from the corresponding FullMatches entry
-func (fs *FileSharing) RequestFile(filename, dest, metahash string) {
-    byteHash, err := hex.DecodeString(metahash)
+// retreived from the corresponding FullMatches entry. The download waits in
+// the queue if too many are running, the highest priorities start first
+func (fs *FileSharing) RequestFile(filename, dest, metahash string, priority int) error {
+    _, err := hex.DecodeString(metahash)
     if err != nil {
-        fmt.Println("ERROR: The provided request is not an hash")
-        return
+        filesLog.Error("The provided request is not an hash")
+        return errors.New("the provided request is not an hash")
     }
 
-    // Prepare chunk locations
-    chunksLocation := make([]string, MAX_CHUNK_SIZE / 32)
+    // Sources -> chunks they offer as pairs of first and last chunk number,
+    // nil for all of them
+    sources := map[string][]uint64{dest: nil}
     if dest == "" {
-        // Download from multiple sources
-        for _, fullMatch := range fs.gossiper.FullMatches {
+        // Download from every source found by the search, later search
+        // replies can add sources while downloading
+        for _, fullMatch := range fs.gossiper.GetFullMatches() {
             if fullMatch.MetaHash == metahash {
-                chunksLocation = fullMatch.ChunksLocation
-                dest = fullMatch.ChunksLocation[0]
+                sources = fullMatch.Sources
+                // Every source has the metafile, ask it to the one with the best reputation
+                dest = fs.gossiper.Reputation.BestOrigin(fullMatch.SourceNames())
                 filename = fullMatch.Filename
             }
         }
 
         // Check if the FullMatch was found
         if dest == "" {
-            fmt.Println("ERROR: Could not download file from multiple sources, the FullMatch is missing")
-            return
-        }
-    } else {
-        // Download from single origin dest
-        for i, _ := range chunksLocation {
-            chunksLocation[i] = dest
+            filesLog.Error("Could not download file from multiple sources, the FullMatch is missing")
+            return errors.New("no full match found for this metahash, search the file first")
         }
     }
 
-    // Add this file to the AvailableFiles map
-    fs.AvailableFiles[metahash] = &model.FileDownload{
-        LocalName: filename,
-        MetaHash: nil,
-        NextChunkOffset: 0,
-        NextChunkHash: "",
-        NbChunks: 0,
-        ChunksLocation: chunksLocation,
+    // The name may come from a remote search result, never let it leave the downloads directory
+    filename = filepath.Base(filename)
+    if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+        filesLog.Error("Invalid filename for the download")
+        return errors.New("invalid filename for the download")
+    }
+
+    if dest != fs.gossiper.Name && fs.gossiper.GetNextHopForDest(dest) == "" {
+        return errors.New("no route to " + dest)
     }
 
-    // Prepare and send the request
-    dr := model.DataRequest{
-        Origin: fs.gossiper.Name,
-        Destination: dest,
-        HopLimit: 10,
-        HashValue: byteHash,
+    if fs.isDownloading(metahash) {
+        return errors.New("the file is already being downloaded")
     }
 
-    fs.sendDataRequest(&dr)
+    // Added to the AvailableFiles map once the download starts
+    file := &model.FileDownload{
+        LocalName: filename,
+        MetaHash: nil,
+        NbChunksDone: 0,
+        NbChunks: 0,
+        ChunksLocation: []string{},
+    }
+    return fs.startDownload(metahash, file, sources, dest, priority)
 }
 
 func (fs *FileSharing) HandleDataReply(dr *model.DataReply) {
     // Check validity of packet: HashValue must be equal to hash(dr.Data)
     if !dr.IsValid() {
-        fmt.Println("ERROR: Invalid packet. Dropped")
+        filesLog.Error("Invalid packet. Dropped")
+        fs.gossiper.Reputation.PenalizeOrigin(dr.Origin, REPUTATION_INVALID_DATA_REPLY)
         return
     }
 
     // If this node is not the destinatary forward the packet
     if dr.Destination != fs.gossiper.Name {
-        fmt.Println("Forwarding DataReply packet to " + dr.Destination)
+        routingLog.Info("Forwarding DataReply packet to " + dr.Destination)
         if dr.HopLimit > 1 {
             dr.HopLimit -= 1
             fs.sendDataReply(dr)
@@ -202,58 +270,8 @@ func (fs *FileSharing) HandleDataReply(dr *model.DataReply) {
         return
     }
 
-    // Notify packet received
-    fs.notifyChannelForHash(hex.EncodeToString(dr.HashValue))
-
-    file, isAvailableFiles := fs.AvailableFiles[hex.EncodeToString(dr.HashValue)]
-    if isAvailableFiles && file.MetaHash == nil {
-        fmt.Println("DOWNLOADING metafile of " + file.LocalName + " from " + dr.Origin)
-
-        nbChunks := len(dr.Data) / 32
-
-        // Store the metafile
-        err := fs.writeBytesToFile(hex.EncodeToString(dr.HashValue), dr.Data)
-        if (err != nil) {
-            return
-        }
-
-        // Ask for next Chunk: send DataRequest packet with HashValue equal to the first hash present in the Metafile
-        firstChunkHash := fs.getChunkHashFromMetafile(hex.EncodeToString(dr.HashValue), 0)
-        if firstChunkHash == nil {
-            fmt.Println("ERROR: If we get here, the metafile is empty")
-            return
-        }
-
-        fs.AvailableFiles[hex.EncodeToString(dr.HashValue)].NextChunkOffset = 0
-        fs.AvailableFiles[hex.EncodeToString(dr.HashValue)].MetaHash = dr.HashValue
-        fs.AvailableFiles[hex.EncodeToString(dr.HashValue)].NextChunkHash = hex.EncodeToString(firstChunkHash)
-        fs.AvailableFiles[hex.EncodeToString(dr.HashValue)].NbChunks = nbChunks
-        fs.requestData(fs.AvailableFiles[hex.EncodeToString(dr.HashValue)].ChunksLocation[0], firstChunkHash)
-    } else {
-        // Store the chunk
-        err := fs.writeBytesToFile(hex.EncodeToString(dr.HashValue), dr.Data)
-        if (err != nil) {
-            return
-        }
-
-        // Find metafile requesting this chunk
-        for metahash, file := range fs.AvailableFiles {
-            if file.NextChunkHash == hex.EncodeToString(dr.HashValue) {
-                fs.AvailableFiles[metahash].NextChunkOffset += 1
-                fmt.Println("DOWNLOADING " + file.LocalName + " chunk", fs.AvailableFiles[metahash].NextChunkOffset, "from " + dr.Origin)
-                nextChunkHash := fs.getChunkHashFromMetafile(metahash, file.NextChunkOffset)
-                if nextChunkHash == nil {
-                    // The download is complete. Reconstruct the file and save it with the local name
-                    fs.reconstructFile(metahash, file.LocalName)
-                } else {
-                    // Request next chunk
-                    fs.AvailableFiles[metahash].NextChunkHash = hex.EncodeToString(nextChunkHash)
-                    fs.requestData(fs.AvailableFiles[metahash].ChunksLocation[file.NextChunkOffset], nextChunkHash)
-                }
-
-                return
-            }
-        }
+    if !fs.receiveData(dr) {
+        filesLog.Debug("Dropped a DataReply that wasn't requested")
     }
 }
 
@@ -278,7 +296,7 @@ func (fs *FileSharing) HandleDataRequest(dr *model.DataRequest) {
 
     if dr.Destination != fs.gossiper.Name {
         // If I don't have the metafile/chunk, forward the request to the destination node
-        fmt.Println("Forwarding DataRequest packet to " + dr.Destination)
+        routingLog.Info("Forwarding DataRequest packet to " + dr.Destination)
         if dr.HopLimit > 1 {
             dr.HopLimit -= 1
             fs.sendDataRequest(dr)
@@ -286,150 +304,41 @@ func (fs *FileSharing) HandleDataRequest(dr *model.DataRequest) {
     }
 }
 
-func (fs *FileSharing) reconstructFile(metahash, filename string) {
-    f, err := os.Create(DOWNLOADS_DIR + filename)
-    if err != nil {
-        fmt.Println("ERROR: While creating the file")
-        fmt.Println(err)
-        return
-    }
-    defer f.Close()
-
-    metafileByteOffset := 0
-    nextChunkHash := make([]byte, 0)
-    chunkToWrite := make([]byte, 0)
-    var nbChunks uint64 = 0
-    for {
-        nextChunkHash = nextChunkHash[:0]
-        nextChunkHash = fs.getChunkHashFromMetafile(metahash, metafileByteOffset)
-        if nextChunkHash == nil {
-            break
-        }
+// Return a copy of the file with the given hex metahash, if indexed or downloaded
+func (fs *FileSharing) GetFile(metahash string) (model.FileDownload, bool) {
+    fs.availableFilesMutex.Lock()
+    defer fs.availableFilesMutex.Unlock()
 
-        chunkToWrite = fs.readChunkFile(hex.EncodeToString(nextChunkHash))
-        if (chunkToWrite == nil) {
-            return
-        }
-
-        _, err = f.Write(chunkToWrite)
-        if err != nil {
-            fmt.Println("ERROR: While writing the file")
-            fmt.Println(err)
-            return
-        }
-        metafileByteOffset += 1
-        nbChunks += 1
+    file, isPresent := fs.AvailableFiles[metahash]
+    if !isPresent {
+        return model.FileDownload{}, false
     }
+    return *file, true
+}
 
-    f.Sync()
+// Return a copy of every indexed or downloaded file, keyed by hex metahash
+func (fs *FileSharing) GetFiles() map[string]model.FileDownload {
+    fs.availableFilesMutex.Lock()
+    defer fs.availableFilesMutex.Unlock()
 
-    fmt.Println("RECONSTRUCTED file " + filename)
-    fmt.Println()
+    files := make(map[string]model.FileDownload)
+    for metahash, file := range fs.AvailableFiles {
+        files[metahash] = *file
+    }
+    return files
 }
 
 func (fs *FileSharing) writeBytesToFile(hash string, buffer []byte) error {
-    err := ioutil.WriteFile(CHUNKS_DIR + hash, buffer, 0644)
+    err := fs.chunks.write(hash, buffer)
     if (err != nil) {
-        fmt.Println("ERROR: While writing metafile or chunk (hash=" + hash + ") to file")
-        fmt.Println(err)
+        filesLog.Error("While writing metafile or chunk (hash=" + hash + ") to file")
+        filesLog.Error(err.Error())
     }
     return err
 }
 
 func (fs *FileSharing) readChunkFile(hash string) []byte {
-    data, err := ioutil.ReadFile(CHUNKS_DIR + hash)
-    if (err != nil) {
-        //fmt.Println("ERROR: While reading metafile or chunk (hash=" + hash + ") from file")
-        //fmt.Println(err)
-        return nil
-    }
-    return data
-}
-
-func (fs *FileSharing) getChunkHashFromMetafile(metahash string, offset int) []byte {
-    metafile := fs.readChunkFile(metahash)
-    if (metafile == nil) {
-        return nil
-    }
-
-    byteOffset := offset * 32
-    if byteOffset >= len(metafile) {
-        return nil
-    }
-
-    endByteOffset := byteOffset + 32
-    if endByteOffset > len(metafile) {
-        endByteOffset = len(metafile)
-    }
-
-    return metafile[byteOffset:endByteOffset]
-}
-
-func (fs *FileSharing) requestData(dest string, hashValue []byte) {
-    // Prepare and send DataRequest packet
-    dr := model.DataRequest{
-        Origin: fs.gossiper.Name,
-        Destination: dest,
-        HopLimit: 10,
-        HashValue: hashValue,
-    }
-
-    //fmt.Println("REQUESTING DATA " + hex.EncodeToString(hashValue))
-
-    fs.sendDataRequest(&dr)
-}
-
-func (fs *FileSharing) getChannelForHash(datahash string) chan bool {
-    fs.waitDataRequestChannelsMutex.Lock()
-    defer fs.waitDataRequestChannelsMutex.Unlock()
-    _, channelExists := fs.waitDataRequestChannels[datahash]
-    if !channelExists {
-        fs.waitDataRequestChannels[datahash] = make(chan bool)
-    }
-    return fs.waitDataRequestChannels[datahash]
-}
-
-func (fs *FileSharing) removeChannelForHash(datahash string) {
-    fs.waitDataRequestChannelsMutex.Lock()
-    defer fs.waitDataRequestChannelsMutex.Unlock()
-    _, channelExists := fs.waitDataRequestChannels[datahash]
-    if channelExists {
-        fs.waitDataRequestChannels[datahash] = nil
-        delete(fs.waitDataRequestChannels, datahash)
-    }
-}
-
-func (fs *FileSharing) notifyChannelForHash(datahash string) {
-    fs.waitDataRequestChannelsMutex.Lock()
-    defer fs.waitDataRequestChannelsMutex.Unlock()
-    _, channelExists := fs.waitDataRequestChannels[datahash]
-    if channelExists {
-        fs.waitDataRequestChannels[datahash] <- true
-    }
-}
-
-func (fs *FileSharing) waitDataReply(dr *model.DataRequest) {
-    ticker := time.NewTicker(TIMEOUT_DATA_REQUEST * time.Second)
-    defer ticker.Stop()
-
-    datahash := hex.EncodeToString(dr.HashValue)
-    channel := fs.getChannelForHash(datahash)
-
-    select {
-    case <-channel:
-        ticker.Stop()
-        fs.removeChannelForHash(datahash)
-        // If we get here it's because the DataReply was received
-
-    case <-ticker.C:
-        ticker.Stop()
-        fs.removeChannelForHash(datahash)
-
-        fmt.Println("DataRequest timed out, resending request")
-
-        // If we get ther, it means that the DataReply was not received
-        fs.sendDataRequest(dr)
-    }
+    return fs.chunks.read(hash)
 }
 
 func (fs *FileSharing) sendDataRequest(dr *model.DataRequest) {
@@ -446,10 +355,6 @@ func (fs *FileSharing) sendDataRequest(dr *model.DataRequest) {
 
     gp := model.GossipPacket{DataRequest: dr}
     go fs.gossiper.sendGossipPacket(&gp, []string{destPeer})
-
-    if dr.Origin == fs.gossiper.Name {
-        go fs.waitDataReply(dr)
-    }
 }
 
 func (fs *FileSharing) sendDataReply(dr *model.DataReply) {
@@ -0,0 +1,87 @@
+package gossip
+
+import (
+    "os"
+    "time"
+    "strings"
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+const SOURCE_CHECK_INTERVAL time.Duration = 10 // Seconds between two checks of the sources of the indexed files
+
+// States of the source of an indexed file
+const (
+    SOURCE_OK = "ok"
+    // Modified since it was indexed, the new content is indexed under a new metahash
+    SOURCE_CHANGED = "changed"
+    SOURCE_MISSING = "missing"
+)
+
+func (fs *FileSharing) watchSources() {
+    ticker := time.NewTicker(SOURCE_CHECK_INTERVAL * time.Second)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        fs.checkSources()
+    }
+}
+
+// Compare the source of every indexed file with its state when it was indexed
+func (fs *FileSharing) checkSources() {
+    for metahash, file := range fs.GetFiles() {
+        // Downloads have no source, and changed sources were indexed again
+        if file.SourceState == "" || file.SourceState == SOURCE_CHANGED {
+            continue
+        }
+
+        state := SOURCE_OK
+        fi, err := os.Stat(file.Path)
+        if err != nil {
+            state = SOURCE_MISSING
+        } else if fi.Size() != file.Size || !fi.ModTime().Equal(file.SourceModTime) {
+            state = SOURCE_CHANGED
+        }
+
+        if state == file.SourceState {
+            continue
+        }
+
+        fs.setSourceState(metahash, state)
+        newMetahash := ""
+        if state == SOURCE_CHANGED {
+            // Index the new content, the old version stays listed as changed
+            var err error
+            newMetahash, err = fs.indexFileAt(file.Path, file.LocalName)
+            if err != nil {
+                filesLog.Warning("Could not index the new version of " + file.Path + ": " + err.Error())
+            }
+        }
+
+        filesLog.Event(logger.INFO, "SOURCE-" + strings.ToUpper(state), "SOURCE " + strings.ToUpper(state) + " " + file.Path, logger.Fields{
+            "filename": file.LocalName,
+            "path": file.Path,
+            "metahash": metahash,
+            "newMetahash": newMetahash,
+        })
+
+        fs.gossiper.Events.Publish(&Event{
+            Type: EVENT_FILE_SOURCE_CHANGED,
+            Source: &FileSourceChange{
+                Filename: file.LocalName,
+                MetaHash: metahash,
+                Path: file.Path,
+                State: state,
+                NewMetaHash: newMetahash,
+            },
+        })
+    }
+}
+
+func (fs *FileSharing) setSourceState(metahash, state string) {
+    fs.availableFilesMutex.Lock()
+    defer fs.availableFilesMutex.Unlock()
+
+    if file, isPresent := fs.AvailableFiles[metahash]; isPresent {
+        file.SourceState = state
+    }
+}
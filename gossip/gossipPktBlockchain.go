@@ -1,13 +1,13 @@
 package gossip
 
 import (
-    "fmt"
     "time"
+    "strconv"
     "bytes"
     "math/rand"
     "encoding/hex"
     "github.com/pablo11/Peerster/model"
-    "github.com/pablo11/Peerster/util/debug"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktTxPublish(gp *model.GossipPacket) {
@@ -18,7 +18,7 @@ func (g *Gossiper) HandlePktTxPublish(gp *model.GossipPacket) {
     for _, pendingTx := range g.txsForNextBlock {
         if bytes.Equal(pendingTx.File.MetafileHash, tp.File.MetafileHash) && pendingTx.File.Name == tp.File.Name && pendingTx.File.Size == tp.File.Size {
             g.txsForNextBlockMutex.Unlock()
-            fmt.Println("Discarding TxPublish since already received")
+            chainLog.Info("Discarding TxPublish since already received")
             return
         }
     }
@@ -29,7 +29,7 @@ func (g *Gossiper) HandlePktTxPublish(gp *model.GossipPacket) {
     _, filenameAlreadyCaimed := g.filesName[tp.File.Name]
     if filenameAlreadyCaimed {
         g.filesNameMutex.Unlock()
-        fmt.Println("Discarding TxPublish since name already claimed")
+        chainLog.Info("Discarding TxPublish since name already claimed")
         return
     }
     g.filesNameMutex.Unlock()
@@ -41,12 +41,13 @@ func (g *Gossiper) HandlePktTxPublish(gp *model.GossipPacket) {
     g.broadcastTxPublishDecrementingHopLimit(tp)
 }
 
-func (g *Gossiper) HandlePktBlockPublish(gp *model.GossipPacket) {
+func (g *Gossiper) HandlePktBlockPublish(gp *model.GossipPacket, fromAddrStr string) {
     bp := gp.BlockPublish
 
     // Validate PoW
     if !bp.Block.IsValid() {
-        fmt.Println("Discarding BlockPublish since the PoW is invalid")
+        chainLog.Info("Discarding BlockPublish since the PoW is invalid")
+        g.Reputation.Penalize(fromAddrStr, REPUTATION_INVALID_BLOCK)
         return
     }
 
@@ -89,10 +90,23 @@ func (g *Gossiper) HandlePktBlockPublish(gp *model.GossipPacket) {
                 // Check if this fork becomes the longest chain
                 if blockchainLength + 1 > g.forks[g.longestChain] {
                     // We are switching to a new longest chain
-                    fmt.Printf("FORK-LONGER rewind %d blocks\n", g.computeNbBlocksRewind(blockHashStr, g.longestChain))
+                    rewind := g.computeNbBlocksRewind(blockHashStr, g.longestChain)
+                    chainLog.Event(logger.INFO, "FORK-LONGER", "FORK-LONGER rewind " + strconv.Itoa(rewind) + " blocks", logger.Fields{
+                        "rewind": rewind,
+                    })
+                    g.Metrics.countForkSwitch()
+
+                    g.Events.Publish(&Event{
+                        Type: EVENT_FORK_SWITCHED,
+                        Fork: &ForkSwitch{
+                            OldHead: g.longestChain,
+                            NewHead: blockHashStr,
+                            Rewind: rewind,
+                        },
+                    })
                     g.updateLongestChain(blockHashStr, nil)
                 } else {
-                    fmt.Println("BLOCK ADDED TO A SHORTER FORK")
+                    chainLog.Info("BLOCK ADDED TO A SHORTER FORK")
                 }
             }
             break
@@ -112,17 +126,31 @@ func (g *Gossiper) HandlePktBlockPublish(gp *model.GossipPacket) {
             // It's the first genesis block
             g.updateLongestChain(blockHashStr, &bp.Block)
         } else {
-            fmt.Println("FORK-SHORTER " + hex.EncodeToString(bp.Block.PrevHash[:]))
+            chainLog.Event(logger.INFO, "FORK-SHORTER", "FORK-SHORTER " + hex.EncodeToString(bp.Block.PrevHash[:]), logger.Fields{
+                "prevHash": hex.EncodeToString(bp.Block.PrevHash[:]),
+            })
         }
     }
 
     // Integrate transactions in the filesName mapping
+    filenames := make([]string, len(bp.Block.Transactions))
     g.filesNameMutex.Lock()
-    for _, trx := range bp.Block.Transactions {
+    for i, trx := range bp.Block.Transactions {
         g.filesName[trx.File.Name] = &trx.File
+        filenames[i] = trx.File.Name
     }
     g.filesNameMutex.Unlock()
 
+    g.Events.Publish(&Event{
+        Type: EVENT_BLOCK_ACCEPTED,
+        Block: &BlockAccepted{
+            Hash: blockHashStr,
+            PrevHash: bp.Block.PrevHashStr(),
+            Filenames: filenames,
+            OnLongestChain: g.longestChain == blockHashStr,
+        },
+    })
+
     // If HopLimit is > 1 decrement and broadcast
     g.broadcastBlockPublishDecrementingHopLimit(bp)
 }
@@ -224,6 +252,7 @@ func (g *Gossiper) computeNbBlocksRewind(newHeadHash, oldHeadHash string) int {
 func (g *Gossiper) printBlockchain(headHash string) {
     currentHash := headHash
     chainStr := ""
+    chainHashes := make([]string, 0)
 
     g.blocksMutex.RLock()
     for {
@@ -233,11 +262,14 @@ func (g *Gossiper) printBlockchain(headHash string) {
         }
 
         chainStr += " " + block.String()
+        chainHashes = append(chainHashes, currentHash)
         currentHash = block.PrevHashStr()
     }
     g.blocksMutex.RUnlock()
 
-    fmt.Println("CHAIN" + chainStr)
+    chainLog.Event(logger.INFO, "CHAIN", "CHAIN" + chainStr, logger.Fields{
+        "blocks": chainHashes,
+    })
 }
 
 func (g *Gossiper) broadcastTxPublish(tp *model.TxPublish) {
@@ -324,7 +356,7 @@ func (g *Gossiper) startMining() {
                     HopLimit: 20,
                 }
 
-                g.HandlePktBlockPublish(&model.GossipPacket{BlockPublish: bp})
+                g.HandlePktBlockPublish(&model.GossipPacket{BlockPublish: bp}, "")
             }
         } else {
             // Wait a bit before checking again
@@ -362,6 +394,7 @@ func (g *Gossiper) createBlockAndMine() *model.Block {
 
         // Create the block with a random nonce
         rand.Read(nonce[:])
+        g.Metrics.countMiningAttempt()
         block := model.Block{
             PrevHash: prevHash,
             Nonce: nonce,
@@ -369,7 +402,9 @@ func (g *Gossiper) createBlockAndMine() *model.Block {
         }
 
         if block.IsValid() {
-            fmt.Println("FOUND-BLOCK " + block.HashStr())
+            chainLog.Event(logger.INFO, "FOUND-BLOCK", "FOUND-BLOCK " + block.HashStr(), logger.Fields{
+                "hash": block.HashStr(),
+            })
 
             // Remove transactions mined from the txsForNextBlock (assume that there are no new TxPhublish added in the middle of the list)
             g.txsForNextBlockMutex.Lock()
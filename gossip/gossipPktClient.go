@@ -1,37 +1,335 @@
 package gossip
 
 import (
-    "fmt"
+    "sort"
+    "strings"
+    "encoding/hex"
+    "encoding/json"
     "github.com/pablo11/Peerster/model"
 )
 
-func (g *Gossiper) HandlePktClient(cm *model.ClientMessage) {
+const CLIENT_QUERY_DEFAULT_LIMIT int = 20 // Messages and blocks returned to the client by default
+
+// Execute the request of the client and return the response to send back
+func (g *Gossiper) HandlePktClient(cm *model.ClientMessage) *model.ClientResponse {
     switch cm.Type {
         case "msg":
-            fmt.Println(cm.String())
-            fmt.Println()
+            gossipLog.Info(cm.String())
+
+            if cm.Text == "" {
+                return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, "the message is empty")
+            }
 
             if cm.Dest == "" {
-                go g.SendPublicMessage(cm.Text, true)
+                id := g.SendPublicMessage(cm.Text, true)
+                return clientResult(cm, model.CLIENT_STATUS_ACCEPTED, map[string]interface{}{
+                    "id": id,
+                })
             } else {
                 pm := model.NewPrivateMessage(g.Name, cm.Text, cm.Dest)
-                go g.SendPrivateMessage(pm)
+                id := g.SendPrivateMessage(pm)
+                return clientResult(cm, model.CLIENT_STATUS_ACCEPTED, map[string]interface{}{
+                    "id": id,
+                    "destination": cm.Dest,
+                    "state": DELIVERY_PENDING,
+                })
             }
 
+        case "messageStatus":
+            delivery, isPresent := g.Outbox.Get(cm.MessageID)
+            if !isPresent {
+                return clientError(cm, model.CLIENT_STATUS_NOT_FOUND, "no private message with this id was sent")
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{
+                "id": delivery.ID,
+                "destination": delivery.Destination,
+                "state": delivery.State,
+                "attempts": delivery.Attempts,
+            })
+
         case "indexFile":
-            go g.FileSharing.IndexFile(cm.File)
+            // Large files take longer to hash than the client waits, it
+            // follows the indexing with indexStatus
+            return clientIndexJob(cm, model.CLIENT_STATUS_ACCEPTED, g.FileSharing.StartIndexing(cm.File))
+
+        case "indexStatus":
+            job, isPresent := g.FileSharing.IndexingState(cm.File)
+            if !isPresent {
+                return clientError(cm, model.CLIENT_STATUS_NOT_FOUND, "no indexing of this file was started")
+            }
+            return clientIndexJob(cm, model.CLIENT_STATUS_OK, job)
 
         case "downloadFile":
-            go g.FileSharing.RequestFile(cm.File, cm.Dest, cm.Request)
+            err := g.FileSharing.RequestFile(cm.File, cm.Dest, cm.Request, int(cm.Priority))
+            if err != nil {
+                return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, err.Error())
+            }
+            return clientResult(cm, model.CLIENT_STATUS_ACCEPTED, map[string]interface{}{
+                "filename": cm.File,
+                "metahash": cm.Request,
+            })
+
+        case "resumeDownload", "pauseDownload", "cancelDownload", "downloadPriority":
+            var err error
+            switch cm.Type {
+                case "resumeDownload":
+                    err = g.FileSharing.ResumeDownload(cm.Request)
+                case "pauseDownload":
+                    err = g.FileSharing.PauseDownload(cm.Request)
+                case "cancelDownload":
+                    err = g.FileSharing.CancelDownload(cm.Request)
+                case "downloadPriority":
+                    err = g.FileSharing.SetDownloadPriority(cm.Request, int(cm.Priority))
+            }
+            if err != nil {
+                return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, err.Error())
+            }
+            return clientResult(cm, model.CLIENT_STATUS_ACCEPTED, map[string]interface{}{
+                "metahash": cm.Request,
+            })
 
         case "searchFile":
+            if len(cm.Keywords) == 0 {
+                return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, "keywords are required")
+            }
+
             if cm.Budget == 0 {
                 go g.StartSearchRequest(2, cm.Keywords, true)
             } else {
                 go g.StartSearchRequest(cm.Budget, cm.Keywords, false)
             }
+            return clientResult(cm, model.CLIENT_STATUS_ACCEPTED, map[string]interface{}{
+                "keywords": cm.Keywords,
+            })
+
+        case "peers", "routes", "messages", "files", "downloads", "searchResults", "chain", "names", "id":
+            return g.handleClientQuery(cm)
 
         default:
-            fmt.Println("WARNING: Unoknown client message type")
+            gossipLog.Warning("Unoknown client message type")
+            return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, "unknown request type " + cm.Type)
+    }
+}
+
+// Answer the read-only requests of the client
+func (g *Gossiper) handleClientQuery(cm *model.ClientMessage) *model.ClientResponse {
+    switch cm.Type {
+        case "peers":
+            peers := make([]map[string]interface{}, 0)
+            for _, p := range g.GetPeerStates() {
+                peers = append(peers, map[string]interface{}{
+                    "address": p.Address,
+                    "score": p.Score,
+                    "banned": p.Banned,
+                })
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{"peers": peers})
+
+        case "routes":
+            routes := make([]map[string]interface{}, 0)
+            for origin, nextHop := range g.GetRoutes() {
+                routes = append(routes, map[string]interface{}{
+                    "origin": origin,
+                    "nextHop": nextHop,
+                })
+            }
+            sort.Slice(routes, func(i, j int) bool {
+                return routes[i]["origin"].(string) < routes[j]["origin"].(string)
+            })
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{"routes": routes})
+
+        case "messages":
+            // The most recent messages or the ones following SinceSeq, oldest first
+            history, _ := g.History.Query(HistoryQuery{
+                SinceSeq: cm.SinceSeq,
+                Descending: cm.SinceSeq == 0,
+                Limit: clientLimit(cm),
+            })
+            messages := make([]map[string]interface{}, len(history))
+            for i, m := range history {
+                position := i
+                if cm.SinceSeq == 0 {
+                    position = len(history) - 1 - i
+                }
+                messages[position] = map[string]interface{}{
+                    "seq": m.Seq,
+                    "type": m.Type,
+                    "origin": m.Origin,
+                    "destination": m.Destination,
+                    "id": m.ID,
+                    "text": m.Text,
+                    "timestamp": m.Timestamp,
+                }
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{"messages": messages})
+
+        case "files":
+            files := make([]map[string]interface{}, 0)
+            for metahash, f := range g.FileSharing.GetFiles() {
+                state := "downloading"
+                if strings.HasPrefix(f.Path, DOWNLOADS_DIR) {
+                    state = "downloaded"
+                } else if f.Path != "" {
+                    state = "shared"
+                }
+                files = append(files, map[string]interface{}{
+                    "name": f.LocalName,
+                    "metahash": metahash,
+                    "size": f.Size,
+                    "state": state,
+                    "path": f.Path,
+                    "sourceState": f.SourceState,
+                    "chunks": f.NbChunksDone,
+                    "nbChunks": f.NbChunks,
+                })
+            }
+            sort.Slice(files, func(i, j int) bool {
+                return files[i]["name"].(string) < files[j]["name"].(string)
+            })
+            start, end := clientPage(cm, len(files))
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{
+                "files": files[start:end],
+                "total": len(files),
+            })
+
+        case "downloads":
+            downloads := make([]map[string]interface{}, 0)
+            for _, d := range g.FileSharing.GetDownloads() {
+                sources := make([]map[string]interface{}, len(d.Sources))
+                for i, s := range d.Sources {
+                    sources[i] = map[string]interface{}{
+                        "name": s.Name,
+                        "hasAll": s.HasAll,
+                        "nbChunks": s.NbChunks,
+                        "downloaded": s.Downloaded,
+                        "pending": s.Pending,
+                        "failures": s.Failures,
+                        "abandoned": s.Abandoned,
+                    }
+                }
+                downloads = append(downloads, map[string]interface{}{
+                    "name": d.LocalName,
+                    "metahash": d.MetaHash,
+                    "state": d.State,
+                    "priority": d.Priority,
+                    "chunks": d.NbChunksDone,
+                    "nbChunks": d.NbChunks,
+                    "bytes": d.BytesDone,
+                    "bytesPerSecond": d.BytesPerSecond,
+                    "sources": sources,
+                })
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{"downloads": downloads})
+
+        case "searchResults":
+            results := make([]map[string]interface{}, 0)
+            for _, m := range g.GetFullMatches() {
+                results = append(results, map[string]interface{}{
+                    "filename": m.Filename,
+                    "metahash": m.MetaHash,
+                    "nbChunks": m.NbChunks,
+                    "sources": m.SourceNames(),
+                })
+            }
+            sort.Slice(results, func(i, j int) bool {
+                return results[i]["filename"].(string) < results[j]["filename"].(string)
+            })
+            start, end := clientPage(cm, len(results))
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{
+                "results": results[start:end],
+                "total": len(results),
+            })
+
+        case "chain":
+            blocks, length := g.GetChain(clientLimit(cm))
+            chain := make([]map[string]interface{}, len(blocks))
+            for i, b := range blocks {
+                chain[i] = map[string]interface{}{
+                    "hash": b.Hash,
+                    "prevHash": b.PrevHash,
+                    "filenames": b.Filenames,
+                }
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{
+                "length": length,
+                "blocks": chain,
+            })
+
+        case "names":
+            names := make([]map[string]interface{}, 0)
+            for _, f := range g.GetNames() {
+                names = append(names, map[string]interface{}{
+                    "name": f.Name,
+                    "size": f.Size,
+                    "metahash": hex.EncodeToString(f.MetafileHash),
+                })
+            }
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{"names": names})
+
+        case "id":
+            return clientResult(cm, model.CLIENT_STATUS_OK, map[string]interface{}{
+                "name": g.Name,
+                "address": g.GetAddress(),
+                "peers": len(g.GetPeers()),
+                "origins": len(g.GetOrigins()),
+                "simple": g.simple,
+            })
+
+        default:
+            return clientError(cm, model.CLIENT_STATUS_BAD_REQUEST, "unknown query " + cm.Type)
+    }
+}
+
+// Number of elements to return for a query of the client
+func clientLimit(cm *model.ClientMessage) int {
+    if cm.Limit == 0 {
+        return CLIENT_QUERY_DEFAULT_LIMIT
+    }
+    return int(cm.Limit)
+}
+
+func clientIndexJob(cm *model.ClientMessage, status uint32, job IndexJob) *model.ClientResponse {
+    return clientResult(cm, status, map[string]interface{}{
+        "filename": job.Filename,
+        "state": job.State,
+        "metahash": job.MetaHash,
+        "error": job.Error,
+    })
+}
+
+// Bounds of the elements of a list of n elements to return, from Offset and
+// at most Limit of them
+func clientPage(cm *model.ClientMessage, n int) (int, int) {
+    start := int(cm.Offset)
+    if start > n {
+        start = n
+    }
+    end := start + clientLimit(cm)
+    if end > n {
+        end = n
+    }
+    return start, end
+}
+
+func clientResult(cm *model.ClientMessage, status uint32, payload interface{}) *model.ClientResponse {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return clientError(cm, model.CLIENT_STATUS_ERROR, "could not encode the response")
+    }
+
+    return &model.ClientResponse{
+        RequestID: cm.RequestID,
+        Status: status,
+        Error: "",
+        Payload: data,
+    }
+}
+
+func clientError(cm *model.ClientMessage, status uint32, errorMsg string) *model.ClientResponse {
+    return &model.ClientResponse{
+        RequestID: cm.RequestID,
+        Status: status,
+        Error: errorMsg,
+        Payload: nil,
     }
 }
@@ -1,21 +1,57 @@
 package gossip
 
 import (
-    "fmt"
     "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktPrivate(gp *model.GossipPacket, fromAddrStr string) {
     if gp.Private.Destination == g.Name {
+        pm := gp.Private
+
+        // Acknowledge every copy, the previous acknowledgement may have been lost.
+        // Messages with ID 0 come from nodes not waiting for acknowledgements
+        if pm.ID != 0 {
+            g.routePacket(&model.GossipPacket{PrivateAck: model.NewPrivateAck(pm)}, pm.Origin)
+
+            if !g.Outbox.markReceived(pm) {
+                gossipLog.Debug("Ignoring retransmitted private message from " + pm.Origin)
+                return
+            }
+        }
+
         // If the private message is for this node, display it
-        g.printGossipPacket("", fromAddrStr, gp)
+        g.printGossipPacket(logger.INFO, "", fromAddrStr, gp)
+
+        g.History.Add(MESSAGE_TYPE_PRIVATE, pm.Origin, pm.Destination, pm.ID, pm.Text)
+        g.Conversations.Add(pm, "")
+
+        g.Events.Publish(&Event{
+            Type: EVENT_PRIVATE_MESSAGE_RECEIVED,
+            Private: pm,
+        })
     } else {
         // Forward the message and decrease the HopLimit
         pm := gp.Private
-        fmt.Println("Forwarding private msg dest " + pm.Destination)
+        routingLog.Info("Forwarding private msg dest " + pm.Destination)
         if pm.HopLimit > 1 {
             pm.HopLimit -= 1
-            g.SendPrivateMessage(pm)
+            g.routePacket(gp, pm.Destination)
+        }
+    }
+}
+
+func (g *Gossiper) HandlePktPrivateAck(gp *model.GossipPacket) {
+    pa := gp.PrivateAck
+    if pa.Destination == g.Name {
+        if !g.Outbox.acknowledge(pa.Origin, pa.ID) {
+            gossipLog.Debug("Ignoring acknowledgement of unknown private message from " + pa.Origin)
+        }
+    } else {
+        // Forward the acknowledgement and decrease the HopLimit
+        if pa.HopLimit > 1 {
+            pa.HopLimit -= 1
+            g.routePacket(gp, pa.Destination)
         }
     }
 }
@@ -2,12 +2,20 @@ package gossip
 
 import (
     "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktRumor(gp *model.GossipPacket, fromAddrStr string) {
+    // A rumor claiming to come from this node with an ID never issued is forged
+    if gp.Rumor.Origin == g.Name && gp.Rumor.ID >= g.nextMessageId {
+        gossipLog.Warning("Discarding forged rumor from " + fromAddrStr)
+        g.Reputation.Penalize(fromAddrStr, REPUTATION_FORGED_RUMOR)
+        return
+    }
+
     isRouteRumor := gp.Rumor.Text == ""
     if !isRouteRumor {
-        g.printGossipPacket("received", fromAddrStr, gp)
+        g.printGossipPacket(logger.INFO, "received", fromAddrStr, gp)
     }
 
     g.updateRoutingTable(gp.Rumor, fromAddrStr)
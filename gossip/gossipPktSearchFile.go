@@ -1,14 +1,13 @@
 package gossip
 
 import (
-    "fmt"
     "time"
     "strings"
     "strconv"
-    "math/rand"
     "encoding/hex"
     "github.com/pablo11/Peerster/model"
     "github.com/pablo11/Peerster/util/collections"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktSearchRequest(gp *model.GossipPacket) {
@@ -34,28 +33,37 @@ func (g *Gossiper) HandlePktSearchRequest(gp *model.GossipPacket) {
 }
 
 func (g *Gossiper) searchFileLocally(keywords []string, origin string) {
-    fmt.Println("Searching files locally")
+    searchLog.Info("Searching files locally")
 
-    searchResults := make([]*model.SearchResult, 0)
+    // The matches are copied first, chunkMap locks the downloads which must
+    // not be locked after the files
+    matches := make([]model.FileDownload, 0)
+    g.FileSharing.availableFilesMutex.Lock()
     for _, file := range g.FileSharing.AvailableFiles {
-        filename := file.LocalName
         for i := 0; i < len(keywords); i++ {
-            if strings.Contains(filename, keywords[i]) {
-                // Following my implementation, if I have chunk nb n, I also have all chunks nb smaller than n
-                chunkMap := make([]uint64, 0)
-                for k := 0; k < file.NextChunkOffset; k++ {
-                    chunkMap = append(chunkMap, uint64(k + 1))
-                }
-
-                searchResults = append(searchResults, &model.SearchResult{
-                    FileName: filename,
-                    MetafileHash: file.MetaHash,
-                    ChunkMap: chunkMap,
-                    ChunkCount: uint64(file.NbChunks),
+            if strings.Contains(file.LocalName, keywords[i]) {
+                matches = append(matches, model.FileDownload{
+                    LocalName: file.LocalName,
+                    MetaHash: file.MetaHash,
+                    NbChunks: file.NbChunks,
                 })
             }
         }
     }
+    g.FileSharing.availableFilesMutex.Unlock()
+
+    searchResults := make([]*model.SearchResult, 0)
+    for _, file := range matches {
+        chunkMap, chunkRanges := g.FileSharing.chunkMap(hex.EncodeToString(file.MetaHash), file.NbChunks)
+
+        searchResults = append(searchResults, &model.SearchResult{
+            FileName: file.LocalName,
+            MetafileHash: file.MetaHash,
+            ChunkMap: chunkMap,
+            ChunkCount: uint64(file.NbChunks),
+            ChunkRanges: chunkRanges,
+        })
+    }
 
     // Send a SearchReply if at least one file matches the SearchRequest
     if len(searchResults) > 0 {
@@ -63,6 +71,38 @@ func (g *Gossiper) searchFileLocally(keywords []string, origin string) {
     }
 }
 
+// Numbers of the chunks held of a file, listed one by one for small files and
+// as pairs of first and last chunk number for the others
+func (fs *FileSharing) chunkMap(metahash string, nbChunks int) ([]uint64, []uint64) {
+    held := fs.heldChunks(metahash)
+    isHeld := func(i int) bool {
+        return held == nil || (i < len(held) && held[i])
+    }
+
+    chunkMap := make([]uint64, 0)
+    chunkRanges := make([]uint64, 0)
+    if nbChunks <= SEARCH_CHUNK_MAP_MAX_LEN {
+        for i := 0; i < nbChunks; i++ {
+            if isHeld(i) {
+                chunkMap = append(chunkMap, uint64(i + 1))
+            }
+        }
+        return chunkMap, chunkRanges
+    }
+
+    for i := 0; i < nbChunks; i++ {
+        if !isHeld(i) {
+            continue
+        }
+        if len(chunkRanges) > 0 && chunkRanges[len(chunkRanges) - 1] == uint64(i) {
+            chunkRanges[len(chunkRanges) - 1] = uint64(i + 1)
+        } else {
+            chunkRanges = append(chunkRanges, uint64(i + 1), uint64(i + 1))
+        }
+    }
+    return chunkMap, chunkRanges
+}
+
 func (g *Gossiper) budgetPropagation(budget uint64, origin string, keywords []string) {
     // Propagate the SearchRequest subdividing the budget
     peersBudget := g.subdivideBudget(budget)
@@ -110,7 +150,7 @@ func (g *Gossiper) sendSearchReplyFor(dest string, results []*model.SearchResult
 
     if dest == g.Name {
         // Handle search request from client
-        g.HandlePktSearchReply(&model.GossipPacket{SearchReply: &sr})
+        g.HandlePktSearchReply(&model.GossipPacket{SearchReply: &sr}, "")
     } else {
         g.sendSearchReply(&sr)
     }
@@ -163,14 +203,14 @@ func (g *Gossiper) subdivideBudget(budget uint64) map[string]uint64 {
 
 func (g *Gossiper) getNRandomPeers(n uint64) []string {
     if len(g.peers) < int(n) {
-        fmt.Println("ERROR: not enough peers to select " + string(n) + " at random")
+        searchLog.Error("not enough peers to select " + strconv.FormatUint(n, 10) + " at random")
         return make([]string, 0)
     }
     tmpPeers := g.peers
     randomPeers := make([]string, 0)
 
     for i := 0; i < int(n); i++ {
-        randomPeer := tmpPeers[rand.Intn(len(tmpPeers))]
+        randomPeer := g.Reputation.WeightedPick(tmpPeers)
         randomPeers = append(randomPeers, randomPeer)
 
         tmpPeers = collections.Filter(tmpPeers, func(p string) bool{
@@ -183,7 +223,10 @@ func (g *Gossiper) getNRandomPeers(n uint64) []string {
 
 func (g *Gossiper) StartSearchRequest(budget uint64, keywords []string, startExpandingRing bool) {
     searchRequestUid := strings.Join(keywords, ",")
-    fmt.Printf("SEARCH STARTED for keywords=" + searchRequestUid + " with budget=%d\n", budget)
+    searchLog.Event(logger.INFO, "SEARCH STARTED", "SEARCH STARTED for keywords=" + searchRequestUid + " with budget=" + strconv.FormatUint(budget, 10), logger.Fields{
+        "keywords": keywords,
+        "budget": budget,
+    })
 
     // Discard SearchRequest if it's a duplicate
     if g.checkDuplicateSearchRequests(g.Name, keywords) {
@@ -195,14 +238,15 @@ func (g *Gossiper) StartSearchRequest(budget uint64, keywords []string, startExp
     searchRequest, isSearching := g.activeSearchRequests[searchRequestUid]
 
     if isSearching && searchRequest.LastBudget >= budget {
-        fmt.Println("WARNING: A SearchRequest is already beeing searched")
+        g.activeSearchRequestsMutex.Unlock()
+        searchLog.Warning("A SearchRequest is already beeing searched")
         return
     }
 
     g.activeSearchRequests[searchRequestUid] = &model.ActiveSearch{
         Keywords: keywords,
         LastBudget: budget,
-        NotifyChannel: make(chan bool),
+        NotifyChannel: make(chan bool, 1),
         Matches: make(map[string]*model.FileMatch),
     }
 
@@ -224,7 +268,7 @@ func (g *Gossiper) StartSearchRequest(budget uint64, keywords []string, startExp
     select {
     case <-g.activeSearchRequests[searchRequestUid].NotifyChannel:
         // Match threshold reached, print
-        fmt.Println("2 MATHCHES for keywords=" + searchRequestUid)
+        searchLog.Info("2 MATHCHES for keywords=" + searchRequestUid)
         if startExpandingRing {
             ticker.Stop()
         }
@@ -243,7 +287,7 @@ func (g *Gossiper) StartSearchRequest(budget uint64, keywords []string, startExp
         }
 
         if budget >= MAX_SEARCH_BUDGET {
-            fmt.Println("MAX BUDGET REACHED")
+            searchLog.Info("MAX BUDGET REACHED")
             return
         }
 
@@ -251,11 +295,12 @@ func (g *Gossiper) StartSearchRequest(budget uint64, keywords []string, startExp
     }
 }
 
-func (g *Gossiper) HandlePktSearchReply(gp *model.GossipPacket) {
+func (g *Gossiper) HandlePktSearchReply(gp *model.GossipPacket, fromAddrStr string) {
     sr := gp.SearchReply
+
     // Forward pkts not for me
     if sr.Destination != g.Name {
-        fmt.Println("Forwarding DataRequest packet to " + sr.Destination)
+        routingLog.Info("Forwarding DataRequest packet to " + sr.Destination)
         if sr.HopLimit > 1 {
             sr.HopLimit -= 1
             g.sendSearchReply(sr)
@@ -263,64 +308,161 @@ func (g *Gossiper) HandlePktSearchReply(gp *model.GossipPacket) {
         return
     }
 
-    // Don't care about files that I already have
+    // Only the results answering an active search or a running download are
+    // used, the chunks of the others are never looked at
+    results := make([]*model.SearchResult, 0)
     for _, result := range sr.Results {
+        if g.isWantedResult(result) {
+            results = append(results, result)
+        }
+    }
+
+    // Reward the origin for answering a search, and the peer relaying the
+    // reply. Replies nobody asked for are not rewarded
+    if len(results) > 0 {
+        g.Reputation.Reward(fromAddrStr, REPUTATION_SEARCH_REPLY_RELAY)
+        if sr.Origin != g.Name {
+            g.Reputation.RewardOrigin(sr.Origin, REPUTATION_SEARCH_REPLY)
+        }
+    }
+
+    for _, result := range results {
+        if result.ChunkCount > MAX_NB_CHUNKS {
+            searchLog.Warning("Ignored search result " + result.FileName + " from " + sr.Origin + " with too many chunks")
+            continue
+        }
+
+        chunkRanges := result.Ranges()
         chunkMapStr := make([]string, len(result.ChunkMap))
         for i := 0; i < len(result.ChunkMap); i++ {
             chunkMapStr[i] = strconv.Itoa(int(result.ChunkMap[i]))
         }
+        for i := 0; i + 1 < len(result.ChunkRanges); i += 2 {
+            chunkMapStr = append(chunkMapStr, strconv.FormatUint(result.ChunkRanges[i], 10) + "-" + strconv.FormatUint(result.ChunkRanges[i + 1], 10))
+        }
 
         hexMetahash := hex.EncodeToString(result.MetafileHash)
-        fmt.Println("FOUND match " + result.FileName + " at " + sr.Origin + " metafile=" + hexMetahash + " chunks=" + strings.Join(chunkMapStr, ","))
-
-        // Find search request corresponding to result
-        for searchRequesUid, _ := range g.activeSearchRequests {
-            keywords := strings.Split(searchRequesUid, ",")
-            for _, k := range keywords {
-                if strings.Contains(result.FileName, k) {
-                    g.activeSearchRequestsMutex.Lock()
-
-                    _, exists := g.activeSearchRequests[searchRequesUid].Matches[hexMetahash]
-                    if !exists {
-                        g.activeSearchRequests[searchRequesUid].Matches[hexMetahash] = &model.FileMatch{
-                            Filename: result.FileName,
-                            MetaHash: hex.EncodeToString(result.MetafileHash),
-                            NbChunks: result.ChunkCount,
-                            ChunksLocation: make([]string, result.ChunkCount),
-                        }
-                    }
-
-                    // Store location of each chunk
-                    for _, chunkNb := range result.ChunkMap {
-                        g.activeSearchRequests[searchRequesUid].Matches[hexMetahash].ChunksLocation[int(chunkNb) - 1] = sr.Origin
-                    }
-
-                    g.activeSearchRequestsMutex.Unlock()
-
-                    // Check if it's a full match
-                    if len(g.activeSearchRequests[searchRequesUid].Matches[hexMetahash].ChunksLocation) == int(g.activeSearchRequests[searchRequesUid].Matches[hexMetahash].NbChunks) {
-                        g.storeFullMatch(hexMetahash, searchRequesUid)
-                    }
+        searchLog.Event(logger.INFO, "FOUND match", "FOUND match " + result.FileName + " at " + sr.Origin + " metafile=" + hexMetahash + " chunks=" + strings.Join(chunkMapStr, ","), logger.Fields{
+            "filename": result.FileName,
+            "origin": sr.Origin,
+            "metafile": hexMetahash,
+            "chunks": result.ChunkMap,
+            "chunkRanges": result.ChunkRanges,
+        })
+
+        g.Events.Publish(&Event{
+            Type: EVENT_SEARCH_MATCH,
+            Match: &SearchMatch{
+                Filename: result.FileName,
+                MetaHash: hexMetahash,
+                Origin: sr.Origin,
+                ChunkRanges: chunkRanges,
+                ChunkCount: result.ChunkCount,
+                IsFullMatch: false,
+            },
+        })
+
+        // A file being downloaded gets a new source
+        g.FileSharing.addSource(hexMetahash, sr.Origin, chunkRanges, result.ChunkCount)
+
+        // Add the origin to the matches of the searches the result answers
+        fullMatches := make(map[*model.ActiveSearch]*model.FileMatch)
+        g.activeSearchRequestsMutex.Lock()
+        for searchRequestUid, search := range g.activeSearchRequests {
+            if !matchesKeywords(result.FileName, searchRequestUid) {
+                continue
+            }
+
+            match, exists := search.Matches[hexMetahash]
+            if !exists {
+                match = &model.FileMatch{
+                    Filename: result.FileName,
+                    MetaHash: hexMetahash,
+                    NbChunks: result.ChunkCount,
+                    Sources: make(map[string][]uint64),
                 }
+                search.Matches[hexMetahash] = match
+            }
+
+            // Every source of a file has the same number of chunks
+            if match.NbChunks != result.ChunkCount {
+                searchLog.Warning("Ignored search result " + result.FileName + " from " + sr.Origin + " with " + strconv.FormatUint(result.ChunkCount, 10) + " chunks instead of " + strconv.FormatUint(match.NbChunks, 10))
+                continue
+            }
+            if _, isKnown := match.Sources[sr.Origin]; !isKnown && len(match.Sources) >= SEARCH_MATCH_MAX_SOURCES {
+                continue
             }
+            match.Sources[sr.Origin] = chunkRanges
+
+            // It's a full match when every chunk has a source
+            if match.IsComplete() {
+                fullMatches[search] = match
+            }
+        }
+        g.activeSearchRequestsMutex.Unlock()
+
+        for search, match := range fullMatches {
+            g.storeFullMatch(match, search)
         }
     }
 }
 
-func (g *Gossiper) storeFullMatch(hexMetahash, searchRequesUid string) {
+// True if result is a file being downloaded or matches a keyword of an active search
+func (g *Gossiper) isWantedResult(result *model.SearchResult) bool {
+    if g.FileSharing.isDownloading(hex.EncodeToString(result.MetafileHash)) {
+        return true
+    }
+
+    g.activeSearchRequestsMutex.Lock()
+    defer g.activeSearchRequestsMutex.Unlock()
+
+    for searchRequestUid, _ := range g.activeSearchRequests {
+        if matchesKeywords(result.FileName, searchRequestUid) {
+            return true
+        }
+    }
+    return false
+}
+
+// True if filename contains one of the keywords of a search request uid
+func matchesKeywords(filename string, searchRequestUid string) bool {
+    for _, k := range strings.Split(searchRequestUid, ",") {
+        if strings.Contains(filename, k) {
+            return true
+        }
+    }
+    return false
+}
+
+func (g *Gossiper) storeFullMatch(fullMatch *model.FileMatch, search *model.ActiveSearch) {
     g.FullMatchesMutex.Lock()
     isDuplicate := false
-    for _, fullMatch := range g.FullMatches {
-        if fullMatch.MetaHash == hexMetahash {
+    for _, match := range g.FullMatches {
+        if match.MetaHash == fullMatch.MetaHash {
             isDuplicate = true
         }
     }
 
     if !isDuplicate {
-        g.FullMatches = append(g.FullMatches, g.activeSearchRequests[searchRequesUid].Matches[hexMetahash])
+        g.FullMatches = append(g.FullMatches, fullMatch)
+
+        g.Events.Publish(&Event{
+            Type: EVENT_SEARCH_MATCH,
+            Match: &SearchMatch{
+                Filename: fullMatch.Filename,
+                MetaHash: fullMatch.MetaHash,
+                ChunkCount: fullMatch.NbChunks,
+                IsFullMatch: true,
+            },
+        })
+
         if len(g.FullMatches) >= SEARCH_REQUEST_MATCH_THRESHOLD {
-            fmt.Println("SEARCH FINISHED")
-            g.activeSearchRequests[searchRequesUid].NotifyChannel <- true
+            searchLog.Info("SEARCH FINISHED")
+            // Never block with FullMatchesMutex locked, the search may be over
+            select {
+                case search.NotifyChannel <- true:
+                default:
+            }
         }
     }
     g.FullMatchesMutex.Unlock()
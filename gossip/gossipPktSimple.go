@@ -3,10 +3,13 @@ package gossip
 import (
     "github.com/pablo11/Peerster/model"
     "github.com/pablo11/Peerster/util/collections"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktSimple(gp *model.GossipPacket) {
-    g.printGossipPacket("peer", "", gp)
+    g.printGossipPacket(logger.INFO, "peer", "", gp)
+
+    g.History.Add(MESSAGE_TYPE_SIMPLE, gp.Simple.OriginalName, "", 0, gp.Simple.Contents)
 
     // Change the relay peer field to this node address
     receivedFrom := gp.Simple.RelayPeerAddr
@@ -1,14 +1,12 @@
 package gossip
 
 import (
-    "fmt"
     "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 func (g *Gossiper) HandlePktStatus(gp *model.GossipPacket, fromAddrStr string) {
-    if (!DEBUG) {
-        g.printGossipPacket("", fromAddrStr, gp)
-    }
+    g.printGossipPacket(logger.DEBUG, "", fromAddrStr, gp)
 
     g.compareVectorClocks(gp.Status, fromAddrStr)
 }
@@ -25,6 +23,7 @@ func (g *Gossiper) compareVectorClocks(sp *model.StatusPacket, fromAddr string)
     // Compare the two vector clocks
     for i := 0; i < len(sp.Want); i++ {
         otherStatusPeer := sp.Want[i]
+        g.Metrics.announceNextID(otherStatusPeer.Identifier, otherStatusPeer.NextID)
 
         g.statusMutex.Lock()
         statusPeer, exists := g.status[otherStatusPeer.Identifier]
@@ -63,10 +62,7 @@ func (g *Gossiper) compareVectorClocks(sp *model.StatusPacket, fromAddr string)
     defer g.statusMutex.Unlock()
     if len(sp.Want) == len(g.status) {
         // The two vectors are the same -> we are in sync with the peer
-        if (!DEBUG) {
-            fmt.Println("IN SYNC WITH " + fromAddr)
-            fmt.Println()
-        }
+        gossipLog.Debug("IN SYNC WITH " + fromAddr)
 
         // Flip the coin and stop timer
         g.getChannelForPeer(fromAddr) <- true
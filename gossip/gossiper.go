@@ -11,18 +11,22 @@ import (
     "github.com/dedis/protobuf"
     "github.com/pablo11/Peerster/model"
     "github.com/pablo11/Peerster/util/collections"
+    "github.com/pablo11/Peerster/util/logger"
 )
 
 const (
-    DEBUG bool = true
     PACKET_BUFFER_LEN int = 1024
+    GOSSIP_READ_BUFFER_LEN int = 4 * 1024 * 1024 // Socket receive buffer, the system may use a smaller one
     ACK_STATUS_WAIT_TIME time.Duration = 1 // Number of seconds to wait for a reply to a status message
     ANTI_ENTROPY_PERIOD time.Duration = 2
     SEARCH_REQUEST_DUPLICATE_PERIOD time.Duration = 500 // Milliseconds to wait before considering new SearchRequest as not duplicate
     SEARCH_REQUEST_BUDGET_DOUBLING_PERIOD time.Duration = 1
     MAX_SEARCH_BUDGET uint64 = 32
     SEARCH_REQUEST_MATCH_THRESHOLD int = 2
+    SEARCH_CHUNK_MAP_MAX_LEN int = 256 // Chunks listed one by one in a SearchResult, larger files are sent as ranges
+    SEARCH_MATCH_MAX_SOURCES int = 32 // Origins kept for each file matched by a search
     GENESIS_BLOCK_WAIT_TIME time.Duration = 5
+    MAX_CLIENT_RESPONSE_LEN int = 65000
 )
 
 type Gossiper struct {
@@ -36,6 +40,31 @@ type Gossiper struct {
 
     FileSharing *FileSharing
 
+    // Per-source token buckets protecting against flooding peers
+    RateLimiter *RateLimiter
+
+    // Score of peer addresses and origins, influencing the choice of peers
+    Reputation *Reputation
+
+    // Counters exposed on the metrics endpoint
+    Metrics *Metrics
+
+    // Bus on which rumors, private messages, routes, downloads, search matches
+    // and blocks are announced
+    Events *EventBus
+
+    // Indexed history of the rumors, private and simple messages sent and received
+    History *MessageHistory
+
+    // Private messages sent and received, grouped by peer
+    Conversations *Conversations
+
+    // Delivery state of the private messages sent by this node
+    Outbox *PrivateOutbox
+
+    // Private messages waiting for a route to their destination
+    Mailbox *Mailbox
+
     status map[string]*model.PeerStatus
     statusMutex sync.Mutex
 
@@ -46,10 +75,6 @@ type Gossiper struct {
     waitStatusChannel map[string]chan bool
     waitStatusChannelMutex sync.Mutex
 
-    // List of every message received to send to the web interface
-    allMessages []*model.RumorMessage
-    allMessagesMutex sync.Mutex
-
     // Routing table Origin->ip:port
     routingTable map[string]string
     routingTableMutex sync.Mutex
@@ -96,6 +121,8 @@ func NewGossiper(address, name string, peers []string, rtimer int, simple bool)
     if err != nil {
         log.Fatal(err)
     }
+    // Room for the replies to the parallel requests of the downloads
+    udpConn.SetReadBuffer(GOSSIP_READ_BUFFER_LEN)
 
     return &Gossiper{
         address: udpAddr,
@@ -106,14 +133,20 @@ func NewGossiper(address, name string, peers []string, rtimer int, simple bool)
         rtimer: time.Duration(rtimer),
         nextMessageId: 1,
         FileSharing: NewFileSharing(),
+        RateLimiter: NewRateLimiter(),
+        Reputation: NewReputation(),
+        Metrics: NewMetrics(),
+        Events: NewEventBus(),
+        History: NewMessageHistory(),
+        Conversations: NewConversations(name),
+        Outbox: NewPrivateOutbox(),
+        Mailbox: NewMailbox(),
         status: make(map[string]*model.PeerStatus),
         statusMutex: sync.Mutex{},
         messages: make(map[string][]*model.RumorMessage),
         messagesMutex: sync.Mutex{},
         waitStatusChannel: make(map[string]chan bool),
         waitStatusChannelMutex: sync.Mutex{},
-        allMessages: make([]*model.RumorMessage, 0),
-        allMessagesMutex: sync.Mutex{},
         routingTable: make(map[string]string),
         routingTableMutex: sync.Mutex{},
         processingSearchRequests: make(map[string]bool),
@@ -144,11 +177,14 @@ func NewGossiper(address, name string, peers []string, rtimer int, simple bool)
 }
 
 func (g *Gossiper) Run(uiPort string) {
-    fmt.Println("\033[0;32mGossiper " + g.Name + " started on " + g.address.String() + "\033[0m")
-    fmt.Println()
+    gossipLog.Event(logger.INFO, "STARTED", "\033[0;32mGossiper " + g.Name + " started on " + g.address.String() + "\033[0m", logger.Fields{
+        "name": g.Name,
+        "address": g.address.String(),
+    })
 
     g.FileSharing.SetGossiper(g)
 
+    go g.Mailbox.watchDeposits()
     go g.listenPeers()
     go g.listenClient(uiPort)
     if (!g.simple) {
@@ -173,14 +209,48 @@ func (g *Gossiper) GetOrigins() []string {
     return collections.MapKeys(g.routingTable)
 }
 
+// Return every rumor of the history, oldest first
 func (g *Gossiper) GetAllMessages() []*model.RumorMessage {
-    g.allMessagesMutex.Lock()
-    defer g.allMessagesMutex.Unlock()
-    return g.allMessages
+    rumors := make([]*model.RumorMessage, 0)
+    query := HistoryQuery{
+        Type: MESSAGE_TYPE_RUMOR,
+        Limit: HISTORY_MAX_LIMIT,
+    }
+    for {
+        page, cursor := g.History.Query(query)
+        for _, m := range page {
+            rumors = append(rumors, &model.RumorMessage{
+                Origin: m.Origin,
+                ID: m.ID,
+                Text: m.Text,
+            })
+        }
+        if cursor == 0 {
+            return rumors
+        }
+        query.SinceSeq = cursor
+    }
 }
 
+// Copies of the full matches, later search replies can add sources to them
 func (g *Gossiper) GetFullMatches() []*model.FileMatch {
-    return g.FullMatches
+    g.FullMatchesMutex.Lock()
+    matches := append([]*model.FileMatch{}, g.FullMatches...)
+    g.FullMatchesMutex.Unlock()
+
+    g.activeSearchRequestsMutex.Lock()
+    defer g.activeSearchRequestsMutex.Unlock()
+
+    fullMatches := make([]*model.FileMatch, len(matches))
+    for i, fullMatch := range matches {
+        match := *fullMatch
+        match.Sources = make(map[string][]uint64)
+        for origin, chunkNbs := range fullMatch.Sources {
+            match.Sources[origin] = chunkNbs
+        }
+        fullMatches[i] = &match
+    }
+    return fullMatches
 }
 
 func (g *Gossiper) listenPeers() {
@@ -193,18 +263,29 @@ func (g *Gossiper) listenPeers() {
     for {
         bytesRead, fromAddr, err = g.conn.ReadFrom(packetBuffer)
         if err != nil {
-            fmt.Println(err)
+            gossipLog.Error(err.Error())
             continue
         }
 
-        // Decode the message
+        // Decode the message from a copy: the byte slices of the packet point
+        // into it and it is handled while the next packet is read
+        packetBytes := make([]byte, bytesRead)
+        copy(packetBytes, packetBuffer[:bytesRead])
         gp := model.GossipPacket{}
-        err = protobuf.Decode(packetBuffer[:bytesRead], &gp)
+        err = protobuf.Decode(packetBytes, &gp)
         if err != nil {
-            //fmt.Println("ERROR:", err)
+            gossipLog.Debug("Could not decode packet from " + fromAddr.String() + ": " + err.Error())
             err = nil
         }
 
+        // Drop packets from sources exceeding their rate limit or banned
+        if !g.RateLimiter.Allow(&gp, fromAddr.String()) {
+            continue
+        }
+
+        packetClass, _, _ := classifyPacket(&gp)
+        g.Metrics.countPacketIn(packetClass, fromAddr.String(), bytesRead)
+
         // Store addr in the list of peers if not already present
         g.AddPeer(fromAddr.String())
 
@@ -213,6 +294,9 @@ func (g *Gossiper) listenPeers() {
 }
 
 func (g *Gossiper) handlePeerReceivedPacket(gp *model.GossipPacket, fromAddrStr string) {
+    g.Metrics.enterHandler()
+    defer g.Metrics.exitHandler()
+
     switch {
         case gp.Simple != nil:
             g.HandlePktSimple(gp)
@@ -226,6 +310,12 @@ func (g *Gossiper) handlePeerReceivedPacket(gp *model.GossipPacket, fromAddrStr
         case gp.Private != nil:
             g.HandlePktPrivate(gp, fromAddrStr)
 
+        case gp.PrivateAck != nil:
+            g.HandlePktPrivateAck(gp)
+
+        case gp.MailboxDeposit != nil:
+            g.HandlePktMailboxDeposit(gp, fromAddrStr)
+
         case gp.DataRequest != nil:
             g.FileSharing.HandleDataRequest(gp.DataRequest)
 
@@ -236,16 +326,16 @@ func (g *Gossiper) handlePeerReceivedPacket(gp *model.GossipPacket, fromAddrStr
             g.HandlePktSearchRequest(gp)
 
         case gp.SearchReply != nil:
-            g.HandlePktSearchReply(gp)
+            g.HandlePktSearchReply(gp, fromAddrStr)
 
         case gp.TxPublish != nil:
             g.HandlePktTxPublish(gp)
 
         case gp.BlockPublish != nil:
-            g.HandlePktBlockPublish(gp)
+            g.HandlePktBlockPublish(gp, fromAddrStr)
 
         default:
-            fmt.Println("WARNING: Unoknown message type")
+            gossipLog.Warning("Unoknown message type")
     }
 
     gp = nil
@@ -256,17 +346,18 @@ func (g *Gossiper) listenClient(uiPort string) {
     udpAddr := resolveAddress("127.0.0.1:" + uiPort)
     conn, err := net.ListenUDP("udp4", udpAddr)
     if err != nil {
-        fmt.Println(err)
+        gossipLog.Error(err.Error())
     }
     defer conn.Close()
 
     packetBuffer := make([]byte, 9 * PACKET_BUFFER_LEN)
     bytesRead := 0
 
+    var fromAddr *net.UDPAddr
     for {
-        bytesRead, _, err = conn.ReadFromUDP(packetBuffer)
+        bytesRead, fromAddr, err = conn.ReadFromUDP(packetBuffer)
         if err != nil {
-            fmt.Println(err)
+            gossipLog.Error(err.Error())
             continue
         }
 
@@ -274,17 +365,51 @@ func (g *Gossiper) listenClient(uiPort string) {
         cm := model.ClientMessage{}
         err = protobuf.Decode(packetBuffer[:bytesRead], &cm)
         if err != nil {
-            //fmt.Println("ERROR:", err)
+            gossipLog.Debug("Could not decode client message: " + err.Error())
             err = nil
         }
 
-        g.HandlePktClient(&cm)
+        go g.respondClient(conn, &cm, fromAddr)
+    }
+}
+
+// Handle the client request and send the response back to the client, if it waits for one
+func (g *Gossiper) respondClient(conn *net.UDPConn, cm *model.ClientMessage, clientAddr *net.UDPAddr) {
+    // A bad request must not stop the node
+    defer func() {
+        if r := recover(); r != nil {
+            gossipLog.Error("Panic while handling a client request of type " + cm.Type + ": " + fmt.Sprint(r))
+        }
+    }()
+
+    response := g.HandlePktClient(cm)
+    if cm.RequestID == 0 {
+        return
+    }
+
+    packetBytes, err := protobuf.Encode(response)
+    if err != nil {
+        gossipLog.Error("Could not encode client response: " + err.Error())
+        return
+    }
+
+    // The response must fit in a single datagram
+    if len(packetBytes) > MAX_CLIENT_RESPONSE_LEN {
+        packetBytes, _ = protobuf.Encode(clientError(cm, model.CLIENT_STATUS_ERROR, "the response is too large, ask for fewer elements"))
+    }
+
+    _, err = conn.WriteToUDP(packetBytes, clientAddr)
+    if err != nil {
+        gossipLog.Error("Could not send client response: " + err.Error())
     }
 }
 
-func (g *Gossiper) SendPublicMessage(contents string, storeForGUI bool) {
+// Send a rumor, or a simple message in simple mode. Returns the ID of the
+// rumor, 0 for a simple message
+func (g *Gossiper) SendPublicMessage(contents string, storeForGUI bool) uint32 {
     if g.simple {
         go g.sendSimpleMessage(contents)
+        return 0
     } else {
         // Build RumorMessage
         rm := model.RumorMessage{
@@ -307,6 +432,7 @@ func (g *Gossiper) SendPublicMessage(contents string, storeForGUI bool) {
 
         // Rumor RumorMessage
         g.sendRumorMessage(&rm, true, "")
+        return rm.ID
     }
 }
 
@@ -314,7 +440,7 @@ func (g *Gossiper) startAntiEntropy() {
     for {
         time.Sleep(ANTI_ENTROPY_PERIOD * time.Second)
         if len(g.peers) > 0 {
-            randomPeer := g.peers[rand.Intn(len(g.peers))]
+            randomPeer := g.Reputation.WeightedPick(g.peers)
             g.sendStatusMessage(randomPeer)
         }
     }
@@ -332,6 +458,8 @@ func (g *Gossiper) startRouteRumoring() {
 }
 
 func (g *Gossiper) sendSimpleMessage(contents string) {
+    g.History.Add(MESSAGE_TYPE_SIMPLE, g.Name, "", 0, contents)
+
     sm := model.SimpleMessage{
         OriginalName: g.Name,
         RelayPeerAddr: g.address.String(),
@@ -358,16 +486,14 @@ func (g *Gossiper) sendRumorMessage(rm *model.RumorMessage, random bool, addr st
             return
         }
 
-        // Select a random peer
-        peer = availablePeers[rand.Intn(len(availablePeers))]
+        // Select a random peer, favouring the ones with a good reputation
+        peer = g.Reputation.WeightedPick(availablePeers)
     }
 
     // Send him the packet
     gp := model.GossipPacket{Rumor: rm}
 
-    if (!DEBUG) {
-        g.printGossipPacket("mongering", peer, &gp)
-    }
+    g.printGossipPacket(logger.DEBUG, "mongering", peer, &gp)
 
     go g.sendGossipPacket(&gp, []string{peer})
 
@@ -375,15 +501,28 @@ func (g *Gossiper) sendRumorMessage(rm *model.RumorMessage, random bool, addr st
     go g.waitStatusAcknowledgement(addr, rm)
 }
 
-func (g *Gossiper) SendPrivateMessage(pm *model.PrivateMessage) {
-    destPeer := g.GetNextHopForDest(pm.Destination)
+// Send a private message from this node, it is retransmitted in background
+// until acknowledged by the destination. Returns the ID of the message
+func (g *Gossiper) SendPrivateMessage(pm *model.PrivateMessage) uint32 {
+    ackChannel := g.Outbox.track(pm)
+
+    g.History.Add(MESSAGE_TYPE_PRIVATE, pm.Origin, pm.Destination, pm.ID, pm.Text)
+    g.Conversations.Add(pm, DELIVERY_PENDING)
+
+    go g.deliverPrivateMessage(pm, ackChannel)
+    return pm.ID
+}
+
+// Send a point to point packet to the next hop towards dest. Returns false if
+// dest is not in the routing table
+func (g *Gossiper) routePacket(gp *model.GossipPacket, dest string) bool {
+    destPeer := g.GetNextHopForDest(dest)
     if destPeer == "" {
-        return
+        return false
     }
 
-    gp := model.GossipPacket{Private: pm}
-
-    go g.sendGossipPacket(&gp, []string{destPeer})
+    go g.sendGossipPacket(gp, []string{destPeer})
+    return true
 }
 
 func (g *Gossiper) GetNextHopForDest(dest string) string {
@@ -391,7 +530,7 @@ func (g *Gossiper) GetNextHopForDest(dest string) string {
     destPeer, destExists := g.routingTable[dest]
     g.routingTableMutex.Unlock()
     if !destExists {
-        fmt.Println("WARNING: Node " + dest + " not in the routing table")
+        routingLog.Warning("Node " + dest + " not in the routing table")
         return ""
     }
     return destPeer
@@ -444,11 +583,9 @@ func (g *Gossiper) removeChannelForPeer(addr string) {
 func (g *Gossiper) flipCoin(rm *model.RumorMessage) {
     if rand.Int() % 2 == 0 {
         if len(g.peers) > 0 {
-            randomPeer := g.peers[rand.Intn(len(g.peers))]
+            randomPeer := g.Reputation.WeightedPick(g.peers)
             g.sendRumorMessage(rm, false, randomPeer)
-            if (!DEBUG) {
-                fmt.Println("FLIPPED COIN sending rumor to " + randomPeer)
-            }
+            gossipLog.Debug("FLIPPED COIN sending rumor to " + randomPeer)
         }
     }
 }
@@ -471,28 +608,35 @@ func (g *Gossiper) sendStatusMessage(toPeer string) {
 func (g *Gossiper) sendGossipPacket(gp *model.GossipPacket, peersAddr []string) {
     packetBytes, err := protobuf.Encode(gp)
     if err != nil {
-        fmt.Println(err)
+        gossipLog.Error(err.Error())
         err = nil
         return
     }
 
+    packetClass, _, _ := classifyPacket(gp)
     for i := 0; i < len(peersAddr); i++ {
         addr := resolveAddress(peersAddr[i])
         if (addr != nil) {
             if _, err2 := g.conn.WriteToUDP(packetBytes, addr); err2 != nil {
-                fmt.Println(err2)
+                gossipLog.Error(err2.Error())
+            } else {
+                g.Metrics.countPacketOut(packetClass, peersAddr[i], len(packetBytes))
             }
         }
     }
 }
 
-func (g *Gossiper) printGossipPacket(mode, relayAddr string, gp *model.GossipPacket) {
+func (g *Gossiper) printGossipPacket(level logger.Level, mode, relayAddr string, gp *model.GossipPacket) {
+    if !gossipLog.IsEnabled(level) {
+        return
+    }
+
     packetToString := gp.String(mode, relayAddr)
     allPeersToString := "PEERS " + strings.Join(g.peers, ",")
 
-    fmt.Println(packetToString)
-    fmt.Println(allPeersToString)
-    fmt.Println()
+    event, fields := gp.Fields(mode, relayAddr)
+    gossipLog.Event(level, event, packetToString, fields)
+    gossipLog.Event(level, "PEERS", allPeersToString, logger.Fields{"peers": g.peers})
 }
 
 func (g *Gossiper) AddPeer(peer string) {
@@ -549,10 +693,13 @@ func (g *Gossiper) storeMessage(rm *model.RumorMessage, storeForGUI bool) {
     g.messagesMutex.Unlock()
 
     if storeForGUI {
-        // Add message also to allMessages for webserver
-        g.allMessagesMutex.Lock()
-        g.allMessages = append(g.allMessages, rm)
-        g.allMessagesMutex.Unlock()
+        // Add message also to the history for webserver
+        g.History.Add(MESSAGE_TYPE_RUMOR, rm.Origin, "", rm.ID, rm.Text)
+
+        g.Events.Publish(&Event{
+            Type: EVENT_RUMOR_DELIVERED,
+            Rumor: rm,
+        })
     }
 }
 
@@ -564,8 +711,23 @@ func (g *Gossiper) updateRoutingTable(rm *model.RumorMessage, fromAddr string) {
     g.routingTableMutex.Lock()
     if g.routingTable[rm.Origin] != fromAddr {
         g.routingTable[rm.Origin] = fromAddr
-        fmt.Println("DSDV " + rm.Origin + " " + fromAddr)
-        fmt.Println()
+        routingLog.Event(logger.INFO, "DSDV", "DSDV " + rm.Origin + " " + fromAddr, logger.Fields{
+            "origin": rm.Origin,
+            "nextHop": fromAddr,
+        })
+
+        g.Events.Publish(&Event{
+            Type: EVENT_ROUTE_CHANGED,
+            Route: &RouteChange{
+                Origin: rm.Origin,
+                NextHop: fromAddr,
+            },
+        })
     }
     g.routingTableMutex.Unlock()
+
+    // Messages waiting in the mailbox can be delivered to rm.Origin now
+    if rm.Origin != g.Name {
+        g.notifyRouteAvailable(rm.Origin)
+    }
 }
@@ -0,0 +1,80 @@
+package gossip
+
+import (
+    "time"
+)
+
+const (
+    INDEX_RUNNING = "indexing"
+    INDEX_DONE = "indexed"
+    INDEX_FAILED = "failed"
+    INDEX_RESULT_RETENTION time.Duration = 600 // Seconds the result of an indexing started by the client is kept
+)
+
+// Indexing of a file started by the client. Hashing a file of several GB
+// takes longer than the client waits for a response, it polls the state
+type IndexJob struct {
+    // Path given by the client
+    Filename string
+    // INDEX_RUNNING, INDEX_DONE or INDEX_FAILED
+    State string
+    MetaHash string
+    Error string
+    finishedAt time.Time
+}
+
+// Index path in the background like IndexFile. If path is already being
+// indexed, its running indexing is returned instead of starting another one
+func (fs *FileSharing) StartIndexing(path string) IndexJob {
+    fs.indexJobsMutex.Lock()
+    defer fs.indexJobsMutex.Unlock()
+
+    // Forget the results nobody asked for
+    for p, job := range fs.indexJobs {
+        if job.State != INDEX_RUNNING && time.Since(job.finishedAt) > INDEX_RESULT_RETENTION * time.Second {
+            delete(fs.indexJobs, p)
+        }
+    }
+
+    if job, isPresent := fs.indexJobs[path]; isPresent && job.State == INDEX_RUNNING {
+        return *job
+    }
+
+    job := &IndexJob{
+        Filename: path,
+        State: INDEX_RUNNING,
+        MetaHash: "",
+        Error: "",
+        finishedAt: time.Time{},
+    }
+    fs.indexJobs[path] = job
+
+    go func() {
+        metahash, err := fs.IndexFile(path)
+
+        fs.indexJobsMutex.Lock()
+        if err != nil {
+            job.State = INDEX_FAILED
+            job.Error = err.Error()
+        } else {
+            job.State = INDEX_DONE
+            job.MetaHash = metahash
+        }
+        job.finishedAt = time.Now()
+        fs.indexJobsMutex.Unlock()
+    }()
+
+    return *job
+}
+
+// State of the last indexing of path started with StartIndexing
+func (fs *FileSharing) IndexingState(path string) (IndexJob, bool) {
+    fs.indexJobsMutex.Lock()
+    defer fs.indexJobsMutex.Unlock()
+
+    job, isPresent := fs.indexJobs[path]
+    if !isPresent {
+        return IndexJob{}, false
+    }
+    return *job, true
+}
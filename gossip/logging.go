@@ -0,0 +1,14 @@
+package gossip
+
+import (
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+// Loggers of the gossiper subsystems
+var (
+    gossipLog = logger.New("gossip")
+    routingLog = logger.New("routing")
+    filesLog = logger.New("files")
+    searchLog = logger.New("search")
+    chainLog = logger.New("chain")
+)
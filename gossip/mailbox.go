@@ -0,0 +1,295 @@
+package gossip
+
+import (
+    "sync"
+    "time"
+    "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+const (
+    MAILBOX_DEFAULT_TTL time.Duration = 3600 // Seconds an undelivered private message is kept before failing
+    MAILBOX_MAX_TTL time.Duration = 24 * 3600 // Maximum number of seconds a volunteer keeps a deposited message
+    MAILBOX_FORWARD_INTERVAL time.Duration = 10 // Minimum seconds between two forwards of a deposited message
+    MAILBOX_MAX_DEPOSITS_PER_PEER int = 100 // Deposits kept for each neighbour, the ones expiring first are dropped first
+    MAILBOX_MAX_DEPOSITS int = 1000 // Deposits kept over all neighbours and destinations
+    MAILBOX_EXPIRY_CHECK_PERIOD time.Duration = 60 // Seconds between two removals of the expired deposits
+)
+
+// Private message deposited by a neighbour
+type mailboxEntry struct {
+    message *model.PrivateMessage
+    // Address of the neighbour that deposited it
+    from string
+    expires time.Time
+    lastForward time.Time
+}
+
+// Store-and-forward service for private messages whose destination can't be
+// reached. The sender keeps its own undelivered messages (see
+// deliverPrivateMessage) and waits here for a route; volunteers also keep the
+// messages deposited by their neighbours and forward them when a route to the
+// destination appears
+type Mailbox struct {
+    ttl time.Duration
+    volunteer bool
+
+    // Destination -> channels of the senders waiting for a route to it
+    waitingRoute map[string][]chan bool
+    waitingRouteMutex sync.Mutex
+
+    // Destination -> messages deposited by neighbours
+    deposits map[string][]*mailboxEntry
+    depositsMutex sync.Mutex
+}
+
+func NewMailbox() *Mailbox {
+    return &Mailbox{
+        ttl: MAILBOX_DEFAULT_TTL * time.Second,
+        volunteer: false,
+        waitingRoute: make(map[string][]chan bool),
+        waitingRouteMutex: sync.Mutex{},
+        deposits: make(map[string][]*mailboxEntry),
+        depositsMutex: sync.Mutex{},
+    }
+}
+
+// Set how long undelivered messages are kept, 0 disables the mailbox and
+// messages fail after PRIVATE_MESSAGE_EXPIRY
+func (m *Mailbox) SetTTL(ttl time.Duration) {
+    m.ttl = ttl
+}
+
+// Accept to keep the messages of neighbours for unreachable destinations
+func (m *Mailbox) SetVolunteer(volunteer bool) {
+    m.volunteer = volunteer
+}
+
+func (m *Mailbox) TTL() time.Duration {
+    return m.ttl
+}
+
+func (m *Mailbox) IsVolunteer() bool {
+    return m.volunteer
+}
+
+// Return a channel notified the next time a route to dest is learned. It must
+// be released with stopWaitingRoute if the sender stops waiting before
+func (m *Mailbox) waitRoute(dest string) chan bool {
+    m.waitingRouteMutex.Lock()
+    defer m.waitingRouteMutex.Unlock()
+
+    routeChannel := make(chan bool, 1)
+    m.waitingRoute[dest] = append(m.waitingRoute[dest], routeChannel)
+    return routeChannel
+}
+
+func (m *Mailbox) stopWaitingRoute(dest string, routeChannel chan bool) {
+    m.waitingRouteMutex.Lock()
+    defer m.waitingRouteMutex.Unlock()
+
+    channels := m.waitingRoute[dest]
+    for i, c := range channels {
+        if c == routeChannel {
+            channels = append(channels[:i], channels[i + 1:]...)
+            break
+        }
+    }
+    if len(channels) == 0 {
+        delete(m.waitingRoute, dest)
+    } else {
+        m.waitingRoute[dest] = channels
+    }
+}
+
+// Called whenever a rumor from dest is received, meaning that it is reachable
+func (g *Gossiper) notifyRouteAvailable(dest string) {
+    g.Mailbox.waitingRouteMutex.Lock()
+    for _, routeChannel := range g.Mailbox.waitingRoute[dest] {
+        routeChannel <- true
+    }
+    delete(g.Mailbox.waitingRoute, dest)
+    g.Mailbox.waitingRouteMutex.Unlock()
+
+    // Forward the messages deposited for dest
+    toForward := make([]*model.PrivateMessage, 0)
+    g.Mailbox.depositsMutex.Lock()
+    now := time.Now()
+    kept := make([]*mailboxEntry, 0, len(g.Mailbox.deposits[dest]))
+    for _, entry := range g.Mailbox.deposits[dest] {
+        if now.After(entry.expires) {
+            continue
+        }
+        if now.Sub(entry.lastForward) >= MAILBOX_FORWARD_INTERVAL * time.Second {
+            entry.lastForward = now
+            toForward = append(toForward, entry.message)
+        }
+        kept = append(kept, entry)
+    }
+    if len(kept) == 0 {
+        delete(g.Mailbox.deposits, dest)
+    } else {
+        g.Mailbox.deposits[dest] = kept
+    }
+    g.Mailbox.depositsMutex.Unlock()
+
+    for _, pm := range toForward {
+        // The origin and ID are unchanged, the destination acknowledges to the origin
+        gossipLog.Info("MAILBOX forwarding private message from " + pm.Origin + " to " + dest)
+        forwarded := *pm
+        g.routePacket(&model.GossipPacket{Private: &forwarded}, dest)
+    }
+}
+
+// Leave pm to the neighbours, the volunteers among them keep it for ttl
+func (g *Gossiper) depositPrivateMessage(pm *model.PrivateMessage, ttl time.Duration) {
+    peers := g.GetPeers()
+    if len(peers) == 0 || ttl <= 0 {
+        return
+    }
+
+    gp := model.GossipPacket{
+        MailboxDeposit: &model.MailboxDeposit{
+            Origin: g.Name,
+            Message: pm,
+            TTL: uint32(ttl / time.Second),
+        },
+    }
+    go g.sendGossipPacket(&gp, peers)
+}
+
+func (g *Gossiper) HandlePktMailboxDeposit(gp *model.GossipPacket, fromAddrStr string) {
+    md := gp.MailboxDeposit
+    if md.Message == nil || md.Message.Origin != md.Origin || md.Message.ID == 0 {
+        gossipLog.Debug("Ignoring malformed mailbox deposit from " + fromAddrStr)
+        return
+    }
+
+    // The destination is this node, deliver the message as if it was routed here
+    if md.Message.Destination == g.Name {
+        g.HandlePktPrivate(&model.GossipPacket{Private: md.Message}, fromAddrStr)
+        return
+    }
+
+    if !g.Mailbox.volunteer {
+        return
+    }
+
+    ttl := time.Duration(md.TTL) * time.Second
+    if ttl > MAILBOX_MAX_TTL * time.Second {
+        ttl = MAILBOX_MAX_TTL * time.Second
+    }
+    if ttl <= 0 {
+        return
+    }
+
+    g.printGossipPacket(logger.INFO, "", fromAddrStr, gp)
+
+    dest := md.Message.Destination
+    g.Mailbox.depositsMutex.Lock()
+    defer g.Mailbox.depositsMutex.Unlock()
+
+    // Neighbours deposit the same message again after each failed attempt
+    for _, entry := range g.Mailbox.deposits[dest] {
+        if entry.message.Origin == md.Message.Origin && entry.message.ID == md.Message.ID {
+            entry.expires = time.Now().Add(ttl)
+            return
+        }
+    }
+
+    // Limit the space a single neighbour, and all of them, can use. The
+    // origin is declared by the neighbour, it can't be trusted
+    fromPeer := 0
+    total := 0
+    for _, entries := range g.Mailbox.deposits {
+        for _, entry := range entries {
+            total += 1
+            if entry.from == fromAddrStr {
+                fromPeer += 1
+            }
+        }
+    }
+    if fromPeer >= MAILBOX_MAX_DEPOSITS_PER_PEER {
+        g.Mailbox.dropDeposit(fromAddrStr)
+    } else if total >= MAILBOX_MAX_DEPOSITS {
+        g.Mailbox.dropDeposit("")
+    }
+
+    g.Mailbox.deposits[dest] = append(g.Mailbox.deposits[dest], &mailboxEntry{
+        message: md.Message,
+        from: fromAddrStr,
+        expires: time.Now().Add(ttl),
+        lastForward: time.Time{},
+    })
+}
+
+// Drop the deposit of the neighbour from ("" for any neighbour) that expires
+// first. Must be called with depositsMutex locked
+func (m *Mailbox) dropDeposit(from string) {
+    dropDest := ""
+    dropIndex := -1
+    for dest, entries := range m.deposits {
+        for i, entry := range entries {
+            if from != "" && entry.from != from {
+                continue
+            }
+            if dropIndex < 0 || entry.expires.Before(m.deposits[dropDest][dropIndex].expires) {
+                dropDest = dest
+                dropIndex = i
+            }
+        }
+    }
+    if dropIndex < 0 {
+        return
+    }
+
+    entries := m.deposits[dropDest]
+    entries = append(entries[:dropIndex], entries[dropIndex + 1:]...)
+    if len(entries) == 0 {
+        delete(m.deposits, dropDest)
+    } else {
+        m.deposits[dropDest] = entries
+    }
+}
+
+// Remove the expired deposits every MAILBOX_EXPIRY_CHECK_PERIOD seconds,
+// including the ones for destinations that never become reachable
+func (m *Mailbox) watchDeposits() {
+    for {
+        time.Sleep(MAILBOX_EXPIRY_CHECK_PERIOD * time.Second)
+
+        m.depositsMutex.Lock()
+        now := time.Now()
+        for dest, entries := range m.deposits {
+            kept := make([]*mailboxEntry, 0, len(entries))
+            for _, entry := range entries {
+                if now.Before(entry.expires) {
+                    kept = append(kept, entry)
+                }
+            }
+            if len(kept) == 0 {
+                delete(m.deposits, dest)
+            } else {
+                m.deposits[dest] = kept
+            }
+        }
+        m.depositsMutex.Unlock()
+    }
+}
+
+// Number of messages kept for neighbours, by destination
+func (m *Mailbox) Deposits() map[string]int {
+    m.depositsMutex.Lock()
+    defer m.depositsMutex.Unlock()
+
+    now := time.Now()
+    counts := make(map[string]int)
+    for dest, entries := range m.deposits {
+        for _, entry := range entries {
+            if now.Before(entry.expires) {
+                counts[dest] += 1
+            }
+        }
+    }
+    return counts
+}
@@ -0,0 +1,247 @@
+package gossip
+
+import (
+    "sort"
+    "sync"
+    "time"
+    "strings"
+    "unicode"
+)
+
+const (
+    MESSAGE_TYPE_RUMOR = "rumor"
+    MESSAGE_TYPE_PRIVATE = "private"
+    MESSAGE_TYPE_SIMPLE = "simple"
+
+    HISTORY_DEFAULT_LIMIT int = 100
+    HISTORY_MAX_LIMIT int = 1000
+)
+
+// A message sent or received by this node, as kept in the history
+type HistoryMessage struct {
+    // Position in the history, starting at 1. Used as pagination cursor
+    Seq uint64
+    Type string
+    Origin string
+    // Only set for private messages
+    Destination string
+    // Only set for rumors and private messages
+    ID uint32
+    Text string
+    Timestamp time.Time
+}
+
+// Filters of a history query. Zero values disable the corresponding filter
+type HistoryQuery struct {
+    // Only messages with a Seq greater than SinceSeq
+    SinceSeq uint64
+    // Only messages with a Seq smaller than BeforeSeq
+    BeforeSeq uint64
+    Origin string
+    Type string
+    From time.Time
+    To time.Time
+    // Every word of Text must appear in the message
+    Text string
+    // Return the newest messages first
+    Descending bool
+    Limit int
+}
+
+// Append-only history of the messages with an inverted index on the origin,
+// the type and the words of the text, so that queries only visit the
+// messages of the most selective filter
+type MessageHistory struct {
+    // messages[i].Seq == i + 1
+    messages []*HistoryMessage
+    // Origin -> Seqs in increasing order
+    byOrigin map[string][]uint64
+    // Type -> Seqs in increasing order
+    byType map[string][]uint64
+    // Lowercase word -> Seqs in increasing order
+    byWord map[string][]uint64
+    messagesMutex sync.RWMutex
+}
+
+func NewMessageHistory() *MessageHistory {
+    return &MessageHistory{
+        messages: make([]*HistoryMessage, 0),
+        byOrigin: make(map[string][]uint64),
+        byType: make(map[string][]uint64),
+        byWord: make(map[string][]uint64),
+        messagesMutex: sync.RWMutex{},
+    }
+}
+
+// Add a message to the history and return its Seq
+func (h *MessageHistory) Add(msgType, origin, destination string, id uint32, text string) uint64 {
+    h.messagesMutex.Lock()
+    defer h.messagesMutex.Unlock()
+
+    seq := uint64(len(h.messages) + 1)
+    timestamp := time.Now()
+    // Keep timestamps ordered like Seqs so that time ranges can be found by bisection
+    if len(h.messages) > 0 && timestamp.Before(h.messages[len(h.messages) - 1].Timestamp) {
+        timestamp = h.messages[len(h.messages) - 1].Timestamp
+    }
+
+    h.messages = append(h.messages, &HistoryMessage{
+        Seq: seq,
+        Type: msgType,
+        Origin: origin,
+        Destination: destination,
+        ID: id,
+        Text: text,
+        Timestamp: timestamp,
+    })
+
+    h.byOrigin[origin] = append(h.byOrigin[origin], seq)
+    h.byType[msgType] = append(h.byType[msgType], seq)
+    for _, word := range uniqueWords(text) {
+        h.byWord[word] = append(h.byWord[word], seq)
+    }
+
+    return seq
+}
+
+// Return the messages matching q, and the cursor to pass as SinceSeq (or
+// BeforeSeq when Descending) to get the next page. The cursor is 0 if there
+// are no more messages
+func (h *MessageHistory) Query(q HistoryQuery) ([]HistoryMessage, uint64) {
+    limit := q.Limit
+    if limit <= 0 {
+        limit = HISTORY_DEFAULT_LIMIT
+    } else if limit > HISTORY_MAX_LIMIT {
+        limit = HISTORY_MAX_LIMIT
+    }
+
+    h.messagesMutex.RLock()
+    defer h.messagesMutex.RUnlock()
+
+    results := make([]HistoryMessage, 0)
+    // Checked first, SinceSeq + 1 overflows otherwise
+    if q.SinceSeq >= uint64(len(h.messages)) {
+        return results, 0
+    }
+
+    // Seqs in [first, last] satisfy the cursor and time range filters
+    first := q.SinceSeq + 1
+    last := uint64(len(h.messages))
+    if q.BeforeSeq > 0 && q.BeforeSeq - 1 < last {
+        last = q.BeforeSeq - 1
+    }
+    if !q.From.IsZero() {
+        fromSeq := uint64(sort.Search(len(h.messages), func(i int) bool {
+            return !h.messages[i].Timestamp.Before(q.From)
+        })) + 1
+        if fromSeq > first {
+            first = fromSeq
+        }
+    }
+    if !q.To.IsZero() {
+        toSeq := uint64(sort.Search(len(h.messages), func(i int) bool {
+            return h.messages[i].Timestamp.After(q.To)
+        }))
+        if toSeq < last {
+            last = toSeq
+        }
+    }
+
+    if first > last {
+        return results, 0
+    }
+
+    // Collect the posting lists of the indexed filters
+    lists := make([][]uint64, 0)
+    if q.Origin != "" {
+        lists = append(lists, h.byOrigin[q.Origin])
+    }
+    if q.Type != "" {
+        lists = append(lists, h.byType[q.Type])
+    }
+    for _, word := range uniqueWords(q.Text) {
+        lists = append(lists, h.byWord[word])
+    }
+
+    // Walk the shortest list and check the others by bisection
+    isIndexed := len(lists) > 0
+    var candidates []uint64
+    if isIndexed {
+        sort.Slice(lists, func(i, j int) bool {
+            return len(lists[i]) < len(lists[j])
+        })
+        candidates = lists[0]
+        lists = lists[1:]
+    }
+
+    matches := func(seq uint64) bool {
+        for _, list := range lists {
+            if !containsSeq(list, seq) {
+                return false
+            }
+        }
+        return true
+    }
+
+    var cursor uint64 = 0
+    visit := func(seq uint64) bool {
+        if !matches(seq) {
+            return true
+        }
+        if len(results) == limit {
+            // There is at least one more message
+            cursor = results[len(results) - 1].Seq
+            return false
+        }
+        results = append(results, *h.messages[seq - 1])
+        return true
+    }
+
+    if !isIndexed {
+        // No indexed filter: walk the range directly
+        if q.Descending {
+            for seq := last; seq >= first && visit(seq); seq-- {}
+        } else {
+            for seq := first; seq <= last && visit(seq); seq++ {}
+        }
+        return results, cursor
+    }
+
+    start := sort.Search(len(candidates), func(i int) bool {
+        return candidates[i] >= first
+    })
+    end := sort.Search(len(candidates), func(i int) bool {
+        return candidates[i] > last
+    })
+    if q.Descending {
+        for i := end - 1; i >= start && visit(candidates[i]); i-- {}
+    } else {
+        for i := start; i < end && visit(candidates[i]); i++ {}
+    }
+
+    return results, cursor
+}
+
+func containsSeq(list []uint64, seq uint64) bool {
+    i := sort.Search(len(list), func(i int) bool {
+        return list[i] >= seq
+    })
+    return i < len(list) && list[i] == seq
+}
+
+// Split text into lowercase words made of letters and digits, without duplicates
+func uniqueWords(text string) []string {
+    words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+        return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+    })
+
+    seen := make(map[string]bool)
+    unique := make([]string, 0, len(words))
+    for _, word := range words {
+        if !seen[word] {
+            seen[word] = true
+            unique = append(unique, word)
+        }
+    }
+    return unique
+}
@@ -0,0 +1,176 @@
+package gossip
+
+import (
+    "bytes"
+    "errors"
+    "encoding/hex"
+    "encoding/binary"
+)
+
+/* Files of up to METAFILE_HASHES chunks keep the original format: the
+   metafile is the list of the hashes of the chunks. Larger files have a tree
+   of metafiles: the hashes of the chunks are grouped in leaf metafiles of
+   METAFILE_HASHES hashes, whose hashes are grouped in the same way until they
+   fit in the root. The root starts with a header of 32 bytes:
+
+     "PSTRTREE" | depth (uint32) | 4 zero bytes | nb of chunks (uint64) | 8 zero bytes
+
+   followed by the hashes of its children. depth is the number of levels of
+   metafiles including the root, the children of the root are leaf metafiles
+   when it is 2. Every metafile but the last of each level is full, so the
+   path to a chunk is computed from its number */
+
+const METAFILE_HASHES = MAX_CHUNK_SIZE / 32
+// Hashes that fit in the root after the header
+const METAFILE_ROOT_HASHES = METAFILE_HASHES - 1
+// Sanity limit for the chunk count announced by remote nodes (1TB files)
+const MAX_NB_CHUNKS = 1 << 27
+// Enough levels for MAX_NB_CHUNKS chunks
+const METAFILE_MAX_DEPTH = 4
+const METAFILE_TREE_MAGIC = "PSTRTREE"
+
+// Parsed root metafile
+type metafileRoot struct {
+    // 1 for the original format
+    depth int
+    nbChunks int
+    // Hashes of the children of the root, chunks when depth is 1
+    children []byte
+}
+
+// Build the metafile tree of the given chunk hashes. Return the root and the
+// other metafiles of the tree by hex hash
+func buildMetafileTree(chunkHashes []byte) ([]byte, map[string][]byte) {
+    nodes := make(map[string][]byte)
+    nbChunks := len(chunkHashes) / 32
+    if nbChunks <= METAFILE_HASHES {
+        return chunkHashes, nodes
+    }
+
+    level := chunkHashes
+    depth := 1
+    for len(level) / 32 > METAFILE_ROOT_HASHES {
+        parents := make([]byte, 0)
+        for start := 0; start < len(level); start += METAFILE_HASHES * 32 {
+            end := start + METAFILE_HASHES * 32
+            if end > len(level) {
+                end = len(level)
+            }
+            node := level[start:end]
+            nodeHash := hash(node)
+            nodes[hex.EncodeToString(nodeHash)] = node
+            parents = append(parents, nodeHash...)
+        }
+        level = parents
+        depth += 1
+    }
+
+    header := make([]byte, 32)
+    copy(header, METAFILE_TREE_MAGIC)
+    binary.BigEndian.PutUint32(header[8:12], uint32(depth))
+    binary.BigEndian.PutUint64(header[16:24], uint64(nbChunks))
+    return append(header, level...), nodes
+}
+
+func parseMetafileRoot(root []byte) (*metafileRoot, error) {
+    if len(root) % 32 != 0 {
+        return nil, errors.New("the length of the metafile is not a multiple of 32")
+    }
+
+    if len(root) < 32 || !bytes.Equal(root[:len(METAFILE_TREE_MAGIC)], []byte(METAFILE_TREE_MAGIC)) {
+        return &metafileRoot{
+            depth: 1,
+            nbChunks: len(root) / 32,
+            children: root,
+        }, nil
+    }
+
+    depth := int(binary.BigEndian.Uint32(root[8:12]))
+    nbChunks := binary.BigEndian.Uint64(root[16:24])
+    children := root[32:]
+    if depth < 2 || depth > METAFILE_MAX_DEPTH || nbChunks > MAX_NB_CHUNKS || len(children) == 0 {
+        return nil, errors.New("invalid metafile header")
+    }
+
+    // The children must cover exactly nbChunks chunks
+    leavesPerChild := pow(METAFILE_HASHES, depth - 1)
+    nbChildren := len(children) / 32
+    if uint64((nbChildren - 1) * leavesPerChild) >= nbChunks || uint64(nbChildren * leavesPerChild) < nbChunks {
+        return nil, errors.New("the metafile doesn't match its chunk count")
+    }
+
+    return &metafileRoot{
+        depth: depth,
+        nbChunks: int(nbChunks),
+        children: children,
+    }, nil
+}
+
+// Return the hash of chunk number offset (starting from 0) of the file. read
+// returns the metafile with the given hex hash, nil if it isn't stored. If a
+// metafile on the path to the chunk isn't stored yet, or doesn't have the
+// length its place in the tree requires, return nil, the hash of this
+// metafile and its length. Return nil, nil, 0 past the end of the file
+func (root *metafileRoot) chunkHash(offset int, read func(string) []byte) ([]byte, []byte, int) {
+    if offset < 0 || offset >= root.nbChunks {
+        return nil, nil, 0
+    }
+
+    chunk := offset
+    node := root.children
+    for level := root.depth; level > 1; level-- {
+        leavesPerChild := pow(METAFILE_HASHES, level - 1)
+        childHash := hashAt(node, offset / leavesPerChild)
+        if childHash == nil {
+            return nil, nil, 0
+        }
+        offset = offset % leavesPerChild
+
+        size := root.metafileLen(level - 1, chunk)
+        node = read(hex.EncodeToString(childHash))
+        if len(node) != size {
+            return nil, childHash, size
+        }
+    }
+
+    return hashAt(node, offset), nil, 0
+}
+
+// Length of the metafile of the given level (1 for leaf metafiles) on the path
+// to chunk number offset. Only the last metafile of a level isn't full
+func (root *metafileRoot) metafileLen(level, offset int) int {
+    chunksPerMetafile := pow(METAFILE_HASHES, level)
+    first := offset / chunksPerMetafile * chunksPerMetafile
+    nbChunks := root.nbChunks - first
+    if nbChunks > chunksPerMetafile {
+        nbChunks = chunksPerMetafile
+    }
+
+    chunksPerHash := pow(METAFILE_HASHES, level - 1)
+    return (nbChunks + chunksPerHash - 1) / chunksPerHash * 32
+}
+
+// Number of chunks of the file with the given hex metahash, 0 if its root metafile is missing
+func (fs *FileSharing) metafileNbChunks(metahash string) int {
+    root, err := parseMetafileRoot(fs.readChunkFile(metahash))
+    if err != nil {
+        return 0
+    }
+    return root.nbChunks
+}
+
+// Hash number i of a metafile, nil if it is too short
+func hashAt(metafile []byte, i int) []byte {
+    if (i + 1) * 32 > len(metafile) {
+        return nil
+    }
+    return metafile[i * 32:(i + 1) * 32]
+}
+
+func pow(base, exponent int) int {
+    result := 1
+    for i := 0; i < exponent; i++ {
+        result *= base
+    }
+    return result
+}
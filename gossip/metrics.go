@@ -0,0 +1,183 @@
+package gossip
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    METRICS_MAX_PEERS int = 256 // Peer addresses with their own byte counters, the others are counted under METRICS_OTHER_PEERS
+    METRICS_OTHER_PEERS string = "other"
+    METRICS_MAX_ORIGINS int = 1024 // Origins whose announced NextID is kept for the rumor lag
+)
+
+// Counters updated by the gossiper while running
+type Metrics struct {
+    // Packet class -> number of packets
+    packetsIn map[string]uint64
+    packetsOut map[string]uint64
+    // Peer address -> number of bytes
+    bytesIn map[string]uint64
+    bytesOut map[string]uint64
+    packetsMutex sync.Mutex
+
+    // Origin -> highest NextID announced by a peer in a StatusPacket
+    announcedNextID map[string]uint32
+    announcedNextIDMutex sync.Mutex
+
+    miningAttempts uint64
+    forkSwitches uint64
+    handlerQueueDepth int64
+}
+
+// Point in time view of all counters and gauges of the gossiper
+type MetricsSnapshot struct {
+    PacketsIn map[string]uint64
+    PacketsOut map[string]uint64
+    BytesIn map[string]uint64
+    BytesOut map[string]uint64
+    RumorLag map[string]uint64
+    Throttled map[string]uint64
+    ActiveDownloads int
+    ActiveSearches int
+    ChunkStoreFiles int
+    ChunkStoreBytes int64
+    BlockchainHeight uint64
+    MiningAttempts uint64
+    ForkSwitches uint64
+    HandlerQueueDepth int64
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{
+        packetsIn: make(map[string]uint64),
+        packetsOut: make(map[string]uint64),
+        bytesIn: make(map[string]uint64),
+        bytesOut: make(map[string]uint64),
+        packetsMutex: sync.Mutex{},
+        announcedNextID: make(map[string]uint32),
+        announcedNextIDMutex: sync.Mutex{},
+    }
+}
+
+func (m *Metrics) countPacketIn(class, peer string, nbBytes int) {
+    if class == "" {
+        class = "unknown"
+    }
+
+    m.packetsMutex.Lock()
+    m.packetsIn[class] += 1
+    m.bytesIn[peerLabel(m.bytesIn, peer)] += uint64(nbBytes)
+    m.packetsMutex.Unlock()
+}
+
+func (m *Metrics) countPacketOut(class, peer string, nbBytes int) {
+    m.packetsMutex.Lock()
+    m.packetsOut[class] += 1
+    m.bytesOut[peerLabel(m.bytesOut, peer)] += uint64(nbBytes)
+    m.packetsMutex.Unlock()
+}
+
+// Key of peer in the byte counters, every address gets a label series so
+// their number is limited
+func peerLabel(counters map[string]uint64, peer string) string {
+    if _, isPresent := counters[peer]; isPresent || len(counters) < METRICS_MAX_PEERS {
+        return peer
+    }
+    return METRICS_OTHER_PEERS
+}
+
+// Origins are named by any peer, the ones that don't fit are ignored until
+// the lag of others is caught up (see GetMetrics)
+func (m *Metrics) announceNextID(origin string, nextID uint32) {
+    m.announcedNextIDMutex.Lock()
+    _, isPresent := m.announcedNextID[origin]
+    if (isPresent || len(m.announcedNextID) < METRICS_MAX_ORIGINS) && nextID > m.announcedNextID[origin] {
+        m.announcedNextID[origin] = nextID
+    }
+    m.announcedNextIDMutex.Unlock()
+}
+
+func (m *Metrics) countMiningAttempt() {
+    atomic.AddUint64(&m.miningAttempts, 1)
+}
+
+func (m *Metrics) countForkSwitch() {
+    atomic.AddUint64(&m.forkSwitches, 1)
+}
+
+func (m *Metrics) enterHandler() {
+    atomic.AddInt64(&m.handlerQueueDepth, 1)
+}
+
+func (m *Metrics) exitHandler() {
+    atomic.AddInt64(&m.handlerQueueDepth, -1)
+}
+
+func copyCounters(counters map[string]uint64) map[string]uint64 {
+    c := make(map[string]uint64)
+    for k, v := range counters {
+        c[k] = v
+    }
+    return c
+}
+
+func (g *Gossiper) GetMetrics() MetricsSnapshot {
+    m := g.Metrics
+
+    m.packetsMutex.Lock()
+    snapshot := MetricsSnapshot{
+        PacketsIn: copyCounters(m.packetsIn),
+        PacketsOut: copyCounters(m.packetsOut),
+        BytesIn: copyCounters(m.bytesIn),
+        BytesOut: copyCounters(m.bytesOut),
+        RumorLag: make(map[string]uint64),
+        Throttled: g.RateLimiter.Stats().Throttled,
+        MiningAttempts: atomic.LoadUint64(&m.miningAttempts),
+        ForkSwitches: atomic.LoadUint64(&m.forkSwitches),
+        HandlerQueueDepth: atomic.LoadInt64(&m.handlerQueueDepth),
+    }
+    m.packetsMutex.Unlock()
+
+    // Rumor catch-up lag: how many messages of each origin peers have that we still miss
+    m.announcedNextIDMutex.Lock()
+    g.statusMutex.Lock()
+    for origin, announced := range m.announcedNextID {
+        var nextID uint32 = 1
+        if status, isPresent := g.status[origin]; isPresent {
+            nextID = status.NextID
+        }
+        var lag uint64 = 0
+        if announced > nextID {
+            lag = uint64(announced - nextID)
+        }
+        snapshot.RumorLag[origin] = lag
+
+        // Origins caught up are forgotten until a peer announces new messages
+        if lag == 0 {
+            delete(m.announcedNextID, origin)
+        }
+    }
+    g.statusMutex.Unlock()
+    m.announcedNextIDMutex.Unlock()
+
+    g.FileSharing.availableFilesMutex.Lock()
+    for _, file := range g.FileSharing.AvailableFiles {
+        if file.MetaHash == nil || file.NbChunksDone < file.NbChunks {
+            snapshot.ActiveDownloads += 1
+        }
+    }
+    g.FileSharing.availableFilesMutex.Unlock()
+
+    g.activeSearchRequestsMutex.Lock()
+    snapshot.ActiveSearches = len(g.activeSearchRequests)
+    g.activeSearchRequestsMutex.Unlock()
+
+    snapshot.ChunkStoreFiles, snapshot.ChunkStoreBytes = g.FileSharing.chunks.size()
+
+    g.forksMutex.Lock()
+    snapshot.BlockchainHeight = g.forks[g.longestChain]
+    g.forksMutex.Unlock()
+
+    return snapshot
+}
@@ -0,0 +1,285 @@
+package gossip
+
+import (
+    "sync"
+    "time"
+    "strings"
+    "strconv"
+    "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
+)
+
+const (
+    PRIVATE_RETRANSMIT_INITIAL time.Duration = 1 // Seconds before the first retransmission, doubled after each attempt
+    PRIVATE_RETRANSMIT_MAX time.Duration = 16 // Maximum number of seconds between two retransmissions
+    PRIVATE_MESSAGE_EXPIRY time.Duration = 60 // Seconds of retransmissions before the message is kept in the mailbox, or fails if the mailbox is disabled
+    PRIVATE_DELIVERY_RETENTION time.Duration = 600 // Seconds the state of a delivered or failed message is kept, the conversation keeps it afterwards
+
+    DELIVERY_PENDING = "pending"
+    // Not acknowledged, waiting in the mailbox for a route to the destination
+    DELIVERY_QUEUED = "queued"
+    DELIVERY_DELIVERED = "delivered"
+    DELIVERY_FAILED = "failed"
+)
+
+// Delivery state of a private message sent by this node
+type PrivateDelivery struct {
+    ID uint32
+    Destination string
+    Text string
+    State string
+    Attempts int
+    CreatedAt time.Time
+    UpdatedAt time.Time
+}
+
+// Keep track of the private messages sent by this node until they are
+// acknowledged, and of the ones received to ignore retransmissions
+type PrivateOutbox struct {
+    nextId uint32
+
+    // ID -> delivery of the messages sent by this node
+    deliveries map[uint32]*PrivateDelivery
+    // ID -> channel notified when the acknowledgement is received
+    ackChannels map[uint32]chan bool
+    deliveriesMutex sync.Mutex
+
+    // origin|ID -> reception time of the private messages received
+    received map[string]time.Time
+    receivedMutex sync.Mutex
+}
+
+func NewPrivateOutbox() *PrivateOutbox {
+    return &PrivateOutbox{
+        // IDs must not be reused after a restart, otherwise destinations would
+        // take new messages for retransmissions
+        nextId: uint32(time.Now().Unix()),
+        deliveries: make(map[uint32]*PrivateDelivery),
+        ackChannels: make(map[uint32]chan bool),
+        deliveriesMutex: sync.Mutex{},
+        received: make(map[string]time.Time),
+        receivedMutex: sync.Mutex{},
+    }
+}
+
+// Assign an ID to pm and start tracking its delivery
+func (o *PrivateOutbox) track(pm *model.PrivateMessage) chan bool {
+    o.deliveriesMutex.Lock()
+    defer o.deliveriesMutex.Unlock()
+
+    // Forget the messages whose delivery ended long ago
+    now := time.Now()
+    for id, delivery := range o.deliveries {
+        isFinished := delivery.State == DELIVERY_DELIVERED || delivery.State == DELIVERY_FAILED
+        if isFinished && now.Sub(delivery.UpdatedAt) > PRIVATE_DELIVERY_RETENTION * time.Second {
+            delete(o.deliveries, id)
+        }
+    }
+
+    o.nextId += 1
+    if o.nextId == 0 {
+        // 0 is the ID of messages sent by nodes not supporting acknowledgements
+        o.nextId = 1
+    }
+    pm.ID = o.nextId
+
+    o.deliveries[pm.ID] = &PrivateDelivery{
+        ID: pm.ID,
+        Destination: pm.Destination,
+        Text: pm.Text,
+        State: DELIVERY_PENDING,
+        Attempts: 0,
+        CreatedAt: time.Now(),
+        UpdatedAt: time.Now(),
+    }
+
+    ackChannel := make(chan bool, 1)
+    o.ackChannels[pm.ID] = ackChannel
+    return ackChannel
+}
+
+// Notify the sender of the message id that from acknowledged it. Returns
+// false if the message is unknown or was not sent to from
+func (o *PrivateOutbox) acknowledge(from string, id uint32) bool {
+    o.deliveriesMutex.Lock()
+    defer o.deliveriesMutex.Unlock()
+
+    delivery, isPresent := o.deliveries[id]
+    if !isPresent || delivery.Destination != from {
+        return false
+    }
+
+    if ackChannel, isWaiting := o.ackChannels[id]; isWaiting {
+        select {
+            case ackChannel <- true:
+            default:
+        }
+    }
+    return true
+}
+
+func (o *PrivateOutbox) countAttempt(id uint32) {
+    o.deliveriesMutex.Lock()
+    defer o.deliveriesMutex.Unlock()
+
+    if delivery, isPresent := o.deliveries[id]; isPresent {
+        delivery.Attempts += 1
+        delivery.UpdatedAt = time.Now()
+    }
+}
+
+func (o *PrivateOutbox) setState(id uint32, state string) {
+    o.deliveriesMutex.Lock()
+    defer o.deliveriesMutex.Unlock()
+
+    if delivery, isPresent := o.deliveries[id]; isPresent {
+        delivery.State = state
+        delivery.UpdatedAt = time.Now()
+    }
+    if state == DELIVERY_DELIVERED || state == DELIVERY_FAILED {
+        delete(o.ackChannels, id)
+    }
+}
+
+// Return a copy of the delivery of the message id
+func (o *PrivateOutbox) Get(id uint32) (PrivateDelivery, bool) {
+    o.deliveriesMutex.Lock()
+    defer o.deliveriesMutex.Unlock()
+
+    delivery, isPresent := o.deliveries[id]
+    if !isPresent {
+        return PrivateDelivery{}, false
+    }
+    return *delivery, true
+}
+
+// Record the reception of a private message, returns false if it was already
+// received (retransmission of a message whose acknowledgement was lost)
+func (o *PrivateOutbox) markReceived(pm *model.PrivateMessage) bool {
+    o.receivedMutex.Lock()
+    defer o.receivedMutex.Unlock()
+
+    // Messages are not delivered after MAILBOX_MAX_TTL, older entries are useless
+    now := time.Now()
+    for key, receivedAt := range o.received {
+        if now.Sub(receivedAt) > MAILBOX_MAX_TTL * time.Second {
+            delete(o.received, key)
+        }
+    }
+
+    key := pm.Origin + "|" + strconv.FormatUint(uint64(pm.ID), 10)
+    if _, isPresent := o.received[key]; isPresent {
+        return false
+    }
+    o.received[key] = now
+    return true
+}
+
+// Send pm until its destination acknowledges it, waiting longer after each
+// attempt. If it is still not acknowledged after PRIVATE_MESSAGE_EXPIRY, the
+// message is kept in the mailbox and sent again when a route to the
+// destination appears, until the mailbox TTL expires
+func (g *Gossiper) deliverPrivateMessage(pm *model.PrivateMessage, ackChannel chan bool) {
+    ttl := g.Mailbox.TTL()
+    if ttl < PRIVATE_MESSAGE_EXPIRY * time.Second {
+        ttl = PRIVATE_MESSAGE_EXPIRY * time.Second
+    }
+    expiry := time.After(ttl)
+    deadline := time.Now().Add(ttl)
+    hasDeposited := false
+
+    for {
+        if g.retransmitPrivateMessage(pm, ackChannel, expiry) {
+            return
+        }
+
+        if g.Mailbox.TTL() <= 0 {
+            g.setDeliveryState(pm, DELIVERY_FAILED)
+            return
+        }
+
+        // Wait in the mailbox, and let the volunteer neighbours try too
+        g.setDeliveryState(pm, DELIVERY_QUEUED)
+        if !hasDeposited {
+            g.depositPrivateMessage(pm, deadline.Sub(time.Now()))
+            hasDeposited = true
+        }
+
+        routeChannel := g.Mailbox.waitRoute(pm.Destination)
+        select {
+            case <-ackChannel:
+                g.Mailbox.stopWaitingRoute(pm.Destination, routeChannel)
+                g.setDeliveryState(pm, DELIVERY_DELIVERED)
+                return
+
+            case <-expiry:
+                g.Mailbox.stopWaitingRoute(pm.Destination, routeChannel)
+                g.setDeliveryState(pm, DELIVERY_FAILED)
+                return
+
+            case <-routeChannel:
+                g.setDeliveryState(pm, DELIVERY_PENDING)
+        }
+    }
+}
+
+// Send pm with an exponential backoff for PRIVATE_MESSAGE_EXPIRY. Returns true
+// if the delivery is over, either acknowledged or expired
+func (g *Gossiper) retransmitPrivateMessage(pm *model.PrivateMessage, ackChannel chan bool, expiry <-chan time.Time) bool {
+    backoff := PRIVATE_RETRANSMIT_INITIAL * time.Second
+    retransmitEnd := time.After(PRIVATE_MESSAGE_EXPIRY * time.Second)
+    idStr := strconv.FormatUint(uint64(pm.ID), 10)
+
+    for {
+        gp := model.GossipPacket{Private: pm}
+        if !g.routePacket(&gp, pm.Destination) {
+            routingLog.Debug("No route to " + pm.Destination + " yet for private message " + idStr)
+        }
+        g.Outbox.countAttempt(pm.ID)
+
+        select {
+            case <-ackChannel:
+                g.setDeliveryState(pm, DELIVERY_DELIVERED)
+                return true
+
+            case <-expiry:
+                g.setDeliveryState(pm, DELIVERY_FAILED)
+                return true
+
+            case <-retransmitEnd:
+                return false
+
+            case <-time.After(backoff):
+                backoff *= 2
+                if backoff > PRIVATE_RETRANSMIT_MAX * time.Second {
+                    backoff = PRIVATE_RETRANSMIT_MAX * time.Second
+                }
+        }
+    }
+}
+
+func (g *Gossiper) setDeliveryState(pm *model.PrivateMessage, state string) {
+    g.Outbox.setState(pm.ID, state)
+    g.Conversations.SetState(pm.Destination, pm.ID, state)
+
+    idStr := strconv.FormatUint(uint64(pm.ID), 10)
+    level := logger.INFO
+    if state == DELIVERY_PENDING {
+        level = logger.DEBUG
+    } else if state == DELIVERY_FAILED {
+        level = logger.WARNING
+    }
+    gossipLog.Event(level, "PRIVATE-" + strings.ToUpper(state), "PRIVATE " + strings.ToUpper(state) + " dest " + pm.Destination + " ID " + idStr, logger.Fields{
+        "dest": pm.Destination,
+        "id": pm.ID,
+    })
+
+    g.Events.Publish(&Event{
+        Type: EVENT_PRIVATE_MESSAGE_STATE,
+        Delivery: &PrivateDeliveryState{
+            ID: pm.ID,
+            Destination: pm.Destination,
+            State: state,
+        },
+    })
+}
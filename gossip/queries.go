@@ -0,0 +1,93 @@
+package gossip
+
+import (
+    "sort"
+    "github.com/pablo11/Peerster/model"
+)
+
+// State of a direct peer, as shown by the client
+type PeerState struct {
+    Address string
+    Score float64
+    Banned bool
+}
+
+// Block of the longest chain, as shown by the client
+type ChainBlock struct {
+    Hash string
+    PrevHash string
+    Filenames []string
+}
+
+func (g *Gossiper) GetPeerStates() []PeerState {
+    peers := g.GetPeers()
+    states := make([]PeerState, len(peers))
+    for i, peer := range peers {
+        states[i] = PeerState{
+            Address: peer,
+            Score: g.Reputation.Score(peer),
+            Banned: g.RateLimiter.IsBanned(peer),
+        }
+    }
+    return states
+}
+
+// Return a copy of the routing table: origin -> next hop address
+func (g *Gossiper) GetRoutes() map[string]string {
+    g.routingTableMutex.Lock()
+    defer g.routingTableMutex.Unlock()
+
+    routes := make(map[string]string)
+    for origin, nextHop := range g.routingTable {
+        routes[origin] = nextHop
+    }
+    return routes
+}
+
+// Return the blocks of the longest chain, from the head, at most limit of them
+// if limit is not 0. The second value is the length of the whole chain
+func (g *Gossiper) GetChain(limit int) ([]ChainBlock, int) {
+    g.blocksMutex.RLock()
+    defer g.blocksMutex.RUnlock()
+
+    blocks := make([]ChainBlock, 0)
+    length := 0
+    currentHash := g.longestChain
+    for {
+        block, isPresent := g.blocks[currentHash]
+        if !isPresent {
+            break
+        }
+
+        length += 1
+        if limit == 0 || len(blocks) < limit {
+            filenames := make([]string, len(block.Transactions))
+            for i, tx := range block.Transactions {
+                filenames[i] = tx.File.Name
+            }
+
+            blocks = append(blocks, ChainBlock{
+                Hash: currentHash,
+                PrevHash: block.PrevHashStr(),
+                Filenames: filenames,
+            })
+        }
+        currentHash = block.PrevHashStr()
+    }
+    return blocks, length
+}
+
+// Return the files registered in the blockchain, ordered by name
+func (g *Gossiper) GetNames() []model.File {
+    g.filesNameMutex.Lock()
+    defer g.filesNameMutex.Unlock()
+
+    files := make([]model.File, 0, len(g.filesName))
+    for _, file := range g.filesName {
+        files = append(files, *file)
+    }
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].Name < files[j].Name
+    })
+    return files
+}
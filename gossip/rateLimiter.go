@@ -0,0 +1,295 @@
+package gossip
+
+import (
+    "sync"
+    "time"
+    "github.com/pablo11/Peerster/model"
+)
+
+const (
+    RATE_LIMIT_BAN_THRESHOLD int = 20 // Number of throttled packets within RATE_LIMIT_OFFENCE_PERIOD before banning the source
+    RATE_LIMIT_OFFENCE_PERIOD time.Duration = 10 // Seconds after which offences are forgotten
+    RATE_LIMIT_BAN_DURATION time.Duration = 60 // Seconds a banned source is ignored
+    RATE_LIMIT_SEARCH_BUDGET_UNIT uint64 = 8 // Every RATE_LIMIT_SEARCH_BUDGET_UNIT of budget costs one more token
+    RATE_LIMIT_ORIGIN_FACTOR float64 = 10 // Origins get buckets this much larger than addresses, relays and anti-entropy send bursts of one origin
+    RATE_LIMIT_PRUNE_PERIOD time.Duration = 30 // Seconds between two evictions of idle buckets and old offences
+)
+
+// Token bucket parameters for a packet class
+type RateLimit struct {
+    // Maximum number of tokens (burst size)
+    Capacity float64
+    // Tokens refilled every second
+    Rate float64
+}
+
+// Default limits per packet class, applied per source address, and
+// RATE_LIMIT_ORIGIN_FACTOR times larger per origin name
+var DEFAULT_RATE_LIMITS = map[string]RateLimit{
+    "simple": RateLimit{Capacity: 50, Rate: 10},
+    "rumor": RateLimit{Capacity: 100, Rate: 20},
+    "status": RateLimit{Capacity: 100, Rate: 20},
+    "private": RateLimit{Capacity: 50, Rate: 10},
+    "privateAck": RateLimit{Capacity: 50, Rate: 10},
+    "mailboxDeposit": RateLimit{Capacity: 20, Rate: 2},
+    "dataRequest": RateLimit{Capacity: 2000, Rate: 1000},
+    "dataReply": RateLimit{Capacity: 2000, Rate: 1000},
+    "searchRequest": RateLimit{Capacity: 20, Rate: 2},
+    "searchReply": RateLimit{Capacity: 50, Rate: 10},
+    "txPublish": RateLimit{Capacity: 20, Rate: 2},
+    "blockPublish": RateLimit{Capacity: 20, Rate: 2},
+}
+
+type tokenBucket struct {
+    tokens float64
+    lastRefill time.Time
+}
+
+type offence struct {
+    count int
+    firstAt time.Time
+}
+
+// Statistics about throttled packets, exposed to the web API
+type RateLimiterStats struct {
+    // Packet class -> number of packets dropped
+    Throttled map[string]uint64
+    // Source address -> ban expiration
+    Banned map[string]time.Time
+    TotalBans uint64
+}
+
+type RateLimiter struct {
+    limits map[string]RateLimit
+
+    // Mapping from class|addr|address or class|origin|name to the corresponding bucket
+    buckets map[string]*tokenBucket
+    lastPrune time.Time
+    bucketsMutex sync.Mutex
+
+    offences map[string]*offence
+    bannedUntil map[string]time.Time
+    throttled map[string]uint64
+    totalBans uint64
+    bansMutex sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+    return &RateLimiter{
+        limits: DEFAULT_RATE_LIMITS,
+        buckets: make(map[string]*tokenBucket),
+        lastPrune: time.Now(),
+        bucketsMutex: sync.Mutex{},
+        offences: make(map[string]*offence),
+        bannedUntil: make(map[string]time.Time),
+        throttled: make(map[string]uint64),
+        totalBans: 0,
+        bansMutex: sync.Mutex{},
+    }
+}
+
+// Returns the packet class, the origin name (empty if the packet has none) and
+// the number of tokens the packet costs
+func classifyPacket(gp *model.GossipPacket) (string, string, float64) {
+    switch {
+        case gp.Simple != nil:
+            return "simple", gp.Simple.OriginalName, 1
+
+        case gp.Rumor != nil:
+            return "rumor", gp.Rumor.Origin, 1
+
+        case gp.Status != nil:
+            return "status", "", 1
+
+        case gp.Private != nil:
+            return "private", gp.Private.Origin, 1
+
+        case gp.PrivateAck != nil:
+            return "privateAck", gp.PrivateAck.Origin, 1
+
+        case gp.MailboxDeposit != nil:
+            return "mailboxDeposit", gp.MailboxDeposit.Origin, 1
+
+        case gp.DataRequest != nil:
+            return "dataRequest", gp.DataRequest.Origin, 1
+
+        case gp.DataReply != nil:
+            return "dataReply", gp.DataReply.Origin, 1
+
+        case gp.SearchRequest != nil:
+            // Requests with a large budget are more expensive since they are propagated further
+            return "searchRequest", gp.SearchRequest.Origin, float64(1 + gp.SearchRequest.Budget / RATE_LIMIT_SEARCH_BUDGET_UNIT)
+
+        case gp.SearchReply != nil:
+            return "searchReply", gp.SearchReply.Origin, 1
+
+        case gp.TxPublish != nil:
+            return "txPublish", "", 1
+
+        case gp.BlockPublish != nil:
+            return "blockPublish", "", 1
+
+        default:
+            return "", "", 0
+    }
+}
+
+// Returns true if the packet received from fromAddr can be processed. Only
+// the sender address is banned: any neighbour can claim the origin of another
+// node, packets over the limit of an origin are only dropped
+func (rl *RateLimiter) Allow(gp *model.GossipPacket, fromAddr string) bool {
+    class, origin, cost := classifyPacket(gp)
+    if class == "" {
+        return true
+    }
+
+    if rl.IsBanned(fromAddr) {
+        rl.countThrottled(class)
+        return false
+    }
+
+    // Both the sender address and the origin must have enough tokens
+    if !rl.take(class, "addr|" + fromAddr, cost, 1) {
+        rl.recordOffence(class, fromAddr)
+        return false
+    }
+    if origin != "" && !rl.take(class, "origin|" + origin, cost, RATE_LIMIT_ORIGIN_FACTOR) {
+        rl.countThrottled(class)
+        return false
+    }
+
+    return true
+}
+
+func (rl *RateLimiter) IsBanned(source string) bool {
+    rl.bansMutex.Lock()
+    defer rl.bansMutex.Unlock()
+
+    until, isBanned := rl.bannedUntil[source]
+    if !isBanned {
+        return false
+    }
+
+    if time.Now().After(until) {
+        delete(rl.bannedUntil, source)
+        gossipLog.Info("UNBANNED " + source)
+        return false
+    }
+    return true
+}
+
+func (rl *RateLimiter) Stats() RateLimiterStats {
+    rl.bansMutex.Lock()
+    defer rl.bansMutex.Unlock()
+
+    stats := RateLimiterStats{
+        Throttled: make(map[string]uint64),
+        Banned: make(map[string]time.Time),
+        TotalBans: rl.totalBans,
+    }
+    for class, count := range rl.throttled {
+        stats.Throttled[class] = count
+    }
+    for source, until := range rl.bannedUntil {
+        if time.Now().Before(until) {
+            stats.Banned[source] = until
+        }
+    }
+    return stats
+}
+
+// Take cost tokens from the bucket of source for the given class, whose limit
+// is multiplied by factor. Returns false if the bucket doesn't have enough tokens
+func (rl *RateLimiter) take(class, source string, cost float64, factor float64) bool {
+    limit := rl.limits[class]
+    capacity := limit.Capacity * factor
+    key := class + "|" + source
+    now := time.Now()
+
+    rl.bucketsMutex.Lock()
+    defer rl.bucketsMutex.Unlock()
+
+    if now.Sub(rl.lastPrune) >= RATE_LIMIT_PRUNE_PERIOD * time.Second {
+        rl.prune(now)
+    }
+
+    bucket, exists := rl.buckets[key]
+    if !exists {
+        bucket = &tokenBucket{
+            tokens: capacity,
+            lastRefill: now,
+        }
+        rl.buckets[key] = bucket
+    }
+
+    // Refill the bucket proportionally to the time elapsed since the last refill
+    bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * limit.Rate * factor
+    if bucket.tokens > capacity {
+        bucket.tokens = capacity
+    }
+    bucket.lastRefill = now
+
+    if bucket.tokens < cost {
+        return false
+    }
+    bucket.tokens -= cost
+    return true
+}
+
+// Forget the buckets that had the time to refill, a new bucket is full, and
+// the offences and bans that expired. Must be called with bucketsMutex locked
+func (rl *RateLimiter) prune(now time.Time) {
+    rl.lastPrune = now
+    for key, bucket := range rl.buckets {
+        if now.Sub(bucket.lastRefill) >= RATE_LIMIT_PRUNE_PERIOD * time.Second {
+            delete(rl.buckets, key)
+        }
+    }
+
+    rl.bansMutex.Lock()
+    defer rl.bansMutex.Unlock()
+
+    for source, o := range rl.offences {
+        if now.Sub(o.firstAt) > RATE_LIMIT_OFFENCE_PERIOD * time.Second {
+            delete(rl.offences, source)
+        }
+    }
+    for source, until := range rl.bannedUntil {
+        if now.After(until) {
+            delete(rl.bannedUntil, source)
+        }
+    }
+}
+
+func (rl *RateLimiter) countThrottled(class string) {
+    rl.bansMutex.Lock()
+    rl.throttled[class] += 1
+    rl.bansMutex.Unlock()
+}
+
+// Keep track of throttled packets of source and ban it if it's a repeat offender
+func (rl *RateLimiter) recordOffence(class, source string) {
+    now := time.Now()
+
+    rl.bansMutex.Lock()
+    defer rl.bansMutex.Unlock()
+
+    rl.throttled[class] += 1
+
+    o, exists := rl.offences[source]
+    if !exists || now.Sub(o.firstAt) > RATE_LIMIT_OFFENCE_PERIOD * time.Second {
+        o = &offence{
+            count: 0,
+            firstAt: now,
+        }
+        rl.offences[source] = o
+    }
+    o.count += 1
+
+    if o.count >= RATE_LIMIT_BAN_THRESHOLD {
+        rl.bannedUntil[source] = now.Add(RATE_LIMIT_BAN_DURATION * time.Second)
+        rl.totalBans += 1
+        delete(rl.offences, source)
+        gossipLog.Warningf("BANNED %s for %d seconds (too many %s packets)", source, RATE_LIMIT_BAN_DURATION, class)
+    }
+}
@@ -0,0 +1,171 @@
+package gossip
+
+import (
+    "sync"
+    "math"
+    "math/rand"
+    "time"
+)
+
+const (
+    REPUTATION_MIN_SCORE float64 = -100
+    REPUTATION_MAX_SCORE float64 = 100
+    REPUTATION_MAX_ENTRIES int = 1024 // Scores kept per key space, peer addresses and origin names
+
+    // Penalties
+    REPUTATION_INVALID_DATA_REPLY float64 = 20
+    REPUTATION_INVALID_BLOCK float64 = 30
+    REPUTATION_FORGED_RUMOR float64 = 50
+    REPUTATION_DATA_REQUEST_TIMEOUT float64 = 5
+
+    // Rewards
+    REPUTATION_SEARCH_REPLY float64 = 2
+    REPUTATION_SEARCH_REPLY_RELAY float64 = 1
+    REPUTATION_DATA_REPLY_MAX float64 = 3 // Reward for a DataReply received immediately, decreasing linearly until TIMEOUT_DATA_REQUEST
+)
+
+// Keep a score for each peer address and each origin name, based on the way
+// they behaved with this node. Addresses and names are kept apart, a name can
+// look like an address
+type Reputation struct {
+    // Peer address -> score
+    peers map[string]float64
+    // Origin name -> score
+    origins map[string]float64
+    scoresMutex sync.Mutex
+}
+
+func NewReputation() *Reputation {
+    return &Reputation{
+        peers: make(map[string]float64),
+        origins: make(map[string]float64),
+        scoresMutex: sync.Mutex{},
+    }
+}
+
+func (r *Reputation) Reward(peer string, amount float64) {
+    r.add(r.peers, peer, amount)
+}
+
+func (r *Reputation) Penalize(peer string, amount float64) {
+    r.add(r.peers, peer, -amount)
+}
+
+func (r *Reputation) RewardOrigin(origin string, amount float64) {
+    r.add(r.origins, origin, amount)
+}
+
+func (r *Reputation) PenalizeOrigin(origin string, amount float64) {
+    r.add(r.origins, origin, -amount)
+}
+
+// Reward origin for a reply received after elapsed, the faster the better
+func (r *Reputation) RewardLatency(origin string, elapsed time.Duration) {
+    timeout := float64(TIMEOUT_DATA_REQUEST * time.Second)
+    reward := REPUTATION_DATA_REPLY_MAX * (1 - float64(elapsed) / timeout)
+    if reward > 0 {
+        r.add(r.origins, origin, reward)
+    }
+}
+
+func (r *Reputation) Score(peer string) float64 {
+    r.scoresMutex.Lock()
+    defer r.scoresMutex.Unlock()
+    return r.peers[peer]
+}
+
+func (r *Reputation) OriginScore(origin string) float64 {
+    r.scoresMutex.Lock()
+    defer r.scoresMutex.Unlock()
+    return r.origins[origin]
+}
+
+// Scores of the peer addresses and of the origin names
+func (r *Reputation) Scores() (map[string]float64, map[string]float64) {
+    r.scoresMutex.Lock()
+    defer r.scoresMutex.Unlock()
+
+    peers := make(map[string]float64)
+    for peer, score := range r.peers {
+        peers[peer] = score
+    }
+    origins := make(map[string]float64)
+    for origin, score := range r.origins {
+        origins[origin] = score
+    }
+    return peers, origins
+}
+
+// Weight used for random selections: always positive so that peers with a bad
+// reputation still have a small chance to be selected and redeem themselves
+func (r *Reputation) Weight(peer string) float64 {
+    return r.Score(peer) - REPUTATION_MIN_SCORE + 1
+}
+
+// Select a random peer among candidates with probability proportional to its weight
+func (r *Reputation) WeightedPick(candidates []string) string {
+    if len(candidates) == 0 {
+        return ""
+    }
+
+    totalWeight := 0.0
+    weights := make([]float64, len(candidates))
+    for i, c := range candidates {
+        weights[i] = r.Weight(c)
+        totalWeight += weights[i]
+    }
+
+    pick := rand.Float64() * totalWeight
+    for i, w := range weights {
+        pick -= w
+        if pick < 0 {
+            return candidates[i]
+        }
+    }
+    return candidates[len(candidates) - 1]
+}
+
+// Return the non-empty origin among candidates with the highest score (the
+// first one in case of equality)
+func (r *Reputation) BestOrigin(candidates []string) string {
+    best := ""
+    bestScore := REPUTATION_MIN_SCORE - 1
+    for _, c := range candidates {
+        if c == "" {
+            continue
+        }
+        if score := r.OriginScore(c); score > bestScore {
+            best = c
+            bestScore = score
+        }
+    }
+    return best
+}
+
+func (r *Reputation) add(scores map[string]float64, key string, amount float64) {
+    if key == "" {
+        return
+    }
+
+    r.scoresMutex.Lock()
+    defer r.scoresMutex.Unlock()
+
+    // Make room by forgetting the score closest to the one of an unknown key
+    if _, isKnown := scores[key]; !isKnown && len(scores) >= REPUTATION_MAX_ENTRIES {
+        forgotten := ""
+        for k, score := range scores {
+            if forgotten == "" || math.Abs(score) < math.Abs(scores[forgotten]) {
+                forgotten = k
+            }
+        }
+        delete(scores, forgotten)
+    }
+
+    score := scores[key] + amount
+    if score > REPUTATION_MAX_SCORE {
+        score = REPUTATION_MAX_SCORE
+    } else if score < REPUTATION_MIN_SCORE {
+        score = REPUTATION_MIN_SCORE
+    }
+    scores[key] = score
+}
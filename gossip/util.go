@@ -1,7 +1,6 @@
 package gossip
 
 import (
-    "fmt"
     "net"
     "crypto/sha256"
 )
@@ -9,7 +8,7 @@ import (
 func resolveAddress(addr string) *net.UDPAddr {
     udpAddr, err := net.ResolveUDPAddr("udp4", addr)
     if err != nil {
-        fmt.Println(err)
+        gossipLog.Error(err.Error())
         return nil
     }
     return udpAddr
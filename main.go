@@ -2,10 +2,13 @@ package main
 
 import (
     "os"
+    "fmt"
     "os/signal"
+    "time"
     "flag"
     "strings"
     "github.com/pablo11/Peerster/gossip"
+    "github.com/pablo11/Peerster/util/logger"
     "github.com/pablo11/Peerster/webserver"
 )
 
@@ -17,9 +20,29 @@ func main() {
     rtimer := flag.Int("rtimer", 0, "Route rumors sending period in seconds, 0 to disable")
     simple := flag.Bool("simple", false, "Run gossiper in simple broadcast mode")
     noGui := flag.Bool("noGUI", false, "If this flag is present, don't run the webserver serving the GUI")
+    logLevel := flag.String("logLevel", "info", "Minimum level of logged events: debug, info, warning or error")
+    logJSON := flag.Bool("logJSON", false, "If this flag is present, log events as JSON objects")
+    guiLocalhost := flag.Bool("guiLocalhost", false, "If this flag is present, the webserver only accepts connections from localhost")
+    guiToken := flag.String("guiToken", "", "Token required to access the webserver (Authorization: Bearer header or ?token= on the first page)")
+    guiPassword := flag.String("guiPassword", "", "Password required to access the webserver with HTTP basic auth")
+    mailboxTTL := flag.Int("mailboxTTL", 3600, "Seconds an undelivered private message is kept and retried when its destination becomes reachable, 0 to disable the mailbox")
+    mailboxVolunteer := flag.Bool("mailboxVolunteer", false, "If this flag is present, keep the private messages of neighbours for unreachable destinations")
+    downloadWindow := flag.Int("downloadWindow", gossip.DOWNLOAD_DEFAULT_WINDOW, "Chunks requested at the same time by each download")
+    sourceWindow := flag.Int("sourceWindow", gossip.DOWNLOAD_DEFAULT_SOURCE_WINDOW, "Chunks requested at the same time to each source, over all the downloads")
+    maxDownloads := flag.Int("maxDownloads", gossip.DOWNLOAD_DEFAULT_MAX_ACTIVE, "Downloads running at the same time, the others are queued")
+    guiTLS := flag.Bool("guiTLS", false, "If this flag is present, serve the GUI over HTTPS with a self-signed certificate")
 
     flag.Parse()
 
+    // Configure logging
+    level, err := logger.ParseLevel(*logLevel)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    logger.SetLevel(level)
+    logger.SetJSON(*logJSON)
+
     // Prepare peers
     peers := strings.Split(*peersParam, ",")
     if *peersParam == "" {
@@ -27,10 +50,21 @@ func main() {
     }
 
     g := gossip.NewGossiper(*gossipAddr, *name, peers, *rtimer, *simple)
+    g.Mailbox.SetTTL(time.Duration(*mailboxTTL) * time.Second)
+    g.Mailbox.SetVolunteer(*mailboxVolunteer)
+    g.FileSharing.SetWindows(*downloadWindow, *sourceWindow)
+    g.FileSharing.SetMaxDownloads(*maxDownloads)
     g.Run(*uiPort)
 
     if !*noGui {
-        go webserver.CreateAndRun(g, *uiPort)
+        config := &webserver.Config{
+            LocalhostOnly: *guiLocalhost,
+            Token: *guiToken,
+            Password: *guiPassword,
+            TLS: *guiTLS,
+            CertDir: "_Certs/" + *name + "/",
+        }
+        go webserver.CreateAndRun(g, *uiPort, config)
     }
 
     // Kill all goroutines before exiting
@@ -1,7 +1,6 @@
 package model
 
 import (
-    "fmt"
     "encoding/binary"
     "crypto/sha256"
     "math/rand"
@@ -44,15 +43,15 @@ func (b *Block) Hash() (out [32]byte) {
     return
 }
 
-func (b *Block) Mine() {
+// Find a nonce making the block valid and return the hex hash of the block.
+// Nothing is printed, the caller logs FOUND-BLOCK with the chain logger
+func (b *Block) Mine() string {
     var nonce [32]byte
     for {
         rand.Read(nonce[:])
         b.Nonce = nonce
         if b.IsValid() {
-            hash := b.Hash()
-            fmt.Println("FOUND-BLOCK " + hex.EncodeToString(hash[:]))
-            return
+            return b.HashStr()
         }
     }
 }
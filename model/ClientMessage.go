@@ -8,6 +8,18 @@ type ClientMessage struct {
     Request string
     Keywords []string
     Budget uint64
+    // If not 0, the gossiper replies with a ClientResponse carrying this ID
+    RequestID uint64
+    // Private message whose delivery state is requested
+    MessageID uint32
+    // Maximum number of elements returned by queries, 0 for the default
+    Limit uint32
+    // Elements skipped by the files and searchResults queries, to page through them
+    Offset uint32
+    // Only messages with a greater Seq are returned, to follow the history
+    SinceSeq uint64
+    // Priority of a download, queued downloads with a higher priority start first
+    Priority int32
 }
 
 func (cm *ClientMessage) String() string {
@@ -0,0 +1,25 @@
+package model
+
+// Status codes of the client responses, with the meaning of the HTTP ones
+const (
+    CLIENT_STATUS_OK uint32 = 200
+    CLIENT_STATUS_ACCEPTED uint32 = 202
+    CLIENT_STATUS_BAD_REQUEST uint32 = 400
+    CLIENT_STATUS_NOT_FOUND uint32 = 404
+    CLIENT_STATUS_ERROR uint32 = 500
+)
+
+// Reply of the gossiper to a ClientMessage with a RequestID
+type ClientResponse struct {
+    // RequestID of the ClientMessage this response answers
+    RequestID uint64
+    Status uint32
+    // Description of the failure when Status is not 2xx
+    Error string
+    // JSON encoded result, its content depends on the request type
+    Payload []byte
+}
+
+func (cr *ClientResponse) IsSuccess() bool {
+    return cr.Status >= 200 && cr.Status < 300
+}
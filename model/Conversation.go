@@ -0,0 +1,26 @@
+package model
+
+import (
+    "time"
+)
+
+// Private messages exchanged with one peer, oldest first
+type Conversation struct {
+    Peer string
+    Messages []*ConversationMessage
+    // Number of received messages not marked as read yet
+    Unread int
+}
+
+type ConversationMessage struct {
+    // Position in the conversation, starting at 1
+    Seq uint64
+    // ID of the private message, 0 if sent by a node not supporting acknowledgements
+    ID uint32
+    Origin string
+    Destination string
+    Text string
+    Timestamp time.Time
+    // Delivery state of the messages sent by this node, empty for received ones
+    State string
+}
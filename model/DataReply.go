@@ -1,6 +1,7 @@
 package model
 
 import (
+    "strconv"
     "crypto/sha256"
     "encoding/hex"
 )
@@ -26,6 +27,6 @@ func (dr *DataReply) String(isMetafile bool, filename string, chunkNb int) strin
     if isMetafile {
         return "DOWNLOADING metafiler of " + filename + " from " + dr.Origin
     } else {
-        return "DOWNLOADING " + filename + " chunk " + string(chunkNb) + " from " + dr.Origin
+        return "DOWNLOADING " + filename + " chunk " + strconv.Itoa(chunkNb) + " from " + dr.Origin
     }
 }
@@ -0,0 +1,23 @@
+package model
+
+// Download in progress saved to disk, to resume it after a restart
+type DownloadState struct {
+    MetaHash string
+    LocalName string
+    Paused bool
+    Priority int
+    // 0 until the root metafile is received
+    NbChunks int
+    // Size of the file, 0 until its last chunk is downloaded
+    Size int64
+    // Bit i is set if chunk number i + 1 was downloaded when the state was saved
+    Chunks []byte
+    Sources []DownloadSourceState
+}
+
+type DownloadSourceState struct {
+    Name string
+    // Offers every chunk, otherwise only the ones set in Chunks
+    HasAll bool
+    Chunks []byte
+}
@@ -1,11 +1,26 @@
 package model
 
+import (
+    "sort"
+    "time"
+)
+
 type FileDownload struct {
     LocalName string
+    // Location of the complete file on disk, empty while downloading. Files
+    // indexed from outside of the shared files directory have an absolute path
+    Path string
+    Size int64
+    // Modification time of the source of an indexed file when it was indexed
+    SourceModTime time.Time
+    // State of the source of an indexed file (SOURCE_OK, SOURCE_CHANGED or
+    // SOURCE_MISSING in package gossip), empty for downloads
+    SourceState string
     MetaHash []byte
-    NextChunkOffset int
-    NextChunkHash string
+    // Chunks downloaded so far, NbChunks for indexed and downloaded files
+    NbChunksDone int
     NbChunks int
+    // Chunk nb - 1 -> node it was downloaded from
     ChunksLocation []string
 }
 
@@ -21,8 +36,44 @@ type FileMatch struct {
     Filename string
     MetaHash string
     NbChunks uint64
-    // Map: chunck nb -> node having it
-    ChunksLocation []string
+    // Every node having chunks of the file -> chunks it has, as pairs of first
+    // and last chunk number
+    Sources map[string][]uint64
+}
+
+// True if every chunk of the file is held by a source
+func (fm *FileMatch) IsComplete() bool {
+    ranges := make([][2]uint64, 0)
+    for _, chunkRanges := range fm.Sources {
+        for i := 0; i + 1 < len(chunkRanges); i += 2 {
+            ranges = append(ranges, [2]uint64{chunkRanges[i], chunkRanges[i + 1]})
+        }
+    }
+    sort.Slice(ranges, func(i, j int) bool {
+        return ranges[i][0] < ranges[j][0]
+    })
+
+    // Chunks up to covered have a source
+    var covered uint64 = 0
+    for _, r := range ranges {
+        if r[0] > covered + 1 {
+            break
+        }
+        if r[1] > covered {
+            covered = r[1]
+        }
+    }
+    return covered >= fm.NbChunks
+}
+
+// Sorted names of the nodes having chunks of the file
+func (fm *FileMatch) SourceNames() []string {
+    names := make([]string, 0, len(fm.Sources))
+    for name, _ := range fm.Sources {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
 }
 
 // For blockchain filename to hash mapping
@@ -11,6 +11,8 @@ type GossipPacket struct {
     SearchReply *SearchReply
     TxPublish *TxPublish
     BlockPublish *BlockPublish
+    PrivateAck *PrivateAck
+    MailboxDeposit *MailboxDeposit
 }
 
 func (gp *GossipPacket) String(mode, relayAddr string) string {
@@ -27,7 +29,66 @@ func (gp *GossipPacket) String(mode, relayAddr string) string {
         case gp.Private != nil:
             return gp.Private.String()
 
+        case gp.PrivateAck != nil:
+            return gp.PrivateAck.String()
+
+        case gp.MailboxDeposit != nil:
+            return gp.MailboxDeposit.String()
+
         default:
             return ""
     }
 }
+
+// Event name and machine-readable fields describing the packet, for logging
+func (gp *GossipPacket) Fields(mode, relayAddr string) (string, map[string]interface{}) {
+    switch {
+        case gp.Simple != nil:
+            return "SIMPLE", map[string]interface{}{
+                "origin": gp.Simple.OriginalName,
+                "from": gp.Simple.RelayPeerAddr,
+                "contents": gp.Simple.Contents,
+            }
+
+        case gp.Rumor != nil:
+            if mode == "mongering" {
+                return "MONGERING", map[string]interface{}{"peer": relayAddr}
+            }
+            return "RUMOR", map[string]interface{}{
+                "origin": gp.Rumor.Origin,
+                "from": relayAddr,
+                "id": gp.Rumor.ID,
+                "contents": gp.Rumor.Text,
+            }
+
+        case gp.Status != nil:
+            return "STATUS", map[string]interface{}{
+                "from": relayAddr,
+                "want": gp.Status.Want,
+            }
+
+        case gp.Private != nil:
+            return "PRIVATE", map[string]interface{}{
+                "origin": gp.Private.Origin,
+                "id": gp.Private.ID,
+                "hopLimit": gp.Private.HopLimit,
+                "contents": gp.Private.Text,
+            }
+
+        case gp.PrivateAck != nil:
+            return "PRIVATE-ACK", map[string]interface{}{
+                "origin": gp.PrivateAck.Origin,
+                "id": gp.PrivateAck.ID,
+            }
+
+        case gp.MailboxDeposit != nil:
+            return "MAILBOX-DEPOSIT", map[string]interface{}{
+                "origin": gp.MailboxDeposit.Origin,
+                "dest": gp.MailboxDeposit.Destination(),
+                "ttl": gp.MailboxDeposit.TTL,
+            }
+
+        default:
+            return "", nil
+    }
+}
@@ -0,0 +1,27 @@
+package model
+
+import (
+    "strconv"
+)
+
+// Private message left by Origin to the neighbours volunteering to deliver it
+// when its destination becomes reachable
+type MailboxDeposit struct {
+    Origin string
+    Message *PrivateMessage
+    // Seconds during which the message must be kept
+    TTL uint32
+}
+
+// Destination of the deposited message, empty if the deposit is malformed
+func (md *MailboxDeposit) Destination() string {
+    if md.Message == nil {
+        return ""
+    }
+    return md.Message.Destination
+}
+
+func (md *MailboxDeposit) String() string {
+    ttlStr := strconv.FormatUint(uint64(md.TTL), 10)
+    return "MAILBOX DEPOSIT origin " + md.Origin + " dest " + md.Destination() + " ttl " + ttlStr
+}
@@ -0,0 +1,30 @@
+package model
+
+import (
+    "strconv"
+)
+
+// Sent back by the destination of a private message to its origin
+type PrivateAck struct {
+    // Node acknowledging the message, the destination of the private message
+    Origin string
+    // Origin of the private message
+    Destination string
+    // ID of the acknowledged private message
+    ID uint32
+    HopLimit uint32
+}
+
+func NewPrivateAck(pm *PrivateMessage) *PrivateAck {
+    return &PrivateAck{
+        Origin: pm.Destination,
+        Destination: pm.Origin,
+        ID: pm.ID,
+        HopLimit: 10,
+    }
+}
+
+func (pa *PrivateAck) String() string {
+    idStr := strconv.FormatUint(uint64(pa.ID), 10)
+    return "PRIVATE ACK origin " + pa.Origin + " ID " + idStr
+}
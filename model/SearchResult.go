@@ -5,4 +5,34 @@ type SearchResult struct {
      MetafileHash []byte
      ChunkMap []uint64
      ChunkCount uint64
+     // Chunks held as pairs of first and last chunk number, used instead of
+     // ChunkMap for files whose chunk list wouldn't fit in a packet
+     ChunkRanges []uint64
+}
+
+// Chunks listed in ChunkMap and ChunkRanges as pairs of first and last chunk
+// number, limited to the chunks from 1 to ChunkCount. The ranges are never
+// expanded, a single pair can cover every chunk of a file
+func (sr *SearchResult) Ranges() []uint64 {
+    ranges := make([]uint64, 0, 2 * len(sr.ChunkMap) + len(sr.ChunkRanges))
+    for _, chunkNb := range sr.ChunkMap {
+        if chunkNb >= 1 && chunkNb <= sr.ChunkCount {
+            ranges = append(ranges, chunkNb, chunkNb)
+        }
+    }
+
+    for i := 0; i + 1 < len(sr.ChunkRanges); i += 2 {
+        first := sr.ChunkRanges[i]
+        last := sr.ChunkRanges[i + 1]
+        if first < 1 {
+            first = 1
+        }
+        if last > sr.ChunkCount {
+            last = sr.ChunkCount
+        }
+        if first <= last {
+            ranges = append(ranges, first, last)
+        }
+    }
+    return ranges
 }
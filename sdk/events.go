@@ -0,0 +1,114 @@
+package sdk
+
+import (
+    "sync"
+    "bufio"
+    "strings"
+    "encoding/json"
+)
+
+// Types of the events streamed by the webserver
+const (
+    EVENT_RUMOR_DELIVERED = "rumorDelivered"
+    EVENT_PRIVATE_MESSAGE_RECEIVED = "privateMessageReceived"
+    EVENT_PRIVATE_MESSAGE_STATE = "privateMessageState"
+    EVENT_CHUNK_DOWNLOADED = "chunkDownloaded"
+    EVENT_FILE_RECONSTRUCTED = "fileReconstructed"
+    EVENT_FILE_SOURCE_CHANGED = "fileSourceChanged"
+    EVENT_SEARCH_MATCH = "searchMatch"
+    EVENT_BLOCK_ACCEPTED = "blockAccepted"
+)
+
+const EVENT_MAX_LINE_LEN int = 1 << 20 // Longest line of the event stream, larger events end the subscription (1MB)
+
+// Event emitted by the node. Data is a JSON object whose fields depend on Type
+type Event struct {
+    Type string
+    Data json.RawMessage
+}
+
+// Decode the data of the event in v
+func (e *Event) Decode(v interface{}) error {
+    return json.Unmarshal(e.Data, v)
+}
+
+// Stream of the events of a node, C is closed when the connection ends
+type Subscription struct {
+    C <-chan Event
+    // Error that ended the stream, nil if it was closed with Close. Only read it once C is closed
+    Err error
+    done chan bool
+    closeOnce sync.Once
+}
+
+// Stop receiving events
+func (s *Subscription) Close() {
+    s.closeOnce.Do(func() {
+        close(s.done)
+    })
+}
+
+// Subscribe to the events of the node (server-sent events of /api/v2/events)
+func (c *WebClient) Subscribe() (*Subscription, error) {
+    response, err := c.request("GET", "/events", "", nil)
+    if err != nil {
+        return nil, err
+    }
+
+    events := make(chan Event)
+    sub := &Subscription{
+        C: events,
+        Err: nil,
+        done: make(chan bool),
+        closeOnce: sync.Once{},
+    }
+
+    // Closing the body unblocks the scanner
+    go func() {
+        <-sub.done
+        response.Body.Close()
+    }()
+
+    go func() {
+        defer close(events)
+        defer sub.Close()
+
+        scanner := bufio.NewScanner(response.Body)
+        scanner.Buffer(make([]byte, 64 * 1024), EVENT_MAX_LINE_LEN)
+        event := Event{}
+        data := make([]string, 0)
+        for scanner.Scan() {
+            line := scanner.Text()
+            switch {
+                // A blank line ends the event
+                case line == "":
+                    if event.Type != "" {
+                        event.Data = json.RawMessage(strings.Join(data, "\n"))
+                        select {
+                            case events <- event:
+                            case <-sub.done:
+                                return
+                        }
+                    }
+                    event = Event{}
+                    data = data[:0]
+
+                // Keepalive comment
+                case strings.HasPrefix(line, ":"):
+
+                case strings.HasPrefix(line, "event:"):
+                    event.Type = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+
+                case strings.HasPrefix(line, "data:"):
+                    data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+            }
+        }
+        select {
+            case <-sub.done:
+            default:
+                sub.Err = scanner.Err()
+        }
+    }()
+
+    return sub, nil
+}
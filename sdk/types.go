@@ -0,0 +1,193 @@
+/* Package sdk drives a Peerster node from Go programs, either through the
+   UI port (UIClient) or through the web API (WebClient). Both clients return
+   the typed results below and fail with an *Error when the node refuses a
+   request */
+package sdk
+
+import (
+    "fmt"
+    "time"
+    "errors"
+)
+
+// Delivery states of a private message
+const (
+    DELIVERY_PENDING = "pending"
+    // Not acknowledged, waiting in the mailbox for a route to the destination
+    DELIVERY_QUEUED = "queued"
+    DELIVERY_DELIVERED = "delivered"
+    DELIVERY_FAILED = "failed"
+)
+
+// States of the files known to a node
+const (
+    FILE_SHARED = "shared"
+    FILE_DOWNLOADED = "downloaded"
+    FILE_DOWNLOADING = "downloading"
+)
+
+// States of the indexing of a file
+const (
+    INDEX_RUNNING = "indexing"
+    INDEX_DONE = "indexed"
+    INDEX_FAILED = "failed"
+)
+
+// States of the source of a shared file
+const (
+    SOURCE_OK = "ok"
+    // Modified since it was indexed, the new content has another metahash
+    SOURCE_CHANGED = "changed"
+    SOURCE_MISSING = "missing"
+)
+
+// Returned when the node doesn't answer before the timeout of the client
+var ErrNoResponse = errors.New("no response from the gossiper")
+
+// Request refused by the node. Status has the meaning of the HTTP status codes
+type Error struct {
+    Status int
+    Message string
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("%s (status %d)", e.Message, e.Status)
+}
+
+// True if err is an *Error with the given status
+func HasStatus(err error, status int) bool {
+    sdkErr, isSdkErr := err.(*Error)
+    return isSdkErr && sdkErr.Status == status
+}
+
+type Identity struct {
+    Name string `json:"name"`
+    Address string `json:"address"`
+    // Only set by UIClient
+    Peers int `json:"peers"`
+    Origins int `json:"origins"`
+    Simple bool `json:"simple"`
+}
+
+type Peer struct {
+    Address string `json:"address"`
+    Score float64 `json:"score"`
+    Banned bool `json:"banned"`
+}
+
+type Route struct {
+    Origin string `json:"origin"`
+    NextHop string `json:"nextHop"`
+}
+
+// Rumor, private or simple message of the history of a node
+type Message struct {
+    // Position in the history of the node, pass it as sinceSeq to get the next messages
+    Seq uint64 `json:"seq"`
+    Type string `json:"type"`
+    Origin string `json:"origin"`
+    Destination string `json:"destination,omitempty"`
+    ID uint32 `json:"id"`
+    Text string `json:"text"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// Delivery state of a private message sent by the node
+type Delivery struct {
+    ID uint32 `json:"id"`
+    Destination string `json:"destination"`
+    // DELIVERY_PENDING, DELIVERY_QUEUED, DELIVERY_DELIVERED or DELIVERY_FAILED
+    State string `json:"state"`
+    Attempts int `json:"attempts"`
+}
+
+type File struct {
+    Name string `json:"name"`
+    MetaHash string `json:"metahash"`
+    Size int64 `json:"size"`
+    // FILE_SHARED, FILE_DOWNLOADED or FILE_DOWNLOADING
+    State string `json:"state"`
+    // Location on the disk of the node, only set by UIClient
+    Path string `json:"path,omitempty"`
+    // SOURCE_OK, SOURCE_CHANGED or SOURCE_MISSING for shared files
+    SourceState string `json:"sourceState,omitempty"`
+    // Chunks downloaded so far, only set by UIClient
+    Chunks int `json:"chunks"`
+    NbChunks int `json:"nbChunks"`
+}
+
+// Fraction of the file downloaded, between 0 and 1
+func (f *File) Progress() float64 {
+    if f.State != FILE_DOWNLOADING {
+        return 1
+    }
+    if f.NbChunks == 0 {
+        return 0
+    }
+    return float64(f.Chunks) / float64(f.NbChunks)
+}
+
+// States of a download
+const (
+    DOWNLOAD_QUEUED = "queued"
+    DOWNLOAD_RUNNING = "running"
+    DOWNLOAD_PAUSED = "paused"
+)
+
+type Download struct {
+    Name string `json:"name"`
+    MetaHash string `json:"metahash"`
+    // DOWNLOAD_QUEUED, DOWNLOAD_RUNNING or DOWNLOAD_PAUSED
+    State string `json:"state"`
+    // Queued downloads with a higher priority start first
+    Priority int `json:"priority"`
+    Chunks int `json:"chunks"`
+    // 0 until the metafile is downloaded
+    NbChunks int `json:"nbChunks"`
+    Bytes int64 `json:"bytes"`
+    BytesPerSecond float64 `json:"bytesPerSecond"`
+    Sources []DownloadSource `json:"sources"`
+}
+
+type DownloadSource struct {
+    Name string `json:"name"`
+    // Offers every chunk, otherwise NbChunks of them
+    HasAll bool `json:"hasAll"`
+    NbChunks int `json:"nbChunks"`
+    // Chunks received from this source
+    Downloaded int `json:"downloaded"`
+    // Requests waiting for an answer of this source
+    Pending int `json:"pending"`
+    // Consecutive timeouts
+    Failures int `json:"failures"`
+    // Only used for the chunks no other source offers
+    Abandoned bool `json:"abandoned"`
+}
+
+// File of which every chunk has a known location
+type SearchResult struct {
+    Filename string `json:"filename"`
+    MetaHash string `json:"metahash"`
+    NbChunks uint64 `json:"nbChunks"`
+    // Origins having chunks of the file
+    Sources []string `json:"sources"`
+}
+
+type Block struct {
+    Hash string `json:"hash"`
+    PrevHash string `json:"prevHash"`
+    Filenames []string `json:"filenames"`
+}
+
+// Most recent blocks of the longest chain, newest first
+type Chain struct {
+    Length int `json:"length"`
+    Blocks []Block `json:"blocks"`
+}
+
+// Name registered in the blockchain
+type Name struct {
+    Name string `json:"name"`
+    Size int64 `json:"size"`
+    MetaHash string `json:"metahash"`
+}
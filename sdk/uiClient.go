@@ -0,0 +1,326 @@
+package sdk
+
+import (
+    "net"
+    "time"
+    "math/rand"
+    "encoding/json"
+    "github.com/dedis/protobuf"
+    "github.com/pablo11/Peerster/model"
+)
+
+const (
+    UI_RESPONSE_TIMEOUT time.Duration = 5 // Seconds to wait for the response of the gossiper
+    UI_RESPONSE_BUFFER_LEN int = 65536
+    UI_PAGE_LEN uint32 = 50 // Files or search results asked per request when listing all of them
+    UI_INDEX_POLL_PERIOD time.Duration = 200 // Milliseconds between two requests of the state of an indexing
+)
+
+// Client of the UI port of a node: the UDP protocol of model.ClientMessage
+// and model.ClientResponse
+type UIClient struct {
+    // ip:port of the UI port
+    Address string
+    Timeout time.Duration
+}
+
+// Client of the node whose UI port is uiPort on this machine
+func NewUIClient(uiPort string) *UIClient {
+    return &UIClient{
+        Address: "127.0.0.1:" + uiPort,
+        Timeout: UI_RESPONSE_TIMEOUT * time.Second,
+    }
+}
+
+// Send a rumor and return its ID
+func (c *UIClient) SendMessage(text string) (uint32, error) {
+    result := struct {
+        ID uint32 `json:"id"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "msg", Text: text}, &result)
+    return result.ID, err
+}
+
+// Send a private message and return its ID, to follow its delivery with MessageStatus
+func (c *UIClient) SendPrivateMessage(dest string, text string) (uint32, error) {
+    result := Delivery{}
+    err := c.Do(&model.ClientMessage{Type: "msg", Text: text, Dest: dest}, &result)
+    return result.ID, err
+}
+
+// Delivery state of a private message sent by the node
+func (c *UIClient) MessageStatus(id uint32) (Delivery, error) {
+    result := Delivery{}
+    err := c.Do(&model.ClientMessage{Type: "messageStatus", MessageID: id}, &result)
+    return result, err
+}
+
+// Poll the delivery state of the private message id until it is not pending
+func (c *UIClient) WaitDelivery(id uint32, period time.Duration) (Delivery, error) {
+    for {
+        delivery, err := c.MessageStatus(id)
+        if err != nil || delivery.State != DELIVERY_PENDING {
+            return delivery, err
+        }
+        time.Sleep(period)
+    }
+}
+
+// Index a file and return its metahash. filename is either an absolute path
+// or relative to the shared files directory of the node. The node indexes it
+// in the background, its state is polled until the indexing ends
+func (c *UIClient) IndexFile(filename string) (string, error) {
+    result := struct {
+        State string `json:"state"`
+        MetaHash string `json:"metahash"`
+        Error string `json:"error"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "indexFile", File: filename}, &result)
+    for err == nil && result.State == INDEX_RUNNING {
+        time.Sleep(UI_INDEX_POLL_PERIOD * time.Millisecond)
+        err = c.Do(&model.ClientMessage{Type: "indexStatus", File: filename}, &result)
+    }
+    if err != nil {
+        return "", err
+    }
+
+    if result.State == INDEX_FAILED {
+        return "", &Error{
+            Status: int(model.CLIENT_STATUS_BAD_REQUEST),
+            Message: result.Error,
+        }
+    }
+    return result.MetaHash, nil
+}
+
+// Start the download of a file, from dest or from the sources found by a
+// search if dest is empty
+func (c *UIClient) DownloadFile(filename string, metahash string, dest string) error {
+    return c.DownloadFileWithPriority(filename, metahash, dest, 0)
+}
+
+// Start the download of a file like DownloadFile. If too many downloads are
+// running, queued downloads with a higher priority start first
+func (c *UIClient) DownloadFileWithPriority(filename string, metahash string, dest string, priority int) error {
+    return c.Do(&model.ClientMessage{
+        Type: "downloadFile",
+        File: filename,
+        Request: metahash,
+        Dest: dest,
+        Priority: int32(priority),
+    }, nil)
+}
+
+// Downloads of the node: running ones, then queued ones in the order they
+// will start, then paused ones
+func (c *UIClient) Downloads() ([]Download, error) {
+    result := struct {
+        Downloads []Download `json:"downloads"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "downloads"}, &result)
+    return result.Downloads, err
+}
+
+// Stop requesting chunks of a download until it is resumed
+func (c *UIClient) PauseDownload(metahash string) error {
+    return c.Do(&model.ClientMessage{Type: "pauseDownload", Request: metahash}, nil)
+}
+
+// Stop a download and forget it
+func (c *UIClient) CancelDownload(metahash string) error {
+    return c.Do(&model.ClientMessage{Type: "cancelDownload", Request: metahash}, nil)
+}
+
+func (c *UIClient) SetDownloadPriority(metahash string, priority int) error {
+    return c.Do(&model.ClientMessage{
+        Type: "downloadPriority",
+        Request: metahash,
+        Priority: int32(priority),
+    }, nil)
+}
+
+// Resume a paused download or a download interrupted by a restart of the
+// node, or retry at once the requests of a running download
+func (c *UIClient) ResumeDownload(metahash string) error {
+    return c.Do(&model.ClientMessage{
+        Type: "resumeDownload",
+        Request: metahash,
+    }, nil)
+}
+
+// Start a search, with an expanding budget if budget is 0. Matches are
+// returned by SearchResults
+func (c *UIClient) Search(keywords []string, budget uint64) error {
+    return c.Do(&model.ClientMessage{
+        Type: "searchFile",
+        Keywords: keywords,
+        Budget: budget,
+    }, nil)
+}
+
+func (c *UIClient) Identity() (Identity, error) {
+    result := Identity{}
+    err := c.Do(&model.ClientMessage{Type: "id"}, &result)
+    return result, err
+}
+
+func (c *UIClient) Peers() ([]Peer, error) {
+    result := struct {
+        Peers []Peer `json:"peers"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "peers"}, &result)
+    return result.Peers, err
+}
+
+func (c *UIClient) Routes() ([]Route, error) {
+    result := struct {
+        Routes []Route `json:"routes"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "routes"}, &result)
+    return result.Routes, err
+}
+
+// The messages following sinceSeq, or the most recent ones if sinceSeq is 0,
+// oldest first. A limit of 0 uses the default of the node
+func (c *UIClient) Messages(limit uint32, sinceSeq uint64) ([]Message, error) {
+    result := struct {
+        Messages []Message `json:"messages"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "messages", Limit: limit, SinceSeq: sinceSeq}, &result)
+    return result.Messages, err
+}
+
+// Files shared, downloaded and being downloaded by the node, by name
+func (c *UIClient) Files() ([]File, error) {
+    files := make([]File, 0)
+    for {
+        page, total, err := c.FilesPage(UI_PAGE_LEN, uint32(len(files)))
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, page...)
+        if len(page) == 0 || len(files) >= total {
+            return files, nil
+        }
+    }
+}
+
+// At most limit files from offset, by name, and the number of files. A limit
+// of 0 uses the default of the node
+func (c *UIClient) FilesPage(limit uint32, offset uint32) ([]File, int, error) {
+    result := struct {
+        Files []File `json:"files"`
+        Total int `json:"total"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "files", Limit: limit, Offset: offset}, &result)
+    return result.Files, result.Total, err
+}
+
+// Files fully matched by the searches of the node, by name
+func (c *UIClient) SearchResults() ([]SearchResult, error) {
+    results := make([]SearchResult, 0)
+    for {
+        page, total, err := c.SearchResultsPage(UI_PAGE_LEN, uint32(len(results)))
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, page...)
+        if len(page) == 0 || len(results) >= total {
+            return results, nil
+        }
+    }
+}
+
+// At most limit search results from offset, by name, and the number of
+// results. A limit of 0 uses the default of the node
+func (c *UIClient) SearchResultsPage(limit uint32, offset uint32) ([]SearchResult, int, error) {
+    result := struct {
+        Results []SearchResult `json:"results"`
+        Total int `json:"total"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "searchResults", Limit: limit, Offset: offset}, &result)
+    return result.Results, result.Total, err
+}
+
+// The longest chain, with at most limit blocks. A limit of 0 uses the default of the node
+func (c *UIClient) Chain(limit uint32) (Chain, error) {
+    result := Chain{}
+    err := c.Do(&model.ClientMessage{Type: "chain", Limit: limit}, &result)
+    return result, err
+}
+
+func (c *UIClient) Names() ([]Name, error) {
+    result := struct {
+        Names []Name `json:"names"`
+    }{}
+    err := c.Do(&model.ClientMessage{Type: "names"}, &result)
+    return result.Names, err
+}
+
+// Send cm to the node and decode the payload of its response in result,
+// which can be nil
+func (c *UIClient) Do(cm *model.ClientMessage, result interface{}) error {
+    response, err := c.exchange(cm)
+    if err != nil {
+        return err
+    }
+
+    if !response.IsSuccess() {
+        return &Error{
+            Status: int(response.Status),
+            Message: response.Error,
+        }
+    }
+
+    if result != nil && len(response.Payload) > 0 {
+        if err := json.Unmarshal(response.Payload, result); err != nil {
+            return &Error{
+                Status: int(model.CLIENT_STATUS_ERROR),
+                Message: "invalid response: " + err.Error(),
+            }
+        }
+    }
+    return nil
+}
+
+func (c *UIClient) exchange(cm *model.ClientMessage) (*model.ClientResponse, error) {
+    cm.RequestID = rand.Uint64() | 1
+
+    packetBytes, err := protobuf.Encode(cm)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, err := net.Dial("udp", c.Address)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    if _, err = conn.Write(packetBytes); err != nil {
+        return nil, err
+    }
+
+    buffer := make([]byte, UI_RESPONSE_BUFFER_LEN)
+    deadline := time.Now().Add(c.Timeout)
+    for {
+        conn.SetReadDeadline(deadline)
+        bytesRead, err := conn.Read(buffer)
+        if err != nil {
+            if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+                return nil, ErrNoResponse
+            }
+            return nil, err
+        }
+
+        response := model.ClientResponse{}
+        if err := protobuf.Decode(buffer[:bytesRead], &response); err != nil {
+            continue
+        }
+
+        // Ignore late responses to other requests
+        if response.RequestID == cm.RequestID {
+            return &response, nil
+        }
+    }
+}
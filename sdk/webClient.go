@@ -0,0 +1,373 @@
+package sdk
+
+import (
+    "os"
+    "io"
+    "bytes"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "path/filepath"
+    "mime/multipart"
+)
+
+// Client of the /api/v2 routes of the webserver of a node
+type WebClient struct {
+    // Address of the webserver, like http://127.0.0.1:8080
+    BaseURL string
+    // Value of -guiToken, sent as bearer token
+    Token string
+    // Value of -guiPassword, sent with HTTP basic auth
+    Password string
+    // Replace it to trust the self-signed certificate of a node started with -guiTLS
+    HTTPClient *http.Client
+}
+
+func NewWebClient(baseURL string) *WebClient {
+    return &WebClient{
+        BaseURL: strings.TrimSuffix(baseURL, "/"),
+        Token: "",
+        Password: "",
+        HTTPClient: &http.Client{},
+    }
+}
+
+// Filters of WebClient.Messages. Zero values disable the corresponding filter
+type MessagesQuery struct {
+    SinceSeq uint64
+    BeforeSeq uint64
+    Limit int
+    Descending bool
+    Origin string
+    // "rumor", "private" or "simple"
+    Type string
+    // Unix timestamps in seconds
+    From int64
+    To int64
+    // Every word must appear in the text
+    Text string
+}
+
+func (c *WebClient) Identity() (Identity, error) {
+    result := Identity{}
+    err := c.do("GET", "/id", nil, &result)
+    return result, err
+}
+
+// Send a rumor
+func (c *WebClient) SendMessage(text string) error {
+    return c.do("POST", "/messages", map[string]interface{}{"text": text}, nil)
+}
+
+// Send a private message and return its ID, to follow its delivery with MessageStatus
+func (c *WebClient) SendPrivateMessage(dest string, text string) (uint32, error) {
+    result := Delivery{}
+    err := c.do("POST", "/messages", map[string]interface{}{"text": text, "dest": dest}, &result)
+    return result.ID, err
+}
+
+// Delivery state of a private message sent by the node
+func (c *WebClient) MessageStatus(id uint32) (Delivery, error) {
+    result := Delivery{}
+    err := c.do("GET", "/messages/private/" + strconv.FormatUint(uint64(id), 10), nil, &result)
+    return result, err
+}
+
+// Messages of the history matching q, and the cursor of the next page (0 on
+// the last page) to pass as SinceSeq, or BeforeSeq when Descending
+func (c *WebClient) Messages(q MessagesQuery) ([]Message, uint64, error) {
+    params := url.Values{}
+    if q.SinceSeq > 0 {
+        params.Set("since", strconv.FormatUint(q.SinceSeq, 10))
+    }
+    if q.BeforeSeq > 0 {
+        params.Set("before", strconv.FormatUint(q.BeforeSeq, 10))
+    }
+    if q.Limit > 0 {
+        params.Set("limit", strconv.Itoa(q.Limit))
+    }
+    if q.Descending {
+        params.Set("order", "desc")
+    }
+    if q.Origin != "" {
+        params.Set("origin", q.Origin)
+    }
+    if q.Type != "" {
+        params.Set("type", q.Type)
+    }
+    if q.From > 0 {
+        params.Set("from", strconv.FormatInt(q.From, 10))
+    }
+    if q.To > 0 {
+        params.Set("to", strconv.FormatInt(q.To, 10))
+    }
+    if q.Text != "" {
+        params.Set("q", q.Text)
+    }
+
+    result := struct {
+        Messages []Message `json:"messages"`
+        NextCursor uint64 `json:"nextCursor"`
+    }{}
+    err := c.do("GET", "/messages?" + params.Encode(), nil, &result)
+    return result.Messages, result.NextCursor, err
+}
+
+// Addresses of the direct peers
+func (c *WebClient) Peers() ([]string, error) {
+    result := struct {
+        Peers []string `json:"peers"`
+    }{}
+    err := c.do("GET", "/peers", nil, &result)
+    return result.Peers, err
+}
+
+// Add a direct peer of the form ip:port
+func (c *WebClient) AddPeer(address string) error {
+    return c.do("POST", "/peers", map[string]interface{}{"peer": address}, nil)
+}
+
+// Names of the known origins
+func (c *WebClient) Origins() ([]string, error) {
+    result := struct {
+        Origins []string `json:"origins"`
+    }{}
+    err := c.do("GET", "/origins", nil, &result)
+    return result.Origins, err
+}
+
+// Files shared and downloaded by the node
+func (c *WebClient) Files() ([]File, error) {
+    result := struct {
+        Files []struct {
+            ID string `json:"id"`
+            Name string `json:"name"`
+            Size int64 `json:"size"`
+            Source string `json:"source"`
+            SourceState string `json:"sourceState"`
+        } `json:"files"`
+    }{}
+    if err := c.do("GET", "/files", nil, &result); err != nil {
+        return nil, err
+    }
+
+    files := make([]File, len(result.Files))
+    for i, f := range result.Files {
+        files[i] = File{
+            Name: f.Name,
+            MetaHash: f.ID,
+            Size: f.Size,
+            State: f.Source,
+            SourceState: f.SourceState,
+        }
+    }
+    return files, nil
+}
+
+// Upload a local file to the shared files directory of the node, which
+// indexes it in the background
+func (c *WebClient) UploadFile(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    body := bytes.Buffer{}
+    writer := multipart.NewWriter(&body)
+    part, err := writer.CreateFormFile("file", filepath.Base(path))
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(part, f); err != nil {
+        return err
+    }
+    if err := writer.Close(); err != nil {
+        return err
+    }
+
+    return c.send("POST", "/files", writer.FormDataContentType(), &body, nil)
+}
+
+// Write the content of a file shared or downloaded by the node to w
+func (c *WebClient) FetchFile(metahash string, w io.Writer) error {
+    response, err := c.request("GET", "/files/" + url.PathEscape(metahash), "", nil)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    _, err = io.Copy(w, response.Body)
+    return err
+}
+
+// Start the download of a file, from dest or from the sources found by a
+// search if dest is empty
+func (c *WebClient) DownloadFile(filename string, metahash string, dest string) error {
+    return c.DownloadFileWithPriority(filename, metahash, dest, 0)
+}
+
+// Start the download of a file like DownloadFile. If too many downloads are
+// running, queued downloads with a higher priority start first
+func (c *WebClient) DownloadFileWithPriority(filename string, metahash string, dest string, priority int) error {
+    return c.do("POST", "/downloads", map[string]interface{}{
+        "filename": filename,
+        "metahash": metahash,
+        "dest": dest,
+        "priority": priority,
+    }, nil)
+}
+
+// Downloads of the node: running ones, then queued ones in the order they
+// will start, then paused ones
+func (c *WebClient) Downloads() ([]Download, error) {
+    result := struct {
+        Downloads []struct {
+            ID string `json:"id"`
+            Download
+        } `json:"downloads"`
+    }{}
+    if err := c.do("GET", "/downloads", nil, &result); err != nil {
+        return nil, err
+    }
+
+    downloads := make([]Download, len(result.Downloads))
+    for i, d := range result.Downloads {
+        downloads[i] = d.Download
+        downloads[i].MetaHash = d.ID
+    }
+    return downloads, nil
+}
+
+// Stop requesting chunks of a download until it is resumed
+func (c *WebClient) PauseDownload(metahash string) error {
+    return c.do("POST", "/downloads/" + url.PathEscape(metahash) + "/pause", nil, nil)
+}
+
+// Resume a paused download or a download interrupted by a restart of the
+// node, or retry at once the requests of a running download
+func (c *WebClient) ResumeDownload(metahash string) error {
+    return c.do("POST", "/downloads/" + url.PathEscape(metahash) + "/resume", nil, nil)
+}
+
+// Stop a download and forget it
+func (c *WebClient) CancelDownload(metahash string) error {
+    return c.do("DELETE", "/downloads/" + url.PathEscape(metahash), nil, nil)
+}
+
+func (c *WebClient) SetDownloadPriority(metahash string, priority int) error {
+    return c.do("POST", "/downloads/" + url.PathEscape(metahash) + "/priority", map[string]interface{}{
+        "priority": priority,
+    }, nil)
+}
+
+// Start a search, with an expanding budget if budget is 0. Matches are
+// returned by SearchResults and streamed as searchMatch events
+func (c *WebClient) Search(keywords []string, budget uint64) error {
+    return c.do("POST", "/searches", map[string]interface{}{
+        "keywords": keywords,
+        "budget": budget,
+    }, nil)
+}
+
+// Files fully matched by the searches of the node
+func (c *WebClient) SearchResults() ([]SearchResult, error) {
+    result := struct {
+        Results []SearchResult `json:"results"`
+    }{}
+    err := c.do("GET", "/searches/results", nil, &result)
+    return result.Results, err
+}
+
+// Send a JSON request and decode the JSON response in result, which can be nil
+func (c *WebClient) do(method string, path string, body interface{}, result interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        encoded, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(encoded)
+    }
+    return c.send(method, path, "application/json", reader, result)
+}
+
+func (c *WebClient) send(method string, path string, contentType string, body io.Reader, result interface{}) error {
+    response, err := c.request(method, path, contentType, body)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+
+    if result == nil {
+        return nil
+    }
+    if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+        return &Error{
+            Status: response.StatusCode,
+            Message: "invalid response: " + err.Error(),
+        }
+    }
+    return nil
+}
+
+// Send the request and return the response if its status is 2xx. The caller
+// must close the body of the response
+func (c *WebClient) request(method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+    req, err := http.NewRequest(method, c.BaseURL + "/api/v2" + path, body)
+    if err != nil {
+        return nil, err
+    }
+
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    if c.Token != "" {
+        req.Header.Set("Authorization", "Bearer " + c.Token)
+    }
+    if c.Password != "" {
+        req.SetBasicAuth("sdk", c.Password)
+    }
+    if contentType != "application/json" && c.Token == "" {
+        // Form requests must repeat the CSRF cookie in a header, any value works
+        // for a client that is not a browser
+        csrfToken := randomToken()
+        req.AddCookie(&http.Cookie{Name: "peerster_csrf", Value: csrfToken})
+        req.Header.Set("X-CSRF-Token", csrfToken)
+    }
+
+    response, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if response.StatusCode < 200 || response.StatusCode >= 300 {
+        defer response.Body.Close()
+        errorBody := struct {
+            Error struct {
+                Code int `json:"code"`
+                Message string `json:"message"`
+            } `json:"error"`
+        }{}
+        message := response.Status
+        if json.NewDecoder(response.Body).Decode(&errorBody) == nil && errorBody.Error.Message != "" {
+            message = errorBody.Error.Message
+        }
+        return nil, &Error{
+            Status: response.StatusCode,
+            Message: message,
+        }
+    }
+
+    return response, nil
+}
+
+func randomToken() string {
+    token := make([]byte, 16)
+    rand.Read(token)
+    return hex.EncodeToString(token)
+}
@@ -0,0 +1,183 @@
+package logger
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+    "encoding/json"
+)
+
+type Level int
+
+const (
+    DEBUG Level = iota
+    INFO
+    WARNING
+    ERROR
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+// Additional machine-readable data attached to a log event
+type Fields map[string]interface{}
+
+// Logger for a subsystem (e.g. gossip, routing, files, search, chain)
+type Logger struct {
+    subsystem string
+}
+
+var (
+    defaultLevel Level = INFO
+    // Subsystem -> level overriding defaultLevel
+    subsystemLevels = make(map[string]Level)
+    jsonOutput bool = false
+    output io.Writer = os.Stdout
+    mutex sync.Mutex
+)
+
+func New(subsystem string) *Logger {
+    return &Logger{
+        subsystem: subsystem,
+    }
+}
+
+func (l Level) String() string {
+    if l < DEBUG || l > ERROR {
+        return "unknown"
+    }
+    return levelNames[l]
+}
+
+func ParseLevel(level string) (Level, error) {
+    for i, name := range levelNames {
+        if strings.ToLower(level) == name {
+            return Level(i), nil
+        }
+    }
+    return INFO, fmt.Errorf("unknown log level %q", level)
+}
+
+// Set the level of every subsystem, removing subsystem specific levels
+func SetLevel(level Level) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    defaultLevel = level
+    subsystemLevels = make(map[string]Level)
+}
+
+func SetSubsystemLevel(subsystem string, level Level) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    subsystemLevels[subsystem] = level
+}
+
+// Return the default level and the subsystem specific levels
+func GetLevels() (Level, map[string]Level) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    levels := make(map[string]Level)
+    for subsystem, level := range subsystemLevels {
+        levels[subsystem] = level
+    }
+    return defaultLevel, levels
+}
+
+// If enabled, every log line is a JSON object instead of a human-readable line
+func SetJSON(enabled bool) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    jsonOutput = enabled
+}
+
+func SetOutput(w io.Writer) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    output = w
+}
+
+func (l *Logger) Debug(msg string) {
+    l.Event(DEBUG, "", msg, nil)
+}
+
+func (l *Logger) Info(msg string) {
+    l.Event(INFO, "", msg, nil)
+}
+
+func (l *Logger) Warning(msg string) {
+    l.Event(WARNING, "", msg, nil)
+}
+
+func (l *Logger) Error(msg string) {
+    l.Event(ERROR, "", msg, nil)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+    l.Event(DEBUG, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+    l.Event(INFO, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+    l.Event(WARNING, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+    l.Event(ERROR, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) IsEnabled(level Level) bool {
+    mutex.Lock()
+    defer mutex.Unlock()
+    return level >= l.levelLocked()
+}
+
+// Log a named event. In text mode only msg is printed, keeping the historical
+// output format; in JSON mode the event name and fields are included as well
+func (l *Logger) Event(level Level, event, msg string, fields Fields) {
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    if level < l.levelLocked() {
+        return
+    }
+
+    if !jsonOutput {
+        prefix := ""
+        if level == WARNING || level == ERROR {
+            prefix = strings.ToUpper(level.String()) + ": "
+        }
+        fmt.Fprintln(output, prefix + msg)
+        return
+    }
+
+    entry := make(map[string]interface{})
+    for k, v := range fields {
+        entry[k] = v
+    }
+    entry["time"] = time.Now().Format(time.RFC3339Nano)
+    entry["level"] = level.String()
+    entry["subsystem"] = l.subsystem
+    entry["msg"] = msg
+    if event != "" {
+        entry["event"] = event
+    }
+
+    line, err := json.Marshal(entry)
+    if err != nil {
+        fmt.Fprintln(output, `{"level":"error","msg":"could not encode log entry"}`)
+        return
+    }
+    fmt.Fprintln(output, string(line))
+}
+
+func (l *Logger) levelLocked() Level {
+    if level, isPresent := subsystemLevels[l.subsystem]; isPresent {
+        return level
+    }
+    return defaultLevel
+}
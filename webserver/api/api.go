@@ -1,22 +1,24 @@
 package api
 
 import (
-    "fmt"
-    "os"
-    "io"
-    "io/ioutil"
+    "sort"
     "net/http"
     "strings"
     "strconv"
-    "encoding/base64"
+    "encoding/json"
     "github.com/pablo11/Peerster/gossip"
     "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/logger"
     "github.com/pablo11/Peerster/util/validator"
 )
 
+var webLog = logger.New("web")
+
 const SHARED_FILES_DIR = "_SharedFiles/"
 const DOWNLOADED_FILES_DIR = "_Downloads/"
 
+/* ApiHandler serves the original routes under /api, kept for compatibility
+   with the GUI and existing scripts. The typed API lives under /api/v2 */
 type ApiHandler struct {
     gossiper *gossip.Gossiper
 }
@@ -29,19 +31,15 @@ func NewApiHandler(gossiper *gossip.Gossiper) *ApiHandler {
 
 func (a *ApiHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
     messages := a.gossiper.GetAllMessages()
-    json := strings.Join(mapRumorMessages(messages, func(m *model.RumorMessage) string {
-        return m.ToJSON()
-    }), ",")
-
-    sendJSON(w, []byte(`[` + json + `]`))
-}
-
-func mapRumorMessages(vs []*model.RumorMessage, f func(*model.RumorMessage) string) []string {
-    vsm := make([]string, len(vs))
-    for i, v := range vs {
-        vsm[i] = f(v)
+    legacyMessages := make([]LegacyMessage, len(messages))
+    for i, m := range messages {
+        legacyMessages[i] = LegacyMessage{
+            From: m.Origin,
+            Msg: m.Text,
+        }
     }
-    return vsm
+
+    sendJSON(w, legacyMessages)
 }
 
 func (a *ApiHandler) SendPublicMessage(w http.ResponseWriter, r *http.Request) {
@@ -49,8 +47,7 @@ func (a *ApiHandler) SendPublicMessage(w http.ResponseWriter, r *http.Request) {
     r.ParseForm()
     postedMsg, isPresent := r.PostForm["msg"]
     if !isPresent || len(postedMsg) != 1 {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "msg is required")
         return
     }
 
@@ -60,16 +57,11 @@ func (a *ApiHandler) SendPublicMessage(w http.ResponseWriter, r *http.Request) {
     go a.gossiper.SendPublicMessage(msg, true)
 
     // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
+    sendOk(w)
 }
 
 func (a *ApiHandler) GetOrigins(w http.ResponseWriter, r *http.Request) {
-    jsonOrigins := JsonOrigins{
-        origins: a.gossiper.GetOrigins(),
-    }
-
-    sendJSON(w, jsonOrigins.toByte())
+    sendJSON(w, a.gossiper.GetOrigins())
 }
 
 func (a *ApiHandler) SendPrivateMessage(w http.ResponseWriter, r *http.Request) {
@@ -78,8 +70,7 @@ func (a *ApiHandler) SendPrivateMessage(w http.ResponseWriter, r *http.Request)
     postedMsg, msgIsPresent := r.PostForm["msg"]
     postedDest, destIsPresent := r.PostForm["dest"]
     if !msgIsPresent || !destIsPresent || len(postedMsg) != 1 || len(postedDest) != 1 {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "msg and dest are required")
         return
     }
 
@@ -91,16 +82,11 @@ func (a *ApiHandler) SendPrivateMessage(w http.ResponseWriter, r *http.Request)
     a.gossiper.SendPrivateMessage(pm)
 
     // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
+    sendOk(w)
 }
 
 func (a *ApiHandler) GetNodes(w http.ResponseWriter, r *http.Request) {
-    jsonPeers := JsonPeers{
-        peers: a.gossiper.GetPeers(),
-    }
-
-    sendJSON(w, jsonPeers.toByte())
+    sendJSON(w, a.gossiper.GetPeers())
 }
 
 func (a *ApiHandler) AddNode(w http.ResponseWriter, r *http.Request) {
@@ -108,8 +94,7 @@ func (a *ApiHandler) AddNode(w http.ResponseWriter, r *http.Request) {
     r.ParseForm()
     postedNewPeer, isPresent := r.PostForm["peer"]
     if !isPresent || len(postedNewPeer) != 1 || !validator.IsGossipAddr(postedNewPeer[0]) {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "peer must be of the form ip:port")
         return
     }
 
@@ -119,57 +104,127 @@ func (a *ApiHandler) AddNode(w http.ResponseWriter, r *http.Request) {
     a.gossiper.AddPeer(peer)
 
     // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
+    sendOk(w)
 }
 
 func (a *ApiHandler) GetId(w http.ResponseWriter, r *http.Request) {
-    jsonId := JsonId{
-        name: a.gossiper.Name,
-        address: a.gossiper.GetAddress(),
+    sendJSON(w, IdResponse{
+        Name: a.gossiper.Name,
+        Address: a.gossiper.GetAddress(),
+    })
+}
+
+func (a *ApiHandler) GetRateLimits(w http.ResponseWriter, r *http.Request) {
+    stats := a.gossiper.RateLimiter.Stats()
+    response := RateLimitsResponse{
+        Throttled: stats.Throttled,
+        Banned: make([]BannedSource, 0, len(stats.Banned)),
+        TotalBans: stats.TotalBans,
+    }
+    for source, until := range stats.Banned {
+        response.Banned = append(response.Banned, BannedSource{
+            Source: source,
+            Until: until,
+        })
     }
 
-    sendJSON(w, jsonId.toByte())
+    sendJSON(w, response)
 }
 
-func sendJSON(w http.ResponseWriter, json []byte) {
+func (a *ApiHandler) GetReputation(w http.ResponseWriter, r *http.Request) {
+    peers, origins := a.gossiper.Reputation.Scores()
+    sendJSON(w, ReputationResponse{
+        Peers: peers,
+        Origins: origins,
+    })
+}
+
+func (a *ApiHandler) GetLogLevel(w http.ResponseWriter, r *http.Request) {
+    defaultLevel, subsystemLevels := logger.GetLevels()
+    response := LogLevelResponse{
+        Level: defaultLevel.String(),
+        Subsystems: make(map[string]string),
+    }
+    for subsystem, level := range subsystemLevels {
+        response.Subsystems[subsystem] = level.String()
+    }
+
+    sendJSON(w, response)
+}
+
+func (a *ApiHandler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+    // Parse "level" and optional "subsystem"
+    req := LogLevelRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    level, err := logger.ParseLevel(req.Level)
+    if err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    if req.Subsystem == "" {
+        logger.SetLevel(level)
+    } else {
+        logger.SetSubsystemLevel(req.Subsystem, level)
+    }
+
+    // Respond to request with ok
+    sendOk(w)
+}
+
+func sendJSON(w http.ResponseWriter, v interface{}) {
+    writeJSON(w, 200, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    body, err := json.Marshal(v)
+    if err != nil {
+        webLog.Error(err.Error())
+        sendError(w, 500, "could not encode the response")
+        return
+    }
+
     w.Header().Set("Server", "Cryptop GO server")
     w.Header().Set("Content-Type", "application/json; charset=utf-8")
-    w.WriteHeader(200)
-    w.Write(json)
+    w.WriteHeader(status)
+    w.Write(body)
 }
 
-func sendError(w http.ResponseWriter, errorMsg string) {
+func sendError(w http.ResponseWriter, status int, errorMsg string) {
+    body, _ := json.Marshal(ErrorResponse{
+        Error: ErrorObject{
+            Code: status,
+            Message: errorMsg,
+        },
+    })
+
     w.Header().Set("Server", "Cryptop GO server")
     w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    w.Write(body)
+}
+
+func sendOk(w http.ResponseWriter) {
+    w.Header().Set("Server", "Cryptop GO server")
     w.WriteHeader(200)
-    w.Write([]byte("{error:" + errorMsg + "}"))
 }
 
 func (a *ApiHandler) UploadFile(w http.ResponseWriter, r *http.Request) {
-    r.ParseMultipartForm(0)
-    file, handler, err := r.FormFile("file")
-    if err != nil {
-        sendError(w, err.Error())
-        fmt.Println(err)
-        return
-    }
-    defer file.Close()
-
-    f, err := os.OpenFile(SHARED_FILES_DIR + handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
+    filename, status, err := a.storeUploadedFile(w, r)
     if err != nil {
-        sendError(w, err.Error())
-        fmt.Println(err)
+        webLog.Error(err.Error())
+        sendError(w, status, err.Error())
         return
     }
-    defer f.Close()
-    io.Copy(f, file)
 
-    go a.gossiper.FileSharing.IndexFile(handler.Filename)
+    go a.gossiper.FileSharing.IndexFile(filename)
 
     // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
+    sendOk(w)
 }
 
 func (a *ApiHandler) RequestFile(w http.ResponseWriter, r *http.Request) {
@@ -179,77 +234,42 @@ func (a *ApiHandler) RequestFile(w http.ResponseWriter, r *http.Request) {
     dest, isDestPresent := r.PostForm["dest"]
     hash, isHashPresent := r.PostForm["hash"]
     if !isHashPresent || len(hash) != 1 {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "hash is required")
         return
     }
 
     hashStr := hash[0]
 
     if isFilenamePresent && len(filename) == 1 && isDestPresent && len(dest) == 1 && dest[0] != "0" {
-        go a.gossiper.FileSharing.RequestFile(filename[0], dest[0], hashStr)
+        go a.gossiper.FileSharing.RequestFile(filename[0], dest[0], hashStr, 0)
     } else if !isFilenamePresent && !isDestPresent {
-        go a.gossiper.FileSharing.RequestFile("", "", hashStr)
+        go a.gossiper.FileSharing.RequestFile("", "", hashStr, 0)
     } else {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "filename and dest must be given together")
         return
     }
 
     // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
+    sendOk(w)
 }
 
+// List the downloaded files
 func (a *ApiHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
-    /*
-    filesShared, err := ioutil.ReadDir(SHARED_FILES_DIR)
-    if err != nil {
-        fmt.Println(err)
-    }
-    */
-
-    filesDownloaded, err := ioutil.ReadDir(DOWNLOADED_FILES_DIR)
-    if err != nil {
-        fmt.Println(err)
-    }
-
-    filesJson := make([]string, 0)
-    /*
-    for _, f := range filesShared {
-        if !strings.HasPrefix(f.Name(), ".") {
-            filesJson = append(filesJson, "{\"path\": \"" + SHARED_FILES_DIR + f.Name() + "\", \"name\": \"" + f.Name() + "\"}")
+    files := make([]LegacyFile, 0)
+    for metahash, f := range a.gossiper.FileSharing.GetFiles() {
+        if strings.HasPrefix(f.Path, DOWNLOADED_FILES_DIR) {
+            files = append(files, LegacyFile{
+                ID: metahash,
+                Path: f.Path,
+                Name: f.LocalName,
+            })
         }
     }
-    */
-    for _, f := range filesDownloaded {
-        if !strings.HasPrefix(f.Name(), ".") {
-            filesJson = append(filesJson, "{\"path\": \"" + DOWNLOADED_FILES_DIR + f.Name() + "\", \"name\": \"" + f.Name() + "\"}")
-        }
-    }
-
-    sendJSON(w, []byte(`[` + strings.Join(filesJson, ",") + `]`))
-}
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].Name < files[j].Name
+    })
 
-func (a *ApiHandler) DownloadFile(w http.ResponseWriter, r *http.Request) {
-    // Get file path from request
-    path, ok := r.URL.Query()["path"]
-    if !ok || len(path[0]) < 1 {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
-        return
-    }
-
-    decodedPath, err := base64.StdEncoding.DecodeString(path[0])
-    if err != nil {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(500)
-        return
-	}
-
-    w.Header().Set("Server", "Cryptop GO server")
-    w.Header().Add("Content-Disposition", "Attachment")
-    http.ServeFile(w, r, string(decodedPath))
+    sendJSON(w, files)
 }
 
 func (a *ApiHandler) SearchFiles(w http.ResponseWriter, r *http.Request) {
@@ -258,36 +278,40 @@ func (a *ApiHandler) SearchFiles(w http.ResponseWriter, r *http.Request) {
     query, isQueryPresent := r.PostForm["query"]
     budget, isBudgetPresent := r.PostForm["budget"]
     if !isQueryPresent || len(query) < 1 || query[0] == "" || !isBudgetPresent || len(budget) < 1 {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+        sendError(w, 400, "query and budget are required")
         return
     }
 
     keywords := strings.Split(query[0], ",")
     budgetVal, err := strconv.Atoi(budget[0])
-    if err != nil {
-        w.Header().Set("Server", "Cryptop GO server")
-        w.WriteHeader(400)
+    if err != nil || budgetVal < 0 {
+        sendError(w, 400, "budget must be a positive integer")
         return
     }
 
-    if budgetVal == 0 {
+    a.startSearch(keywords, uint64(budgetVal))
+
+    // Respond to request with ok
+    sendOk(w)
+}
+
+func (a *ApiHandler) startSearch(keywords []string, budget uint64) {
+    if budget == 0 {
         go a.gossiper.StartSearchRequest(2, keywords, true)
     } else {
-        go a.gossiper.StartSearchRequest(uint64(budgetVal), keywords, false)
+        go a.gossiper.StartSearchRequest(budget, keywords, false)
     }
-
-    // Respond to request with ok
-    w.Header().Set("Server", "Cryptop GO server")
-    w.WriteHeader(200)
 }
 
 func (a *ApiHandler) SearchResults(w http.ResponseWriter, r *http.Request) {
     fileMatches := a.gossiper.GetFullMatches()
-    jsonFiles := make([]string, len(fileMatches))
+    results := make([]SearchResult, len(fileMatches))
     for i, f := range fileMatches {
-        jsonFiles[i] = "{\"filename\":\"" + f.Filename + "\", \"metahash\":\"" + f.MetaHash + "\"}"
+        results[i] = SearchResult{
+            Filename: f.Filename,
+            MetaHash: f.MetaHash,
+        }
     }
 
-    sendJSON(w, []byte(`[` + strings.Join(jsonFiles, ",") + `]`))
+    sendJSON(w, results)
 }
@@ -0,0 +1,225 @@
+package api
+
+import (
+    "sort"
+    "net/http"
+    "strings"
+    "strconv"
+    "time"
+    "encoding/hex"
+    "github.com/gorilla/mux"
+    "github.com/pablo11/Peerster/gossip"
+    "github.com/pablo11/Peerster/model"
+    "github.com/pablo11/Peerster/util/validator"
+)
+
+/* Handlers of the typed /api/v2 routes. Requests are accepted both as JSON
+   bodies and as forms; errors are always returned as ErrorResponse objects */
+
+// List the message history, filtered by the query string parameters since,
+// before, limit, order, origin, type, from, to and q (full-text search)
+func (a *ApiHandler) GetMessagesV2(w http.ResponseWriter, r *http.Request) {
+    req := MessagesQuery{}
+    if err := req.fromForm(r.URL.Query()); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+    if err := req.validate(); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    messages, cursor := a.gossiper.History.Query(req.HistoryQuery)
+    response := MessagesResponse{
+        Messages: make([]Message, len(messages)),
+        NextCursor: cursor,
+    }
+    for i, m := range messages {
+        response.Messages[i] = Message{
+            Seq: m.Seq,
+            Type: m.Type,
+            Origin: m.Origin,
+            Destination: m.Destination,
+            ID: m.ID,
+            Text: m.Text,
+            Timestamp: m.Timestamp,
+        }
+    }
+
+    sendJSON(w, response)
+}
+
+func (a *ApiHandler) SendMessageV2(w http.ResponseWriter, r *http.Request) {
+    req := SendMessageRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    if req.Dest == "" {
+        go a.gossiper.SendPublicMessage(req.Text, true)
+        writeJSON(w, 202, AcceptedResponse{Status: "sent"})
+        return
+    }
+
+    pm := model.NewPrivateMessage(a.gossiper.Name, req.Text, req.Dest)
+    id := a.gossiper.SendPrivateMessage(pm)
+    writeJSON(w, 202, DeliveryResponse{
+        ID: id,
+        Destination: req.Dest,
+        State: gossip.DELIVERY_PENDING,
+        Attempts: 0,
+    })
+}
+
+// Get the mailbox settings and the messages kept for neighbours
+func (a *ApiHandler) GetMailboxV2(w http.ResponseWriter, r *http.Request) {
+    sendJSON(w, MailboxResponse{
+        TTL: int64(a.gossiper.Mailbox.TTL() / time.Second),
+        Volunteer: a.gossiper.Mailbox.IsVolunteer(),
+        Deposits: a.gossiper.Mailbox.Deposits(),
+    })
+}
+
+// Get the delivery state of a private message sent by this node
+func (a *ApiHandler) GetDeliveryV2(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+    if err != nil {
+        sendError(w, 400, "id must be a positive integer")
+        return
+    }
+
+    delivery, isPresent := a.gossiper.Outbox.Get(uint32(id))
+    if !isPresent {
+        sendError(w, 404, "no private message with this id was sent")
+        return
+    }
+
+    sendJSON(w, DeliveryResponse{
+        ID: delivery.ID,
+        Destination: delivery.Destination,
+        State: delivery.State,
+        Attempts: delivery.Attempts,
+    })
+}
+
+func (a *ApiHandler) GetOriginsV2(w http.ResponseWriter, r *http.Request) {
+    sendJSON(w, OriginsResponse{Origins: a.gossiper.GetOrigins()})
+}
+
+func (a *ApiHandler) GetPeersV2(w http.ResponseWriter, r *http.Request) {
+    sendJSON(w, PeersResponse{Peers: a.gossiper.GetPeers()})
+}
+
+func (a *ApiHandler) AddPeerV2(w http.ResponseWriter, r *http.Request) {
+    req := AddPeerRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    if !validator.IsGossipAddr(req.Peer) {
+        sendError(w, 400, "peer must be of the form ip:port")
+        return
+    }
+
+    a.gossiper.AddPeer(req.Peer)
+    writeJSON(w, 201, PeersResponse{Peers: a.gossiper.GetPeers()})
+}
+
+func (a *ApiHandler) UploadFileV2(w http.ResponseWriter, r *http.Request) {
+    filename, status, err := a.storeUploadedFile(w, r)
+    if err != nil {
+        sendError(w, status, err.Error())
+        return
+    }
+
+    go a.gossiper.FileSharing.IndexFile(filename)
+
+    writeJSON(w, 202, AcceptedResponse{Status: "indexing"})
+}
+
+func (a *ApiHandler) ListFilesV2(w http.ResponseWriter, r *http.Request) {
+    response := FilesResponse{
+        Files: make([]FileEntry, 0),
+    }
+    for metahash, f := range a.gossiper.FileSharing.GetFiles() {
+        source := "shared"
+        if strings.HasPrefix(f.Path, DOWNLOADED_FILES_DIR) {
+            source = "downloaded"
+        } else if f.Path == "" {
+            // Download in progress
+            continue
+        }
+
+        response.Files = append(response.Files, FileEntry{
+            ID: metahash,
+            Name: f.LocalName,
+            Size: f.Size,
+            Source: source,
+            SourceState: f.SourceState,
+        })
+    }
+    sort.Slice(response.Files, func(i, j int) bool {
+        return response.Files[i].Name < response.Files[j].Name
+    })
+
+    sendJSON(w, response)
+}
+
+func (a *ApiHandler) RequestFileV2(w http.ResponseWriter, r *http.Request) {
+    req := RequestFileRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    if metahash, err := hex.DecodeString(req.MetaHash); err != nil || len(metahash) != 32 {
+        sendError(w, 400, "metahash must be an hex encoded SHA-256 hash")
+        return
+    }
+
+    if err := a.gossiper.FileSharing.RequestFile(req.Filename, req.Dest, req.MetaHash, req.Priority); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    writeJSON(w, 202, AcceptedResponse{Status: "requested"})
+}
+
+func (a *ApiHandler) SearchFilesV2(w http.ResponseWriter, r *http.Request) {
+    req := SearchRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    a.startSearch(req.Keywords, req.Budget)
+
+    writeJSON(w, 202, AcceptedResponse{Status: "searching"})
+}
+
+func (a *ApiHandler) SearchResultsV2(w http.ResponseWriter, r *http.Request) {
+    fileMatches := a.gossiper.GetFullMatches()
+    response := SearchResultsResponse{
+        Results: make([]SearchResultV2, len(fileMatches)),
+    }
+    for i, f := range fileMatches {
+        response.Results[i] = SearchResultV2{
+            Filename: f.Filename,
+            MetaHash: f.MetaHash,
+            NbChunks: f.NbChunks,
+            Sources: f.SourceNames(),
+        }
+    }
+
+    sendJSON(w, response)
+}
+
+func (a *ApiHandler) NotFoundV2(w http.ResponseWriter, r *http.Request) {
+    sendError(w, 404, "no route " + r.Method + " " + r.URL.Path)
+}
+
+func (a *ApiHandler) MethodNotAllowedV2(w http.ResponseWriter, r *http.Request) {
+    sendError(w, 405, "method " + r.Method + " not allowed on " + r.URL.Path)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+    "math"
+    "strconv"
+    "net/http"
+    "github.com/gorilla/mux"
+    "github.com/pablo11/Peerster/model"
+)
+
+// List the private conversations, the most recent first
+func (a *ApiHandler) ListConversationsV2(w http.ResponseWriter, r *http.Request) {
+    summaries := a.gossiper.Conversations.List()
+    response := ConversationsResponse{
+        Conversations: make([]ConversationSummary, len(summaries)),
+        Unread: 0,
+    }
+    for i, s := range summaries {
+        response.Conversations[i] = ConversationSummary{
+            Peer: s.Peer,
+            NbMessages: s.NbMessages,
+            Unread: s.Unread,
+            LastMessage: newPrivateMessage(s.LastMessage),
+        }
+        response.Unread += s.Unread
+    }
+
+    sendJSON(w, response)
+}
+
+// Get the messages exchanged with a peer, optionally after the message
+// "since" and at most "limit" of them
+func (a *ApiHandler) GetConversationV2(w http.ResponseWriter, r *http.Request) {
+    peer := mux.Vars(r)["peer"]
+    query := r.URL.Query()
+
+    since, err := parseUintParam(query, "since")
+    if err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+    limit, err := parseUintParam(query, "limit")
+    if err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+    // Larger values would become negative once converted
+    if limit > math.MaxInt32 {
+        sendError(w, 400, "limit must be at most " + strconv.Itoa(math.MaxInt32))
+        return
+    }
+
+    messages, unread, isPresent := a.gossiper.Conversations.Thread(peer, since, int(limit))
+    if !isPresent {
+        sendError(w, 404, "no conversation with " + peer)
+        return
+    }
+
+    response := ConversationResponse{
+        Peer: peer,
+        Unread: unread,
+        Messages: make([]PrivateMessage, len(messages)),
+    }
+    for i, m := range messages {
+        response.Messages[i] = newPrivateMessage(m)
+    }
+
+    sendJSON(w, response)
+}
+
+// Mark every message of a conversation as read
+func (a *ApiHandler) MarkConversationReadV2(w http.ResponseWriter, r *http.Request) {
+    peer := mux.Vars(r)["peer"]
+    if !a.gossiper.Conversations.MarkRead(peer) {
+        sendError(w, 404, "no conversation with " + peer)
+        return
+    }
+
+    sendJSON(w, AcceptedResponse{Status: "read"})
+}
+
+func newPrivateMessage(m model.ConversationMessage) PrivateMessage {
+    return PrivateMessage{
+        Seq: m.Seq,
+        ID: m.ID,
+        Origin: m.Origin,
+        Destination: m.Destination,
+        Text: m.Text,
+        Timestamp: m.Timestamp,
+        State: m.State,
+    }
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+    "net/http"
+    "encoding/hex"
+    "github.com/gorilla/mux"
+    "github.com/pablo11/Peerster/gossip"
+)
+
+// List the downloads: running ones, then queued ones in the order they will
+// start, then paused ones
+func (a *ApiHandler) ListDownloadsV2(w http.ResponseWriter, r *http.Request) {
+    statuses := a.gossiper.FileSharing.GetDownloads()
+    response := DownloadsResponse{
+        Downloads: make([]Download, len(statuses)),
+    }
+    for i, d := range statuses {
+        response.Downloads[i] = newDownload(d)
+    }
+
+    sendJSON(w, response)
+}
+
+func (a *ApiHandler) GetDownloadV2(w http.ResponseWriter, r *http.Request) {
+    metahash, isValid := downloadId(w, r)
+    if !isValid {
+        return
+    }
+
+    status, isPresent := a.gossiper.FileSharing.GetDownload(metahash)
+    if !isPresent {
+        sendError(w, 404, "download not found")
+        return
+    }
+
+    sendJSON(w, newDownload(status))
+}
+
+func (a *ApiHandler) PauseDownloadV2(w http.ResponseWriter, r *http.Request) {
+    metahash, isValid := downloadId(w, r)
+    if !isValid {
+        return
+    }
+
+    if err := a.gossiper.FileSharing.PauseDownload(metahash); err != nil {
+        sendError(w, 404, err.Error())
+        return
+    }
+
+    sendJSON(w, AcceptedResponse{Status: "paused"})
+}
+
+// Resume a paused download or a download interrupted by a restart, or retry
+// the requests of a running download at once
+func (a *ApiHandler) ResumeDownloadV2(w http.ResponseWriter, r *http.Request) {
+    metahash, isValid := downloadId(w, r)
+    if !isValid {
+        return
+    }
+
+    if err := a.gossiper.FileSharing.ResumeDownload(metahash); err != nil {
+        sendError(w, 404, err.Error())
+        return
+    }
+
+    writeJSON(w, 202, AcceptedResponse{Status: "resumed"})
+}
+
+func (a *ApiHandler) CancelDownloadV2(w http.ResponseWriter, r *http.Request) {
+    metahash, isValid := downloadId(w, r)
+    if !isValid {
+        return
+    }
+
+    if err := a.gossiper.FileSharing.CancelDownload(metahash); err != nil {
+        sendError(w, 404, err.Error())
+        return
+    }
+
+    sendJSON(w, AcceptedResponse{Status: "cancelled"})
+}
+
+func (a *ApiHandler) SetDownloadPriorityV2(w http.ResponseWriter, r *http.Request) {
+    metahash, isValid := downloadId(w, r)
+    if !isValid {
+        return
+    }
+
+    req := DownloadPriorityRequest{}
+    if err := decodeRequest(w, r, &req); err != nil {
+        sendError(w, 400, err.Error())
+        return
+    }
+
+    if err := a.gossiper.FileSharing.SetDownloadPriority(metahash, req.Priority); err != nil {
+        sendError(w, 404, err.Error())
+        return
+    }
+
+    sendJSON(w, AcceptedResponse{Status: "updated"})
+}
+
+// Hex metahash of the download in the path, send an error if it is invalid
+func downloadId(w http.ResponseWriter, r *http.Request) (string, bool) {
+    metahash := mux.Vars(r)["id"]
+    if byteHash, err := hex.DecodeString(metahash); err != nil || len(byteHash) != 32 {
+        sendError(w, 400, "id must be an hex encoded SHA-256 hash")
+        return "", false
+    }
+    return metahash, true
+}
+
+func newDownload(d gossip.DownloadStatus) Download {
+    download := Download{
+        ID: d.MetaHash,
+        Name: d.LocalName,
+        State: d.State,
+        Priority: d.Priority,
+        Chunks: d.NbChunksDone,
+        NbChunks: d.NbChunks,
+        Bytes: d.BytesDone,
+        BytesPerSecond: d.BytesPerSecond,
+        Sources: make([]DownloadSource, len(d.Sources)),
+    }
+    for i, s := range d.Sources {
+        download.Sources[i] = DownloadSource{
+            Name: s.Name,
+            HasAll: s.HasAll,
+            NbChunks: s.NbChunks,
+            Downloaded: s.Downloaded,
+            Pending: s.Pending,
+            Failures: s.Failures,
+            Abandoned: s.Abandoned,
+        }
+    }
+    return download
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+    "time"
+    "net/http"
+    "encoding/json"
+    "github.com/pablo11/Peerster/gossip"
+)
+
+const EVENTS_KEEPALIVE_PERIOD time.Duration = 15 // Seconds between two keepalive comments on the event stream
+
+// Stream gossiper events to the browser using Server-Sent Events
+func (a *ApiHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+    flusher, canFlush := w.(http.Flusher)
+    if !canFlush {
+        sendError(w, 500, "streaming not supported")
+        return
+    }
+
+    sub := a.gossiper.Events.Subscribe(
+        gossip.EVENT_RUMOR_DELIVERED,
+        gossip.EVENT_PRIVATE_MESSAGE_RECEIVED,
+        gossip.EVENT_PRIVATE_MESSAGE_STATE,
+        gossip.EVENT_CHUNK_DOWNLOADED,
+        gossip.EVENT_FILE_RECONSTRUCTED,
+        gossip.EVENT_FILE_SOURCE_CHANGED,
+        gossip.EVENT_SEARCH_MATCH,
+        gossip.EVENT_BLOCK_ACCEPTED,
+    )
+    defer a.gossiper.Events.Unsubscribe(sub)
+
+    w.Header().Set("Server", "Cryptop GO server")
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(200)
+    flusher.Flush()
+
+    keepalive := time.NewTicker(EVENTS_KEEPALIVE_PERIOD * time.Second)
+    defer keepalive.Stop()
+
+    for {
+        select {
+        case e, isOpen := <-sub.C:
+            if !isOpen {
+                return
+            }
+
+            data, err := json.Marshal(eventPayload(e))
+            if err != nil {
+                webLog.Error(err.Error())
+                continue
+            }
+
+            w.Write([]byte("event: " + string(e.Type) + "\ndata: " + string(data) + "\n\n"))
+            flusher.Flush()
+
+        case <-keepalive.C:
+            w.Write([]byte(": keepalive\n\n"))
+            flusher.Flush()
+
+        case <-r.Context().Done():
+            // The browser closed the connection
+            return
+        }
+    }
+}
+
+// Build the JSON payload sent to the GUI for an event. Rumors use the same
+// format as /api/messages
+func eventPayload(e *gossip.Event) interface{} {
+    switch e.Type {
+        case gossip.EVENT_RUMOR_DELIVERED:
+            return map[string]interface{}{
+                "from": e.Rumor.Origin,
+                "id": e.Rumor.ID,
+                "msg": e.Rumor.Text,
+            }
+
+        case gossip.EVENT_PRIVATE_MESSAGE_RECEIVED:
+            return map[string]interface{}{
+                "from": e.Private.Origin,
+                "to": e.Private.Destination,
+                "msg": e.Private.Text,
+            }
+
+        case gossip.EVENT_PRIVATE_MESSAGE_STATE:
+            return map[string]interface{}{
+                "id": e.Delivery.ID,
+                "to": e.Delivery.Destination,
+                "state": e.Delivery.State,
+            }
+
+        case gossip.EVENT_CHUNK_DOWNLOADED:
+            return map[string]interface{}{
+                "filename": e.Chunk.Filename,
+                "metahash": e.Chunk.MetaHash,
+                "chunk": e.Chunk.ChunkNb,
+                "nbChunks": e.Chunk.NbChunks,
+                "from": e.Chunk.From,
+            }
+
+        case gossip.EVENT_FILE_RECONSTRUCTED:
+            return map[string]interface{}{
+                "filename": e.File.Filename,
+                "metahash": e.File.MetaHash,
+            }
+
+        case gossip.EVENT_FILE_SOURCE_CHANGED:
+            return map[string]interface{}{
+                "filename": e.Source.Filename,
+                "metahash": e.Source.MetaHash,
+                "state": e.Source.State,
+                "newMetahash": e.Source.NewMetaHash,
+            }
+
+        case gossip.EVENT_SEARCH_MATCH:
+            return map[string]interface{}{
+                "filename": e.Match.Filename,
+                "metahash": e.Match.MetaHash,
+                "origin": e.Match.Origin,
+                "chunkCount": e.Match.ChunkCount,
+                "fullMatch": e.Match.IsFullMatch,
+            }
+
+        case gossip.EVENT_BLOCK_ACCEPTED:
+            return map[string]interface{}{
+                "hash": e.Block.Hash,
+                "prevHash": e.Block.PrevHash,
+                "filenames": e.Block.Filenames,
+                "onLongestChain": e.Block.OnLongestChain,
+            }
+
+        default:
+            return map[string]interface{}{}
+    }
+}
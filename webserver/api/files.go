@@ -0,0 +1,232 @@
+package api
+
+import (
+    "os"
+    "io"
+    "errors"
+    "strings"
+    "strconv"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/hex"
+    "encoding/base64"
+    "github.com/gorilla/mux"
+    "github.com/pablo11/Peerster/gossip"
+    "github.com/pablo11/Peerster/model"
+)
+
+const MAX_UPLOAD_SIZE int64 = 1024 * 1024 * 1024
+// Larger uploads are buffered in a temporary file while they are parsed
+const MAX_UPLOAD_MEMORY int64 = 2 * 1024 * 1024
+// Room left for the multipart headers around the uploaded file
+const MAX_UPLOAD_OVERHEAD int64 = 64 * 1024
+
+var errNotContained = errors.New("path is outside of the shared and downloads directories")
+
+/* Files are served by identifier (the hex metahash of the file), the path on
+   disk is never taken from the request except for the legacy ?path= parameter,
+   which must resolve inside the shared or downloads directory */
+
+// Download a file by id, or by base64 encoded path for older clients
+func (a *ApiHandler) DownloadFile(w http.ResponseWriter, r *http.Request) {
+    if id := r.URL.Query().Get("id"); id != "" {
+        a.serveFileById(w, r, id)
+        return
+    }
+
+    path := r.URL.Query().Get("path")
+    if path == "" {
+        sendError(w, 400, "id is required")
+        return
+    }
+
+    decodedPath, err := base64.StdEncoding.DecodeString(path)
+    if err != nil {
+        sendError(w, 400, "path must be base64 encoded")
+        return
+    }
+
+    fullPath, err := containedPath(SHARED_FILES_DIR, string(decodedPath))
+    if err != nil {
+        fullPath, err = containedPath(DOWNLOADED_FILES_DIR, string(decodedPath))
+    }
+    if err != nil {
+        webLog.Warning("Rejected download of " + string(decodedPath) + " from " + r.RemoteAddr)
+        sendError(w, 404, "file not found")
+        return
+    }
+
+    serveFile(w, r, fullPath)
+}
+
+func (a *ApiHandler) GetFileV2(w http.ResponseWriter, r *http.Request) {
+    a.serveFileById(w, r, mux.Vars(r)["id"])
+}
+
+func (a *ApiHandler) serveFileById(w http.ResponseWriter, r *http.Request, id string) {
+    if metahash, err := hex.DecodeString(id); err != nil || len(metahash) != 32 {
+        sendError(w, 400, "id must be an hex encoded SHA-256 hash")
+        return
+    }
+
+    file, isPresent := a.gossiper.FileSharing.GetFile(id)
+    if !isPresent || file.Path == "" {
+        sendError(w, 404, "file not found")
+        return
+    }
+
+    fullPath, err := fileLocation(file)
+    if err != nil {
+        webLog.Warning("Refused to serve " + file.Path + ": " + err.Error())
+        sendError(w, 404, "file not found")
+        return
+    }
+
+    serveFile(w, r, fullPath)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+    f, err := os.Open(fullPath)
+    if err != nil {
+        sendError(w, 404, "file not found")
+        return
+    }
+    defer f.Close()
+
+    fileInfo, err := f.Stat()
+    if err != nil || !fileInfo.Mode().IsRegular() {
+        sendError(w, 404, "file not found")
+        return
+    }
+
+    w.Header().Set("Server", "Cryptop GO server")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"" + strings.Replace(fileInfo.Name(), "\"", "", -1) + "\"")
+    http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), f)
+}
+
+// Resolve the path of a file known to the gossiper, it must be inside the
+// directory it was shared from or downloaded to, or be a file that the user
+// indexed from another location
+func fileLocation(file model.FileDownload) (string, error) {
+    if filepath.IsAbs(file.Path) && file.SourceState == gossip.SOURCE_OK {
+        return file.Path, nil
+    }
+    if strings.HasPrefix(file.Path, SHARED_FILES_DIR) {
+        return containedPath(SHARED_FILES_DIR, strings.TrimPrefix(file.Path, SHARED_FILES_DIR))
+    }
+    if strings.HasPrefix(file.Path, DOWNLOADED_FILES_DIR) {
+        return containedPath(DOWNLOADED_FILES_DIR, strings.TrimPrefix(file.Path, DOWNLOADED_FILES_DIR))
+    }
+    return "", errNotContained
+}
+
+// Return the absolute path of name inside dir. Fails if name, once cleaned
+// and with symlinks resolved, points outside of dir
+func containedPath(dir, name string) (string, error) {
+    absDir, err := filepath.Abs(dir)
+    if err != nil {
+        return "", err
+    }
+    absDir, err = filepath.EvalSymlinks(absDir)
+    if err != nil {
+        return "", err
+    }
+
+    // A leading directory of the same name is accepted, paths returned by /api/listFiles include it
+    name = strings.TrimPrefix(filepath.ToSlash(name), filepath.ToSlash(dir))
+
+    fullPath := filepath.Join(absDir, filepath.FromSlash(name))
+    if !isInside(absDir, fullPath) {
+        return "", errNotContained
+    }
+
+    resolvedPath, err := filepath.EvalSymlinks(fullPath)
+    if err != nil {
+        return "", err
+    }
+    if !isInside(absDir, resolvedPath) {
+        return "", errNotContained
+    }
+
+    return resolvedPath, nil
+}
+
+func isInside(dir, path string) bool {
+    rel, err := filepath.Rel(dir, path)
+    if err != nil {
+        return false
+    }
+    return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator))
+}
+
+// Check that a name given by a client can be used as a file name in one of
+// the shared directories and return it without any directory component
+func sanitizeFilename(name string) (string, error) {
+    name = filepath.Base(filepath.FromSlash(strings.Replace(name, "\\", "/", -1)))
+    if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+        return "", errors.New("invalid filename")
+    }
+    return name, nil
+}
+
+// Store the file of the multipart form of r in the shared files directory
+// and return its name. The returned status is the HTTP status to answer with
+// when an error occurs
+func (a *ApiHandler) storeUploadedFile(w http.ResponseWriter, r *http.Request) (string, int, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE + MAX_UPLOAD_OVERHEAD)
+    if err := r.ParseMultipartForm(MAX_UPLOAD_MEMORY); err != nil {
+        if strings.Contains(err.Error(), "request body too large") {
+            return "", 413, errors.New("file is larger than the maximum size of " + formatSize(MAX_UPLOAD_SIZE))
+        }
+        return "", 400, err
+    }
+
+    file, handler, err := r.FormFile("file")
+    if err != nil {
+        return "", 400, err
+    }
+    defer file.Close()
+
+    if handler.Size > MAX_UPLOAD_SIZE {
+        return "", 413, errors.New("file is larger than the maximum size of " + formatSize(MAX_UPLOAD_SIZE))
+    }
+
+    filename, err := sanitizeFilename(handler.Filename)
+    if err != nil {
+        return "", 400, err
+    }
+
+    if _, err := os.Lstat(SHARED_FILES_DIR + filename); err == nil {
+        return "", 409, errors.New("a file named " + filename + " is already shared")
+    }
+
+    // Write to a temporary file first so that a partial upload is never indexed
+    tmp, err := ioutil.TempFile(SHARED_FILES_DIR, ".upload-")
+    if err != nil {
+        return "", 500, err
+    }
+    defer os.Remove(tmp.Name())
+
+    _, err = io.Copy(tmp, file)
+    tmp.Close()
+    if err != nil {
+        return "", 500, err
+    }
+
+    if _, err := os.Lstat(SHARED_FILES_DIR + filename); err == nil {
+        return "", 409, errors.New("a file named " + filename + " is already shared")
+    }
+    if err := os.Rename(tmp.Name(), SHARED_FILES_DIR + filename); err != nil {
+        return "", 500, err
+    }
+
+    return filename, 200, nil
+}
+
+func formatSize(size int64) string {
+    if size % (1024 * 1024) == 0 {
+        return strconv.FormatInt(size / (1024 * 1024), 10) + "MB"
+    }
+    return strconv.FormatInt(size / 1024, 10) + "KB"
+}
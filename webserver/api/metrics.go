@@ -0,0 +1,96 @@
+package api
+
+import (
+    "sort"
+    "strings"
+    "strconv"
+    "net/http"
+)
+
+/* PromWriter builds a response in the Prometheus text exposition format */
+type PromWriter struct {
+    lines []string
+}
+
+func (p *PromWriter) header(name, help, metricType string) {
+    p.lines = append(p.lines, "# HELP " + name + " " + help, "# TYPE " + name + " " + metricType)
+}
+
+func (p *PromWriter) value(name string, value float64) {
+    p.lines = append(p.lines, name + " " + strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (p *PromWriter) labeled(name, label string, values map[string]uint64) {
+    // Sort label values to get a stable output
+    keys := make([]string, 0, len(values))
+    for k, _ := range values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        p.lines = append(p.lines, name + "{" + label + "=\"" + escapeLabel(k) + "\"} " + strconv.FormatUint(values[k], 10))
+    }
+}
+
+func (p *PromWriter) toByte() []byte {
+    return []byte(strings.Join(p.lines, "\n") + "\n")
+}
+
+func escapeLabel(v string) string {
+    v = strings.Replace(v, `\`, `\\`, -1)
+    v = strings.Replace(v, `"`, `\"`, -1)
+    return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func (a *ApiHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+    m := a.gossiper.GetMetrics()
+    p := PromWriter{lines: make([]string, 0)}
+
+    p.header("peerster_packets_received_total", "Packets received from peers per GossipPacket variant.", "counter")
+    p.labeled("peerster_packets_received_total", "type", m.PacketsIn)
+
+    p.header("peerster_packets_sent_total", "Packets sent to peers per GossipPacket variant.", "counter")
+    p.labeled("peerster_packets_sent_total", "type", m.PacketsOut)
+
+    p.header("peerster_bytes_received_total", "Bytes received per peer.", "counter")
+    p.labeled("peerster_bytes_received_total", "peer", m.BytesIn)
+
+    p.header("peerster_bytes_sent_total", "Bytes sent per peer.", "counter")
+    p.labeled("peerster_bytes_sent_total", "peer", m.BytesOut)
+
+    p.header("peerster_packets_throttled_total", "Packets dropped by the rate limiter per GossipPacket variant.", "counter")
+    p.labeled("peerster_packets_throttled_total", "type", m.Throttled)
+
+    p.header("peerster_rumor_lag", "Rumors of an origin announced by peers but not yet received.", "gauge")
+    p.labeled("peerster_rumor_lag", "origin", m.RumorLag)
+
+    p.header("peerster_active_downloads", "Files currently being downloaded.", "gauge")
+    p.value("peerster_active_downloads", float64(m.ActiveDownloads))
+
+    p.header("peerster_active_searches", "Search requests currently active.", "gauge")
+    p.value("peerster_active_searches", float64(m.ActiveSearches))
+
+    p.header("peerster_chunk_store_files", "Number of chunks and metafiles served by this node.", "gauge")
+    p.value("peerster_chunk_store_files", float64(m.ChunkStoreFiles))
+
+    p.header("peerster_chunk_store_bytes", "Size of the chunks and metafiles served by this node in bytes.", "gauge")
+    p.value("peerster_chunk_store_bytes", float64(m.ChunkStoreBytes))
+
+    p.header("peerster_blockchain_height", "Length of the longest chain.", "gauge")
+    p.value("peerster_blockchain_height", float64(m.BlockchainHeight))
+
+    p.header("peerster_mining_attempts_total", "Nonces tried while mining.", "counter")
+    p.value("peerster_mining_attempts_total", float64(m.MiningAttempts))
+
+    p.header("peerster_fork_switches_total", "Switches of the longest chain to another fork.", "counter")
+    p.value("peerster_fork_switches_total", float64(m.ForkSwitches))
+
+    p.header("peerster_handler_queue_depth", "Received packets currently being handled.", "gauge")
+    p.value("peerster_handler_queue_depth", float64(m.HandlerQueueDepth))
+
+    w.Header().Set("Server", "Cryptop GO server")
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.WriteHeader(200)
+    w.Write(p.toByte())
+}
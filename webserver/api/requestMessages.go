@@ -0,0 +1,268 @@
+package api
+
+import (
+    "mime"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+    "net/url"
+    "net/http"
+    "encoding/json"
+    "github.com/pablo11/Peerster/gossip"
+)
+
+const MAX_REQUEST_BODY_SIZE int64 = 1 << 20 // Maximum size of a JSON request body (1MB)
+
+/* formRequest is implemented by the requests of /api/v2, that can be sent
+   either as JSON bodies or as forms */
+type formRequest interface {
+    fromForm(form url.Values) error
+    validate() error
+}
+
+type SendMessageRequest struct {
+    Text string `json:"text"`
+    // Empty for a public message
+    Dest string `json:"dest"`
+}
+
+func (req *SendMessageRequest) fromForm(form url.Values) error {
+    req.Text = form.Get("text")
+    if req.Text == "" {
+        req.Text = form.Get("msg")
+    }
+    req.Dest = form.Get("dest")
+    return nil
+}
+
+func (req *SendMessageRequest) validate() error {
+    if req.Text == "" {
+        return errors.New("text is required")
+    }
+    return nil
+}
+
+type AddPeerRequest struct {
+    Peer string `json:"peer"`
+}
+
+func (req *AddPeerRequest) fromForm(form url.Values) error {
+    req.Peer = form.Get("peer")
+    return nil
+}
+
+func (req *AddPeerRequest) validate() error {
+    if req.Peer == "" {
+        return errors.New("peer is required")
+    }
+    return nil
+}
+
+type RequestFileRequest struct {
+    MetaHash string `json:"metahash"`
+    Filename string `json:"filename"`
+    // Empty to download from the sources found by a search
+    Dest string `json:"dest"`
+    // Queued downloads with a higher priority start first
+    Priority int `json:"priority"`
+}
+
+func (req *RequestFileRequest) fromForm(form url.Values) error {
+    req.MetaHash = form.Get("metahash")
+    if req.MetaHash == "" {
+        req.MetaHash = form.Get("hash")
+    }
+    req.Filename = form.Get("filename")
+    req.Dest = form.Get("dest")
+    return parseIntParam(form, "priority", &req.Priority)
+}
+
+func (req *RequestFileRequest) validate() error {
+    if req.MetaHash == "" {
+        return errors.New("metahash is required")
+    }
+    if req.Dest != "" && req.Filename == "" {
+        return errors.New("filename is required when downloading from dest")
+    }
+    return nil
+}
+
+type DownloadPriorityRequest struct {
+    Priority int `json:"priority"`
+}
+
+func (req *DownloadPriorityRequest) fromForm(form url.Values) error {
+    if form.Get("priority") == "" {
+        return errors.New("priority is required")
+    }
+    return parseIntParam(form, "priority", &req.Priority)
+}
+
+func (req *DownloadPriorityRequest) validate() error {
+    return nil
+}
+
+type SearchRequest struct {
+    Keywords []string `json:"keywords"`
+    // 0 to start an expanding-ring search
+    Budget uint64 `json:"budget"`
+}
+
+func (req *SearchRequest) fromForm(form url.Values) error {
+    keywords := form.Get("keywords")
+    if keywords == "" {
+        keywords = form.Get("query")
+    }
+    if keywords != "" {
+        req.Keywords = strings.Split(keywords, ",")
+    }
+
+    if budget := form.Get("budget"); budget != "" {
+        budgetVal, err := strconv.ParseUint(budget, 10, 64)
+        if err != nil {
+            return errors.New("budget must be a positive integer")
+        }
+        req.Budget = budgetVal
+    }
+    return nil
+}
+
+func (req *SearchRequest) validate() error {
+    if len(req.Keywords) == 0 {
+        return errors.New("keywords are required")
+    }
+    return nil
+}
+
+type LogLevelRequest struct {
+    Level string `json:"level"`
+    // Empty to change the level of every subsystem
+    Subsystem string `json:"subsystem"`
+}
+
+func (req *LogLevelRequest) fromForm(form url.Values) error {
+    req.Level = form.Get("level")
+    req.Subsystem = form.Get("subsystem")
+    return nil
+}
+
+func (req *LogLevelRequest) validate() error {
+    if req.Level == "" {
+        return errors.New("level is required")
+    }
+    return nil
+}
+
+/* MessagesQuery holds the query string parameters of GET /api/v2/messages */
+type MessagesQuery struct {
+    gossip.HistoryQuery
+}
+
+func (req *MessagesQuery) fromForm(form url.Values) error {
+    var err error
+    if req.SinceSeq, err = parseUintParam(form, "since"); err != nil {
+        return err
+    }
+    if req.BeforeSeq, err = parseUintParam(form, "before"); err != nil {
+        return err
+    }
+    limit, err := parseUintParam(form, "limit")
+    if err != nil {
+        return err
+    }
+    req.Limit = int(limit)
+    if req.From, err = parseTimeParam(form, "from"); err != nil {
+        return err
+    }
+    if req.To, err = parseTimeParam(form, "to"); err != nil {
+        return err
+    }
+
+    req.Origin = form.Get("origin")
+    req.Type = form.Get("type")
+    req.Text = form.Get("q")
+
+    switch form.Get("order") {
+        case "", "asc":
+            req.Descending = false
+        case "desc":
+            req.Descending = true
+        default:
+            return errors.New("order must be asc or desc")
+    }
+    return nil
+}
+
+func (req *MessagesQuery) validate() error {
+    if req.Type != "" && req.Type != gossip.MESSAGE_TYPE_RUMOR && req.Type != gossip.MESSAGE_TYPE_PRIVATE && req.Type != gossip.MESSAGE_TYPE_SIMPLE {
+        return errors.New("type must be rumor, private or simple")
+    }
+    if req.Limit > gossip.HISTORY_MAX_LIMIT {
+        return errors.New("limit must be at most " + strconv.Itoa(gossip.HISTORY_MAX_LIMIT))
+    }
+    if !req.From.IsZero() && !req.To.IsZero() && req.To.Before(req.From) {
+        return errors.New("to must be after from")
+    }
+    return nil
+}
+
+// Parse the integer parameter name into value, left unchanged if it is missing
+func parseIntParam(form url.Values, name string, value *int) error {
+    if form.Get(name) == "" {
+        return nil
+    }
+    parsed, err := strconv.Atoi(form.Get(name))
+    if err != nil {
+        return errors.New(name + " must be an integer")
+    }
+    *value = parsed
+    return nil
+}
+
+func parseUintParam(form url.Values, name string) (uint64, error) {
+    value := form.Get(name)
+    if value == "" {
+        return 0, nil
+    }
+    parsed, err := strconv.ParseUint(value, 10, 64)
+    if err != nil {
+        return 0, errors.New(name + " must be a positive integer")
+    }
+    return parsed, nil
+}
+
+// Times are accepted in RFC 3339 format or as unix timestamps in seconds
+func parseTimeParam(form url.Values, name string) (time.Time, error) {
+    value := form.Get(name)
+    if value == "" {
+        return time.Time{}, nil
+    }
+    if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+        return time.Unix(seconds, 0), nil
+    }
+    parsed, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return time.Time{}, errors.New(name + " must be an RFC 3339 time or a unix timestamp")
+    }
+    return parsed, nil
+}
+
+// Fill req from the JSON body or the form of r and validate it
+func decodeRequest(w http.ResponseWriter, r *http.Request, req formRequest) error {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType == "application/json" {
+        decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY_SIZE))
+        if err := decoder.Decode(req); err != nil {
+            return errors.New("invalid JSON body: " + err.Error())
+        }
+    } else {
+        if err := r.ParseForm(); err != nil {
+            return errors.New("invalid form: " + err.Error())
+        }
+        if err := req.fromForm(r.Form); err != nil {
+            return err
+        }
+    }
+    return req.validate()
+}
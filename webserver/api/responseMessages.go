@@ -1,40 +1,203 @@
 package api
 
 import (
-    "strings"
-    "github.com/pablo11/Peerster/util/collections"
+    "time"
 )
 
-/* JsonId models the JSON response for request /api/id */
-type JsonId struct {
-    name string
-    address string
+/* ErrorResponse is the body of every error response */
+type ErrorResponse struct {
+    Error ErrorObject `json:"error"`
 }
 
-func (id *JsonId) toByte() []byte {
-    return []byte(`{"name":"` + id.name + `","address":"` + id.address + `"}`)
+type ErrorObject struct {
+    Code int `json:"code"`
+    Message string `json:"message"`
 }
 
-/* JsonPeers models the JSON response for request /api/node */
-type JsonPeers struct {
-    peers []string
+/* LegacyMessage models an element of the response for request /api/messages */
+type LegacyMessage struct {
+    From string `json:"from"`
+    Msg string `json:"msg"`
 }
 
-func (peers *JsonPeers) toByte() []byte {
-    peersStr := strings.Join(collections.Map(peers.peers, func(p string) string{
-        return "\"" + p + "\""
-    }), ",")
-    return []byte(`[` + peersStr + `]`)
+/* Message models a rumor, private or simple message in the responses of /api/v2 */
+type Message struct {
+    // Position in the history of this node, used for pagination
+    Seq uint64 `json:"seq"`
+    Type string `json:"type"`
+    Origin string `json:"origin"`
+    Destination string `json:"destination,omitempty"`
+    ID uint32 `json:"id"`
+    Text string `json:"text"`
+    Timestamp time.Time `json:"timestamp"`
 }
 
-/* JsonOrigins models the JSON response for request /api/origins */
-type JsonOrigins struct {
-    origins []string
+type MessagesResponse struct {
+    Messages []Message `json:"messages"`
+    // Pass as since (or before with order=desc) to get the next page, absent on the last page
+    NextCursor uint64 `json:"nextCursor,omitempty"`
 }
 
-func (origins *JsonOrigins) toByte() []byte {
-    peersStr := strings.Join(collections.Map(origins.origins, func(o string) string{
-        return "\"" + o + "\""
-    }), ",")
-    return []byte(`[` + peersStr + `]`)
+/* DeliveryResponse is the delivery state of a private message sent by this node */
+type DeliveryResponse struct {
+    ID uint32 `json:"id"`
+    Destination string `json:"destination"`
+    // pending, queued (waiting in the mailbox), delivered or failed
+    State string `json:"state"`
+    Attempts int `json:"attempts"`
+}
+
+type MailboxResponse struct {
+    // Seconds undelivered private messages are kept
+    TTL int64 `json:"ttl"`
+    Volunteer bool `json:"volunteer"`
+    // Destination -> number of messages kept for neighbours
+    Deposits map[string]int `json:"deposits"`
+}
+
+/* PrivateMessage models a message of a conversation in the responses of /api/v2/conversations */
+type PrivateMessage struct {
+    // Position in the conversation, used for pagination
+    Seq uint64 `json:"seq"`
+    ID uint32 `json:"id"`
+    Origin string `json:"origin"`
+    Destination string `json:"destination"`
+    Text string `json:"text"`
+    Timestamp time.Time `json:"timestamp"`
+    // Delivery state of the messages sent by this node: pending, queued, delivered or failed
+    State string `json:"state,omitempty"`
+}
+
+type ConversationSummary struct {
+    Peer string `json:"peer"`
+    NbMessages int `json:"nbMessages"`
+    Unread int `json:"unread"`
+    LastMessage PrivateMessage `json:"lastMessage"`
+}
+
+type ConversationsResponse struct {
+    Conversations []ConversationSummary `json:"conversations"`
+    // Total over every conversation
+    Unread int `json:"unread"`
+}
+
+type ConversationResponse struct {
+    Peer string `json:"peer"`
+    Unread int `json:"unread"`
+    Messages []PrivateMessage `json:"messages"`
+}
+
+/* IdResponse models the JSON response for request /api/id */
+type IdResponse struct {
+    Name string `json:"name"`
+    Address string `json:"address"`
+}
+
+type PeersResponse struct {
+    Peers []string `json:"peers"`
+}
+
+type OriginsResponse struct {
+    Origins []string `json:"origins"`
+}
+
+/* LegacyFile models an element of the response for request /api/listFiles */
+type LegacyFile struct {
+    ID string `json:"id"`
+    Path string `json:"path"`
+    Name string `json:"name"`
+}
+
+type FileEntry struct {
+    // Hex metahash, used to download the file from /api/v2/files/{id}
+    ID string `json:"id"`
+    Name string `json:"name"`
+    Size int64 `json:"size"`
+    // "shared" or "downloaded"
+    Source string `json:"source"`
+    // State of the source of shared files: "ok", "changed" or "missing"
+    SourceState string `json:"sourceState,omitempty"`
+}
+
+type FilesResponse struct {
+    Files []FileEntry `json:"files"`
+}
+
+/* SearchResult models an element of the response for request /api/searchResults */
+type SearchResult struct {
+    Filename string `json:"filename"`
+    MetaHash string `json:"metahash"`
+}
+
+type SearchResultV2 struct {
+    Filename string `json:"filename"`
+    MetaHash string `json:"metahash"`
+    NbChunks uint64 `json:"nbChunks"`
+    // Origins having chunks of the file
+    Sources []string `json:"sources"`
+}
+
+type SearchResultsResponse struct {
+    Results []SearchResultV2 `json:"results"`
+}
+
+type Download struct {
+    // Hex metahash
+    ID string `json:"id"`
+    Name string `json:"name"`
+    // "queued", "running" or "paused"
+    State string `json:"state"`
+    Priority int `json:"priority"`
+    Chunks int `json:"chunks"`
+    // 0 until the metafile is downloaded
+    NbChunks int `json:"nbChunks"`
+    Bytes int64 `json:"bytes"`
+    BytesPerSecond float64 `json:"bytesPerSecond"`
+    Sources []DownloadSource `json:"sources"`
+}
+
+type DownloadSource struct {
+    Name string `json:"name"`
+    // Offers every chunk, otherwise nbChunks of them
+    HasAll bool `json:"hasAll"`
+    NbChunks int `json:"nbChunks"`
+    Downloaded int `json:"downloaded"`
+    Pending int `json:"pending"`
+    Failures int `json:"failures"`
+    Abandoned bool `json:"abandoned"`
+}
+
+type DownloadsResponse struct {
+    Downloads []Download `json:"downloads"`
+}
+
+/* RateLimitsResponse models the JSON response for request /api/rateLimits */
+type RateLimitsResponse struct {
+    Throttled map[string]uint64 `json:"throttled"`
+    Banned []BannedSource `json:"banned"`
+    TotalBans uint64 `json:"totalBans"`
+}
+
+type BannedSource struct {
+    Source string `json:"source"`
+    Until time.Time `json:"until"`
+}
+
+/* ReputationResponse models the JSON response for request /api/reputation */
+type ReputationResponse struct {
+    // Peer address -> score
+    Peers map[string]float64 `json:"peers"`
+    // Origin name -> score
+    Origins map[string]float64 `json:"origins"`
+}
+
+/* LogLevelResponse models the JSON response for request /api/logLevel */
+type LogLevelResponse struct {
+    Level string `json:"level"`
+    Subsystems map[string]string `json:"subsystems"`
+}
+
+/* AcceptedResponse is returned by /api/v2 requests starting an asynchronous action */
+type AcceptedResponse struct {
+    Status string `json:"status"`
 }
@@ -0,0 +1,87 @@
+package webserver
+
+import (
+    "os"
+    "net"
+    "time"
+    "math/big"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/x509/pkix"
+    "encoding/pem"
+)
+
+const CERTIFICATE_VALIDITY time.Duration = 365 * 24 * time.Hour
+
+// Return the paths of the certificate and key stored in certDir, generating a
+// self-signed certificate for localhost if they don't exist yet
+func ensureCertificate(certDir string) (string, string, error) {
+    certFile := certDir + "cert.pem"
+    keyFile := certDir + "key.pem"
+
+    _, certErr := os.Stat(certFile)
+    _, keyErr := os.Stat(keyFile)
+    if certErr == nil && keyErr == nil {
+        return certFile, keyFile, nil
+    }
+
+    if err := os.MkdirAll(certDir, 0700); err != nil {
+        return "", "", err
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return "", "", err
+    }
+
+    serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return "", "", err
+    }
+
+    template := x509.Certificate{
+        SerialNumber: serialNumber,
+        Subject: pkix.Name{
+            Organization: []string{"Peerster"},
+            CommonName: "localhost",
+        },
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(CERTIFICATE_VALIDITY),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+        DNSNames: []string{"localhost"},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+    }
+
+    certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err != nil {
+        return "", "", err
+    }
+
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return "", "", err
+    }
+
+    if err := writePEM(certFile, "CERTIFICATE", certDER, 0644); err != nil {
+        return "", "", err
+    }
+    if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+        return "", "", err
+    }
+
+    webLog.Info("Generated self-signed certificate " + certFile)
+    return certFile, keyFile, nil
+}
+
+func writePEM(path, blockType string, data []byte, perm os.FileMode) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return pem.Encode(f, &pem.Block{Type: blockType, Bytes: data})
+}
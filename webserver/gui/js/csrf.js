@@ -0,0 +1,18 @@
+// Repeat the CSRF cookie in a header for every request modifying the node state
+$.ajaxSetup({
+    beforeSend: function(xhr, settings) {
+        if (settings.type != "GET") {
+            xhr.setRequestHeader("X-CSRF-Token", getCookie("peerster_csrf"))
+        }
+    }
+})
+
+function getCookie(name) {
+    for (var cookie of document.cookie.split(";")) {
+        const parts = cookie.trim().split("=")
+        if (parts[0] == name) {
+            return decodeURIComponent(parts.slice(1).join("="))
+        }
+    }
+    return ""
+}
@@ -1,14 +1,60 @@
 $(document).ready(function() {
     listFiles()
-    setInterval(function() {
-        listFiles()
-    }, 2000)
 
     setupFileUpload()
     setupRequestFile()
     setupSearchFile()
+    listenFileEvents()
 })
 
+function listenFileEvents() {
+    if (!window.EventSource) {
+        // Poll files and search results every 2 seconds
+        setInterval(function() {
+            listFiles()
+            getAndDisplaySearchResults()
+        }, 2000)
+        return
+    }
+
+    const events = new EventSource("api/events")
+
+    events.addEventListener("chunkDownloaded", function(e) {
+        const chunk = JSON.parse(e.data)
+        displayDownloadProgress(chunk)
+    })
+
+    events.addEventListener("fileReconstructed", function(e) {
+        const file = JSON.parse(e.data)
+        $("#download-" + file.metahash).remove()
+        listFiles()
+    })
+
+    events.addEventListener("searchMatch", function(e) {
+        const match = JSON.parse(e.data)
+        if (match.fullMatch) {
+            getAndDisplaySearchResults()
+        }
+    })
+}
+
+function displayDownloadProgress(chunk) {
+    if (chunk.nbChunks < 1) {
+        return
+    }
+
+    const id = "download-" + chunk.metahash
+    if ($("#" + id).length == 0) {
+        $("#listDownloads").append('<div class="list-group-item" id="' + id + '"><span class="download-name"></span><progress max="' + chunk.nbChunks + '" value="0" style="width:100%;"></progress></div>')
+    }
+
+    $("#" + id + " .download-name").text(chunk.filename + " (" + chunk.chunk + "/" + chunk.nbChunks + " chunks from " + chunk.from + ")")
+    $("#" + id + " progress").attr({
+        value: chunk.chunk,
+        max: chunk.nbChunks,
+    })
+}
+
 function listFiles() {
     $.get("api/listFiles", function(data, status) {
         // Order by name
@@ -19,8 +65,7 @@ function listFiles() {
         //console.log(data);
         var html = ""
         for (var f of data) {
-            const b64pth = btoa(f.path)
-            html += '<a href="/api/downloadFile?path=' + b64pth + '" target="_blank" class="list-group-item">' + f.name + '</a>'
+            html += '<a href="/api/downloadFile?id=' + encodeURIComponent(f.id) + '" target="_blank" class="list-group-item">' + $("<div>").text(f.name).html() + '</a>'
         }
 
         $("#listFiles").html(html)
@@ -126,9 +171,7 @@ function setupSearchFile() {
     })
 
     $(".search-results").hide()
-    setInterval(function() {
-        getAndDisplaySearchResults()
-    }, 2000)
+    getAndDisplaySearchResults()
 }
 
 function getAndDisplaySearchResults() {
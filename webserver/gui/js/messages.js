@@ -17,17 +17,30 @@ $(document).ready(function() {
         toggleScrollToBottomBtn()
     })
 
-    // Load identity and messages
+    // Load identity and messages, then listen for new ones
     getIdentity(function() {
-        loadMessages()
+        loadMessages(listenMessages)
     })
-
-    // Refresh messages every REFRESH_MESSAGES_PERIOD milliseconds
-    setInterval(function() {
-        loadMessages()
-    }, REFRESH_MESSAGES_PERIOD)
 })
 
+function listenMessages() {
+    if (!window.EventSource) {
+        // Refresh messages every REFRESH_MESSAGES_PERIOD milliseconds
+        setInterval(function() {
+            loadMessages()
+        }, REFRESH_MESSAGES_PERIOD)
+        return
+    }
+
+    // Get new messages pushed by the server as they are delivered
+    const events = new EventSource("api/events")
+    events.addEventListener("rumorDelivered", function(e) {
+        const message = JSON.parse(e.data)
+        messages.push(message)
+        addMessage(message.from, message.msg, message.from == myName)
+    })
+}
+
 function setScrollToBottomBtn() {
     $('.scroll-to-bottom').click(function() {
         $("html, body").animate({ scrollTop: $(document).height() }, 1000);
@@ -66,7 +79,7 @@ function getIdentity(onReturn) {
     })
 }
 
-function loadMessages() {
+function loadMessages(onLoaded) {
     $.get("api/messages", function(data, status) {
         console.log("Refreshing messages");
         if (messages.length != data.length) {
@@ -76,5 +89,9 @@ function loadMessages() {
                 addMessage(data[i].from, data[i].msg, data[i].from == myName, false)
             }
         }
+
+        if (onLoaded) {
+            onLoaded()
+        }
     })
 }
@@ -1,8 +1,76 @@
+// Peer of the conversation currently displayed
+var openConversation = ""
+
 $(document).ready(function() {
     loadAndDisplayOrigins()
     setupSendMessageFrom()
+    loadConversations()
+    listenPrivateMessages()
 })
 
+function listenPrivateMessages() {
+    if (!window.EventSource) {
+        setInterval(refreshConversations, 2000)
+        return
+    }
+
+    // Refresh the conversations when a private message is received
+    const events = new EventSource("api/events")
+    events.addEventListener("privateMessageReceived", function(e) {
+        refreshConversations()
+    })
+    events.addEventListener("privateMessageState", function(e) {
+        refreshConversations()
+    })
+}
+
+function refreshConversations() {
+    loadConversations()
+    if (openConversation != "") {
+        showConversation(openConversation)
+    }
+}
+
+function loadConversations() {
+    $.get("api/v2/conversations", function(data, status) {
+        $("#conversations-list").empty()
+        for (var c of data.conversations) {
+            const item = $('<a href="#" class="list-group-item"><span class="badge"></span><b></b> <span class="text-muted"></span></a>')
+            item.find("b").text(c.peer)
+            item.find(".text-muted").text(c.lastMessage.text)
+            if (c.unread > 0) {
+                item.find(".badge").text(c.unread)
+            }
+            item.click(function(peer) {
+                return function() {
+                    showConversation(peer)
+                    return false
+                }
+            }(c.peer))
+            $("#conversations-list").append(item)
+        }
+    })
+}
+
+function showConversation(peer) {
+    openConversation = peer
+    $.get("api/v2/conversations/" + encodeURIComponent(peer), function(data, status) {
+        $("#conversation-title").text("Conversation with " + peer)
+        $("#conversation-messages").empty()
+        for (var m of data.messages) {
+            const html = $('<div class="well message"><b></b> <small class="text-muted"></small><p class="mb-0"></p></div>')
+            html.find("b").text(m.origin)
+            html.find("small").text(m.state || "")
+            html.find("p").text(m.text)
+            $("#conversation-messages").append(html)
+        }
+
+        if (data.unread > 0) {
+            $.post("api/v2/conversations/" + encodeURIComponent(peer) + "/read", loadConversations)
+        }
+    })
+}
+
 function loadAndDisplayOrigins() {
     $.get("api/origins", function(data, status) {
         const html = data.map(origin => '<a href="#" class="list-group-item" onclick="sendPrivateMessage(this)">' + origin + '</a>')
@@ -40,6 +108,7 @@ function setupSendMessageFrom() {
 
         $("#messageModal").modal("hide")
         displayMsg("Message to " + dest + " sent.")
+        setTimeout(refreshConversations, 500)
 
         return false
     })
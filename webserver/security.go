@@ -0,0 +1,161 @@
+package webserver
+
+import (
+    "mime"
+    "strings"
+    "net/http"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+)
+
+const (
+    TOKEN_COOKIE_NAME = "peerster_token"
+    CSRF_COOKIE_NAME = "peerster_csrf"
+    CSRF_HEADER_NAME = "X-CSRF-Token"
+    CSRF_FORM_FIELD = "csrf_token"
+    CSRF_MAX_FORM_SIZE int64 = 1 << 20 // Maximum size of a form body read to find the CSRF field (1MB)
+)
+
+// Security options of the webserver
+type Config struct {
+    // Bind to 127.0.0.1 instead of every interface
+    LocalhostOnly bool
+    // If not empty, requests must provide this token (Authorization: Bearer header,
+    // "token" query parameter or cookie)
+    Token string
+    // If not empty, requests must provide this password with HTTP basic auth
+    Password string
+    // Serve HTTPS with a self-signed certificate generated on first start
+    TLS bool
+    // Directory where the certificate and its key are stored
+    CertDir string
+}
+
+func (c *Config) authEnabled() bool {
+    return c.Token != "" || c.Password != ""
+}
+
+// Reject requests that don't provide the configured token or password
+func withAuth(c *Config, next http.Handler) http.Handler {
+    if !c.authEnabled() {
+        return next
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if c.Token != "" {
+            if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != r.Header.Get("Authorization") && secureEqual(bearer, c.Token) {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            if cookie, err := r.Cookie(TOKEN_COOKIE_NAME); err == nil && secureEqual(cookie.Value, c.Token) {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            // The token in the URL lets the browser open the GUI, then it's kept in a cookie
+            if token := r.URL.Query().Get("token"); token != "" && secureEqual(token, c.Token) {
+                http.SetCookie(w, &http.Cookie{
+                    Name: TOKEN_COOKIE_NAME,
+                    Value: token,
+                    Path: "/",
+                    HttpOnly: true,
+                    Secure: c.TLS,
+                    SameSite: http.SameSiteStrictMode,
+                })
+                next.ServeHTTP(w, r)
+                return
+            }
+        }
+
+        if c.Password != "" {
+            if _, password, hasBasicAuth := r.BasicAuth(); hasBasicAuth && secureEqual(password, c.Password) {
+                next.ServeHTTP(w, r)
+                return
+            }
+            w.Header().Set("WWW-Authenticate", `Basic realm="Peerster"`)
+        }
+
+        webLog.Warning("Unauthorized request " + r.Method + " " + r.URL.Path + " from " + r.RemoteAddr)
+        w.Header().Set("Server", "Cryptop GO server")
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        w.WriteHeader(401)
+        w.Write([]byte(`{"error":{"code":401,"message":"authentication required"}}`))
+    })
+}
+
+// Protect form endpoints against cross-site request forgery with a double
+// submit cookie: state changing form requests must repeat the value of the
+// CSRF cookie in the X-CSRF-Token header or in the csrf_token field, of the
+// URL for multipart forms. JSON requests can't be sent cross-site without
+// CORS and requests authenticated with a bearer token don't rely on ambient
+// credentials, so both are exempt
+func withCSRF(c *Config, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cookie, err := r.Cookie(CSRF_COOKIE_NAME)
+        if err != nil || cookie.Value == "" {
+            cookie = &http.Cookie{
+                Name: CSRF_COOKIE_NAME,
+                Value: randomToken(),
+                Path: "/",
+                Secure: c.TLS,
+                SameSite: http.SameSiteStrictMode,
+            }
+            http.SetCookie(w, cookie)
+        }
+
+        if needsCSRFCheck(r) {
+            submitted := r.Header.Get(CSRF_HEADER_NAME)
+            if submitted == "" {
+                submitted = formToken(w, r)
+            }
+
+            if err != nil || !secureEqual(submitted, cookie.Value) {
+                webLog.Warning("Rejected request " + r.Method + " " + r.URL.Path + " with missing or invalid CSRF token")
+                w.Header().Set("Server", "Cryptop GO server")
+                w.Header().Set("Content-Type", "application/json; charset=utf-8")
+                w.WriteHeader(403)
+                w.Write([]byte(`{"error":{"code":403,"message":"missing or invalid CSRF token"}}`))
+                return
+            }
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// CSRF token of the csrf_token field. Multipart forms can be large uploads,
+// limited by their handler only: their field is only read from the URL
+func formToken(w http.ResponseWriter, r *http.Request) string {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType == "multipart/form-data" {
+        return r.URL.Query().Get(CSRF_FORM_FIELD)
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, CSRF_MAX_FORM_SIZE)
+    return r.FormValue(CSRF_FORM_FIELD)
+}
+
+func needsCSRFCheck(r *http.Request) bool {
+    if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+        return false
+    }
+
+    if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+        return false
+    }
+
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return mediaType != "application/json"
+}
+
+func secureEqual(a, b string) bool {
+    return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func randomToken() string {
+    token := make([]byte, 32)
+    rand.Read(token)
+    return hex.EncodeToString(token)
+}
@@ -1,18 +1,28 @@
 package webserver
 
 import (
-    "log"
-    "fmt"
+    "os"
     "net/http"
     "github.com/pablo11/Peerster/gossip"
     "github.com/pablo11/Peerster/webserver/api"
+    "github.com/pablo11/Peerster/util/logger"
     "github.com/gorilla/mux"
 )
 
+var webLog = logger.New("web")
 
-func CreateAndRun(g *gossip.Gossiper, webserverPort string) {
-    fmt.Println("\033[0;32mWebserver listening on localhost:" + webserverPort + "\033[0m")
-    fmt.Println()
+
+func CreateAndRun(g *gossip.Gossiper, webserverPort string, config *Config) {
+    listenAddr := ":" + webserverPort
+    if config.LocalhostOnly {
+        listenAddr = "127.0.0.1:" + webserverPort
+    }
+
+    scheme := "http"
+    if config.TLS {
+        scheme = "https"
+    }
+    webLog.Info("\033[0;32mWebserver listening on " + scheme + "://localhost:" + webserverPort + "\033[0m")
 
     r := mux.NewRouter()
     a := api.NewApiHandler(g)
@@ -56,10 +66,71 @@ func CreateAndRun(g *gossip.Gossiper, webserverPort string) {
     // Search file results
     r.HandleFunc("/api/searchResults", a.SearchResults).Methods("GET")
 
+    // Get statistics about throttled packets and banned sources
+    r.HandleFunc("/api/rateLimits", a.GetRateLimits).Methods("GET")
+
+    // Get the reputation score of known peers and origins
+    r.HandleFunc("/api/reputation", a.GetReputation).Methods("GET")
+
+    // Stream new rumors, private messages, downloads, search matches and blocks (Server-Sent Events)
+    r.HandleFunc("/api/events", a.StreamEvents).Methods("GET")
+
+    // Prometheus-compatible metrics
+    r.HandleFunc("/metrics", a.GetMetrics).Methods("GET")
+
+    // Get and set the log level, globally or for a subsystem
+    r.HandleFunc("/api/logLevel", a.GetLogLevel).Methods("GET")
+    r.HandleFunc("/api/logLevel", a.SetLogLevel).Methods("POST")
+
+    // Typed API (JSON or form requests, JSON responses and errors)
+    v2 := r.PathPrefix("/api/v2").Subrouter()
+    v2.HandleFunc("/messages", a.GetMessagesV2).Methods("GET")
+    v2.HandleFunc("/messages", a.SendMessageV2).Methods("POST")
+    v2.HandleFunc("/messages/private/{id}", a.GetDeliveryV2).Methods("GET")
+    v2.HandleFunc("/mailbox", a.GetMailboxV2).Methods("GET")
+    v2.HandleFunc("/conversations", a.ListConversationsV2).Methods("GET")
+    v2.HandleFunc("/conversations/{peer}", a.GetConversationV2).Methods("GET")
+    v2.HandleFunc("/conversations/{peer}/read", a.MarkConversationReadV2).Methods("POST")
+    v2.HandleFunc("/origins", a.GetOriginsV2).Methods("GET")
+    v2.HandleFunc("/peers", a.GetPeersV2).Methods("GET")
+    v2.HandleFunc("/peers", a.AddPeerV2).Methods("POST")
+    v2.HandleFunc("/id", a.GetId).Methods("GET")
+    v2.HandleFunc("/files", a.ListFilesV2).Methods("GET")
+    v2.HandleFunc("/files", a.UploadFileV2).Methods("POST")
+    v2.HandleFunc("/files/{id}", a.GetFileV2).Methods("GET")
+    v2.HandleFunc("/downloads", a.ListDownloadsV2).Methods("GET")
+    v2.HandleFunc("/downloads", a.RequestFileV2).Methods("POST")
+    v2.HandleFunc("/downloads/{id}", a.GetDownloadV2).Methods("GET")
+    v2.HandleFunc("/downloads/{id}", a.CancelDownloadV2).Methods("DELETE")
+    v2.HandleFunc("/downloads/{id}/pause", a.PauseDownloadV2).Methods("POST")
+    v2.HandleFunc("/downloads/{id}/resume", a.ResumeDownloadV2).Methods("POST")
+    v2.HandleFunc("/downloads/{id}/priority", a.SetDownloadPriorityV2).Methods("POST")
+    v2.HandleFunc("/searches", a.SearchFilesV2).Methods("POST")
+    v2.HandleFunc("/searches/results", a.SearchResultsV2).Methods("GET")
+    v2.HandleFunc("/events", a.StreamEvents).Methods("GET")
+    v2.HandleFunc("/rateLimits", a.GetRateLimits).Methods("GET")
+    v2.HandleFunc("/reputation", a.GetReputation).Methods("GET")
+    v2.HandleFunc("/logLevel", a.GetLogLevel).Methods("GET")
+    v2.HandleFunc("/logLevel", a.SetLogLevel).Methods("POST")
+    v2.NotFoundHandler = http.HandlerFunc(a.NotFoundV2)
+    v2.MethodNotAllowedHandler = http.HandlerFunc(a.MethodNotAllowedV2)
+
     // Get the html index page
     r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./webserver/gui/"))))
 
-    http.Handle("/", r)
-
-    log.Fatal(http.ListenAndServe(":" + webserverPort, nil))
+    http.Handle("/", withAuth(config, withCSRF(config, r)))
+
+    var err error
+    if config.TLS {
+        certFile, keyFile, certErr := ensureCertificate(config.CertDir)
+        if certErr != nil {
+            webLog.Error("Could not create the TLS certificate: " + certErr.Error())
+            os.Exit(1)
+        }
+        err = http.ListenAndServeTLS(listenAddr, certFile, keyFile, nil)
+    } else {
+        err = http.ListenAndServe(listenAddr, nil)
+    }
+    webLog.Error(err.Error())
+    os.Exit(1)
 }